@@ -0,0 +1,174 @@
+// Package config reads the connection and registry settings of the
+// toumin commands. A setting comes from, in order of precedence, a
+// command line flag, an environment variable or a JSON config file:
+//
+//	toumin -driver mysql -database amersfoort2 -table-suffix _data tables
+//	TOUMIN_DRIVER=mysql TOUMIN_DATABASE=amersfoort2 toumin tables
+//
+// The config file is given by -config or TOUMIN_CONFIG, and defaults to
+// toumin.json in the working directory, if it exists:
+//
+//	{"driver": "mysql", "database": "amersfoort2", "user": "root",
+//	 "tableSuffix": "_data", "fieldPrefix": "{model}_"}
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/henkburgstra/toumin"
+)
+
+// DefaultFile is the config file that is read if none is given.
+const DefaultFile = "toumin.json"
+
+// Config holds the settings of a connection and its registry.
+type Config struct {
+	Driver      string `json:"driver"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Database    string `json:"database"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	TablePrefix string `json:"tablePrefix"`
+	TableSuffix string `json:"tableSuffix"`
+	FieldPrefix string `json:"fieldPrefix"`
+	// Snapshot is a file written by Registry.SaveSnapshot; if set, the
+	// entities are read from it instead of the database.
+	Snapshot string `json:"snapshot"`
+
+	file string
+}
+
+// settings maps the flags to their environment variables.
+var settings = []struct{ flag, env, usage string }{
+	{"driver", "TOUMIN_DRIVER", "database driver: mysql, mssql or sqlite"},
+	{"host", "TOUMIN_HOST", "database host"},
+	{"port", "TOUMIN_PORT", "database port"},
+	{"database", "TOUMIN_DATABASE", "database name"},
+	{"user", "TOUMIN_USER", "database user"},
+	{"password", "TOUMIN_PASSWORD", "database password"},
+	{"table-prefix", "TOUMIN_TABLE_PREFIX", "table prefix of the registry"},
+	{"table-suffix", "TOUMIN_TABLE_SUFFIX", "table suffix of the registry"},
+	{"field-prefix", "TOUMIN_FIELD_PREFIX", "field prefix of the registry, e.g. {model}_"},
+	{"snapshot", "TOUMIN_SNAPSHOT", "schema snapshot to read the entities from"},
+}
+
+// New returns a Config and defines its settings as flags of flags.
+func New(flags *flag.FlagSet) *Config {
+	c := &Config{Driver: "mysql"}
+	vars := []interface{}{&c.Driver, &c.Host, &c.Port, &c.Database, &c.User, &c.Password,
+		&c.TablePrefix, &c.TableSuffix, &c.FieldPrefix, &c.Snapshot}
+	for i, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		switch v := vars[i].(type) {
+		case *string:
+			flags.StringVar(v, s.flag, *v, usage)
+		case *int:
+			flags.IntVar(v, s.flag, *v, usage)
+		}
+	}
+	flags.StringVar(&c.file, "config", "", "config file (env TOUMIN_CONFIG, default "+DefaultFile+")")
+	return c
+}
+
+// Load completes the settings after flags have been parsed: flags that
+// were not set take their value from the environment or the config file.
+func (c *Config) Load(flags *flag.FlagSet) error {
+	set := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	file, required := c.file, true
+	if file == "" {
+		file = os.Getenv("TOUMIN_CONFIG")
+	}
+	if file == "" {
+		file, required = DefaultFile, false
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("config file %s: %w", file, err)
+		}
+	} else if required || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for _, s := range settings {
+		value, ok := set[s.flag]
+		if !ok {
+			value, ok = os.LookupEnv(s.env)
+		}
+		if !ok {
+			continue
+		}
+		if err := flags.Set(s.flag, value); err != nil {
+			return fmt.Errorf("%s: %w", s.flag, err)
+		}
+	}
+	return nil
+}
+
+// Engine returns an Engine for the connection settings.
+func (c *Config) Engine() (*toumin.Engine, error) {
+	var driver toumin.IEngineDriver
+	switch strings.ToLower(c.Driver) {
+	case "mysql":
+		driver = toumin.MysqlDriver
+	case "mssql":
+		driver = toumin.MssqlDriver
+	case "sqlite":
+		driver = toumin.SqliteDriver
+	default:
+		return nil, fmt.Errorf("Unknown driver %q", c.Driver)
+	}
+	e := toumin.NewEngine(driver)
+	e.SetHost(c.Host)
+	e.SetPort(c.Port)
+	e.SetDatabase(c.Database)
+	e.SetUser(c.User)
+	e.SetPassword(c.Password)
+	return e, nil
+}
+
+// Registry returns a Registry with the affixes of the settings and
+// the entities of the snapshot or, if there is none, of the database.
+// If lazy is set, entities are loaded from the database when they are
+// first used.
+func (c *Config) Registry(lazy bool) (*toumin.Registry, error) {
+	engine, err := c.Engine()
+	if err != nil {
+		return nil, err
+	}
+	r := toumin.NewRegistry(engine)
+	r.SetTablePrefix(c.TablePrefix)
+	r.SetTableSuffix(c.TableSuffix)
+	r.SetFieldPrefix(c.FieldPrefix)
+	if c.Snapshot != "" {
+		f, err := os.Open(c.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := r.LoadSnapshot(f); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", c.Snapshot, err)
+		}
+		return r, nil
+	}
+	if _, err := r.Db(); err != nil {
+		return nil, err
+	}
+	if lazy {
+		r.SetLazy(true)
+	} else {
+		r.LoadEntities()
+	}
+	return r, nil
+}
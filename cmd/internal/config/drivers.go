@@ -0,0 +1,8 @@
+package config
+
+// The database/sql drivers of the toumin engine drivers.
+import (
+	_ "github.com/denisenkom/go-mssqldb"
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
+)
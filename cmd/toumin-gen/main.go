@@ -0,0 +1,59 @@
+// Command toumin-gen generates Go model types for the entities of a
+// database or schema snapshot:
+//
+//	toumin-gen -database amersfoort2 -table-suffix _data -field-prefix '{model}_' \
+//		-package models -o models/models_gen.go
+//	toumin-gen -snapshot schema.json -models patient,behandeling
+//
+// The connection settings may also come from the environment or a
+// config file; see toumin -h.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/henkburgstra/toumin/cmd/internal/config"
+	"github.com/henkburgstra/toumin/gen"
+)
+
+func main() {
+	flags := flag.NewFlagSet("toumin-gen", flag.ExitOnError)
+	cfg := config.New(flags)
+	pkg := flags.String("package", "models", "name of the generated package")
+	models := flags.String("models", "", "comma separated models to generate (default all)")
+	out := flags.String("o", "", "output file (default standard output)")
+	flags.Parse(os.Args[1:])
+
+	if err := run(flags, cfg, *pkg, *models, *out); err != nil {
+		fmt.Fprintln(os.Stderr, "toumin-gen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(flags *flag.FlagSet, cfg *config.Config, pkg, models, out string) error {
+	if err := cfg.Load(flags); err != nil {
+		return err
+	}
+	registry, err := cfg.Registry(false)
+	if err != nil {
+		return err
+	}
+	opts := gen.Options{Package: pkg}
+	if models != "" {
+		opts.Models = strings.Split(models, ",")
+	}
+
+	var b bytes.Buffer
+	if err := gen.Generate(&b, registry, opts); err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(b.Bytes())
+		return err
+	}
+	return os.WriteFile(out, b.Bytes(), 0644)
+}
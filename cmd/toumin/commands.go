@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/henkburgstra/toumin"
+	"github.com/henkburgstra/toumin/filter"
+)
+
+// tables lists the tables of the database, or of the snapshot if the
+// registry is not lazy, with their model names.
+func tables(w io.Writer, r *toumin.Registry) error {
+	names := make([]string, 0)
+	if r.Lazy() {
+		engine, err := r.Engine()
+		if err != nil {
+			return err
+		}
+		names = engine.TableNames()
+	} else {
+		for _, model := range r.EntityNames() {
+			names = append(names, r.Entity(model).Name)
+		}
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tTABLE")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", r.TrimTableAffixes(name), name)
+	}
+	return tw.Flush()
+}
+
+// entity returns the entity of model or an UnknownModelError.
+func entity(r *toumin.Registry, model string) (*toumin.Entity, error) {
+	e := r.Entity(model)
+	if e == nil {
+		return nil, toumin.UnknownModelError{Model: model}
+	}
+	return e, nil
+}
+
+// modelField returns the model field name of column of model.
+func modelField(r *toumin.Registry, model, column string) string {
+	return strings.TrimPrefix(column, strings.Replace(r.FieldPrefix(), "{model}", model, 1))
+}
+
+// describe prints the fields, indexes and relationships of model.
+func describe(w io.Writer, r *toumin.Registry, model string) error {
+	e, err := entity(r, model)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Model %s, table %s\n\n", model, e.Name)
+
+	fmt.Fprintln(tw, "FIELD\tCOLUMN\tTYPE\tKEY\tNULL\tDEFAULT")
+	for _, column := range e.ColumnNames() {
+		f := e.Fields[column]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", modelField(r, model, column), column, f.Type,
+			yes(f.Key), yes(f.Null), f.Default)
+	}
+
+	if len(e.Indexes) > 0 {
+		fmt.Fprintln(tw, "\nINDEX\tUNIQUE\tCOLUMNS")
+		names := make([]string, 0, len(e.Indexes))
+		for name := range e.Indexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			index := e.Indexes[name]
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, yes(index.Unique), strings.Join(index.Columns, ", "))
+		}
+	}
+
+	if len(e.Relationships) > 0 {
+		fmt.Fprintln(tw, "\nFOREIGN KEY\tREFERENCES\tMODEL")
+		for _, rel := range outgoing(e) {
+			fmt.Fprintf(tw, "%s\t%s.%s\t%s\n", rel.ForeignKey, rel.ReferencedTable, rel.ReferencedColumn,
+				r.TrimTableAffixes(rel.ReferencedTable))
+		}
+	}
+	return tw.Flush()
+}
+
+// refs prints the foreign keys of model and those that refer to it.
+func refs(w io.Writer, r *toumin.Registry, model string) error {
+	e, err := entity(r, model)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTION\tMODEL\tFOREIGN KEY\tREFERENCES")
+	for _, rel := range outgoing(e) {
+		fmt.Fprintf(tw, "out\t%s\t%s.%s\t%s.%s\n", r.TrimTableAffixes(rel.ReferencedTable),
+			e.Name, rel.ForeignKey, rel.ReferencedTable, rel.ReferencedColumn)
+	}
+	for _, other := range r.EntityNames() {
+		for _, rel := range outgoing(r.Entity(other)) {
+			if rel.ReferencedTable == e.Name {
+				fmt.Fprintf(tw, "in\t%s\t%s.%s\t%s.%s\n", other,
+					r.Entity(other).Name, rel.ForeignKey, rel.ReferencedTable, rel.ReferencedColumn)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// outgoing returns the relationships of e ordered by foreign key.
+func outgoing(e *toumin.Entity) []toumin.EntityRelationship {
+	relationships := make([]toumin.EntityRelationship, 0, len(e.Relationships))
+	for _, rel := range e.Relationships {
+		relationships = append(relationships, rel)
+	}
+	sort.Slice(relationships, func(i, j int) bool {
+		return relationships[i].ForeignKey < relationships[j].ForeignKey
+	})
+	return relationships
+}
+
+func yes(b bool) string {
+	if b {
+		return "yes"
+	}
+	return ""
+}
+
+// query prints the models of model that pass the filter text, in format
+// table, json, csv, jsonl or xlsx.
+func query(w io.Writer, r *toumin.Registry, model, text, format string) error {
+	e, err := entity(r, model)
+	if err != nil {
+		return err
+	}
+	q := r.Query(model)
+	if text != "" {
+		f, err := filter.Parse(text)
+		if err != nil {
+			return err
+		}
+		if err := r.ValidateFilter(f); err != nil {
+			return err
+		}
+		q.Filter(f)
+	}
+	fields := make([]string, 0, len(e.Fields))
+	for _, column := range e.ColumnNames() {
+		fields = append(fields, modelField(r, model, column))
+	}
+
+	var out rowWriter
+	switch format {
+	case "table":
+		out = &tableWriter{tw: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+	case "json":
+		out = &jsonWriter{w: w}
+	case "csv":
+		_, err := q.ExportCSV(w, toumin.ExportOptions{})
+		return err
+	case "jsonl":
+		_, err := q.ExportJSONL(w, toumin.ExportOptions{})
+		return err
+	case "xlsx":
+		_, err := q.ExportXLSX(w, toumin.ExportOptions{})
+		return err
+	default:
+		return fmt.Errorf("Unknown format %q", format)
+	}
+
+	if err := out.header(fields); err != nil {
+		return err
+	}
+	err = q.ReuseModel(true).Each(func(m toumin.IModel) error {
+		return out.row(fields, m)
+	})
+	if err != nil {
+		return err
+	}
+	return out.close()
+}
+
+// rowWriter writes the models of a query in an output format.
+type rowWriter interface {
+	header(fields []string) error
+	row(fields []string, m toumin.IModel) error
+	close() error
+}
+
+type tableWriter struct {
+	tw *tabwriter.Writer
+}
+
+func (t *tableWriter) header(fields []string) error {
+	_, err := fmt.Fprintln(t.tw, strings.ToUpper(strings.Join(fields, "\t")))
+	return err
+}
+
+func (t *tableWriter) row(fields []string, m toumin.IModel) error {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		if v := m.Field(f); v.IsNil() {
+			values[i] = "NULL"
+		} else {
+			values[i] = strings.ReplaceAll(v.String(), "\t", " ")
+		}
+	}
+	_, err := fmt.Fprintln(t.tw, strings.Join(values, "\t"))
+	return err
+}
+
+func (t *tableWriter) close() error {
+	return t.tw.Flush()
+}
+
+// jsonWriter writes a JSON array of the models, encoded by MarshalJSON.
+type jsonWriter struct {
+	w    io.Writer
+	rows int
+}
+
+func (j *jsonWriter) header(fields []string) error {
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonWriter) row(fields []string, m toumin.IModel) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if j.rows > 0 {
+		io.WriteString(j.w, ",")
+	}
+	j.rows++
+	_, err = fmt.Fprintf(j.w, "\n  %s", data)
+	return err
+}
+
+func (j *jsonWriter) close() error {
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
@@ -0,0 +1,221 @@
+// Command toumin inspects the schema and data of a database through
+// a toumin Registry:
+//
+//	toumin [flags] tables
+//	toumin [flags] describe <model>
+//	toumin [flags] refs <model>
+//	toumin [flags] query <model> [-filter 'patient.geslacht = "M"'] [-format table|json|csv|jsonl|xlsx]
+//	toumin [flags] diagram [<model> -hops n] [-format dot|mermaid]
+//	toumin [flags] import <model> <file.csv|file.jsonl> [-dry-run] [-comma ';']
+//
+// The flags select the connection and the affixes of the registry:
+//
+//	toumin -driver mysql -database amersfoort2 -user root \
+//		-table-suffix _data -field-prefix '{model}_' describe patient
+//
+// Every flag can also be set with an environment variable (TOUMIN_DRIVER,
+// TOUMIN_DATABASE, ...) or in a JSON config file, toumin.json by default.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/henkburgstra/toumin"
+	"github.com/henkburgstra/toumin/cmd/internal/config"
+)
+
+const usage = `Usage: toumin [flags] <command> [arguments]
+
+Commands:
+  tables                  list the tables and their models
+  describe <model>        show the fields, indexes and relationships of a model
+  refs <model>            show the foreign keys from and to a model
+  query <model> [flags]   print the rows of a model; flags:
+      -filter text        a filter in the toumin syntax
+      -format format      table, json, csv, jsonl or xlsx (default table)
+  diagram [<model>] [flags]
+                          print an ER diagram of all models or those near a model; flags:
+      -hops n             the number of relationships from the model (default 1)
+      -format format      dot or mermaid (default dot)
+  import <model> <file> [flags]
+                          import a CSV or JSON Lines file (.jsonl) into a model; flags:
+      -dry-run            validate the rows without inserting them
+      -comma c            the CSV delimiter (default ,)
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("toumin", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	cfg := config.New(flags)
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := cfg.Load(flags); err != nil {
+		fail(err)
+	}
+
+	if err := run(os.Stdout, cfg, flags.Arg(0), flags.Args()[1:]); err != nil {
+		if err == errUsage {
+			flags.Usage()
+			os.Exit(2)
+		}
+		fail(err)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func run(w io.Writer, cfg *config.Config, command string, args []string) error {
+	switch command {
+	case "tables":
+		registry, err := cfg.Registry(true)
+		if err != nil {
+			return err
+		}
+		return tables(w, registry)
+	case "describe", "refs":
+		if len(args) != 1 {
+			return fmt.Errorf("%s needs a model", command)
+		}
+		// refs needs all entities to find the incoming foreign keys.
+		registry, err := cfg.Registry(command == "describe")
+		if err != nil {
+			return err
+		}
+		if command == "describe" {
+			return describe(w, registry, args[0])
+		}
+		return refs(w, registry, args[0])
+	case "query":
+		return runQuery(w, cfg, args)
+	case "diagram":
+		return runDiagram(w, cfg, args)
+	case "import":
+		return runImport(w, cfg, args)
+	}
+	return errUsage
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "toumin:", err)
+	os.Exit(1)
+}
+
+// runQuery parses the arguments of the query command, which may have
+// flags after the model, and prints the rows.
+func runQuery(w io.Writer, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	text := flags.String("filter", "", "filter in the toumin syntax")
+	format := flags.String("format", "table", "output format: table, json, csv, jsonl or xlsx")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("query needs a model")
+	}
+	registry, err := cfg.Registry(true)
+	if err != nil {
+		return err
+	}
+	return query(w, registry, positional[0], *text, *format)
+}
+
+// parseInterspersed parses flags that may follow positional arguments,
+// as in "query patient -filter ...", and returns the positional ones.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// runDiagram parses the arguments of the diagram command and prints
+// the diagram.
+func runDiagram(w io.Writer, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("diagram", flag.ContinueOnError)
+	hops := flags.Int("hops", 1, "number of relationships from the model")
+	format := flags.String("format", "dot", "output format: dot or mermaid")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("diagram takes at most one model")
+	}
+	registry, err := cfg.Registry(false)
+	if err != nil {
+		return err
+	}
+	opts := toumin.DiagramOptions{Hops: *hops}
+	if len(positional) == 1 {
+		opts.Model = positional[0]
+	}
+	switch *format {
+	case "dot":
+		return registry.WriteDot(w, opts)
+	case "mermaid":
+		return registry.WriteMermaid(w, opts)
+	}
+	return fmt.Errorf("Unknown format %q", *format)
+}
+
+// runImport parses the arguments of the import command, imports the
+// file and prints the report.
+func runImport(w io.Writer, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "validate the rows without inserting them")
+	comma := flags.String("comma", ",", "CSV delimiter")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("import needs a model and a file")
+	}
+	if utf8.RuneCountInString(*comma) != 1 {
+		return fmt.Errorf("the delimiter must be a single character")
+	}
+	registry, err := cfg.Registry(true)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(positional[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts := toumin.ImportOptions{DryRun: *dryRun}
+	opts.Comma, _ = utf8.DecodeRuneInString(*comma)
+	var report *toumin.ImportReport
+	if strings.HasSuffix(strings.ToLower(positional[1]), ".jsonl") {
+		report, err = registry.ImportJSONL(positional[0], f, opts)
+	} else {
+		report, err = registry.ImportCSV(positional[0], f, opts)
+	}
+	if report != nil {
+		fmt.Fprint(w, report)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henkburgstra/toumin/cmd/internal/config"
+)
+
+const snapshot = `{"version": 1, "driver": "mysql", "tableSuffix": "_data", "fieldPrefix": "{model}_",
+ "entities": {
+  "patient": {"name": "patient_data", "fields": [
+   {"name": "patient_key", "type": "varchar(25)", "key": true},
+   {"name": "patient_achternaam", "type": "varchar(50)", "null": true}],
+   "indexes": {"patient_achternaam": {"name": "patient_achternaam", "columns": ["patient_achternaam"]}}},
+  "behandeling": {"name": "behandeling_data", "fields": [
+   {"name": "behandeling_key", "type": "varchar(25)", "key": true},
+   {"name": "behandeling_patient", "type": "varchar(25)"}],
+   "relationships": [{"foreignKey": "behandeling_patient", "referencedTable": "patient_data",
+    "referencedColumn": "patient_key"}]}}}`
+
+func makeConfig(t *testing.T) *config.Config {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(snapshot), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("toumin", flag.ContinueOnError)
+	cfg := config.New(flags)
+	flags.Parse([]string{"-config", filepath.Join(t.TempDir(), "none.json"), "-snapshot", path,
+		"-table-suffix", "_data", "-field-prefix", "{model}_"})
+	if err := cfg.Load(flags); err == nil {
+		t.Fatalf("makeConfig(): expected an error for a missing config file")
+	}
+	flags = flag.NewFlagSet("toumin", flag.ContinueOnError)
+	cfg = config.New(flags)
+	t.Setenv("TOUMIN_TABLE_SUFFIX", "_data")
+	t.Setenv("TOUMIN_SNAPSHOT", "overruled.json")
+	flags.Parse([]string{"-snapshot", path, "-field-prefix", "{model}_"})
+	if err := cfg.Load(flags); err != nil {
+		t.Fatalf("makeConfig(): %s", err.Error())
+	}
+	return cfg
+}
+
+func TestCommands(t *testing.T) {
+	cfg := makeConfig(t)
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"tables"}, []string{"behandeling  behandeling_data\npatient      patient_data\n"}},
+		{[]string{"describe", "patient"}, []string{
+			"Model patient, table patient_data",
+			"key         patient_key         varchar(25)  yes",
+			"achternaam  patient_achternaam  varchar(50)       yes",
+			"patient_achternaam          patient_achternaam",
+		}},
+		{[]string{"describe", "behandeling"}, []string{"behandeling_patient  patient_data.patient_key  patient"}},
+		{[]string{"diagram", "patient", "-format", "mermaid"}, []string{"patient ||--o{ behandeling : \"behandeling_patient\""}},
+		{[]string{"refs", "patient"}, []string{"in         behandeling  behandeling_data.behandeling_patient  patient_data.patient_key"}},
+	} {
+		var b bytes.Buffer
+		if err := run(&b, cfg, test.args[0], test.args[1:]); err != nil {
+			t.Errorf("TestCommands(%v): %s", test.args, err.Error())
+			continue
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(b.String(), expected) {
+				t.Errorf("TestCommands(%v): expected %q in\n%s", test.args, expected, b.String())
+			}
+		}
+	}
+	path := filepath.Join(t.TempDir(), "patient.csv")
+	os.WriteFile(path, []byte("key;achternaam\nP1;Leeuwerik\n;Merel\n"), 0644)
+	var b bytes.Buffer
+	if err := run(&b, cfg, "import", []string{"patient", path, "-dry-run", "-comma", ";"}); err != nil {
+		t.Errorf("TestCommands(import): %s", err.Error())
+	}
+	if b.String() != "2 rows read, 0 inserted, 1 errors\nline 3: field key: a value is required\n" {
+		t.Errorf("TestCommands(import): %s", b.String())
+	}
+	if err := run(&bytes.Buffer{}, cfg, "describe", []string{"arts"}); err == nil {
+		t.Errorf("TestCommands(): expected an error for an unknown model")
+	}
+	if err := run(&bytes.Buffer{}, cfg, "drop", nil); err != errUsage {
+		t.Errorf("TestCommands(): expected errUsage, got %v", err)
+	}
+}
+
+func TestDescribeDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "toumin.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []string{
+		`CREATE TABLE patient_data (patient_key varchar(25) PRIMARY KEY, patient_achternaam varchar(50),
+			patient_bsn varchar(9) UNIQUE)`,
+		`CREATE INDEX patient_naam ON patient_data (patient_achternaam)`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flags := flag.NewFlagSet("toumin", flag.ContinueOnError)
+	cfg := config.New(flags)
+	flags.Parse([]string{"-driver", "sqlite", "-database", path, "-table-suffix", "_data", "-field-prefix", "{model}_"})
+	if err := cfg.Load(flags); err != nil {
+		t.Fatalf("TestDescribeDatabase(): %s", err.Error())
+	}
+	var b bytes.Buffer
+	if err := run(&b, cfg, "describe", []string{"patient"}); err != nil {
+		t.Fatalf("TestDescribeDatabase(): %s", err.Error())
+	}
+	for _, expected := range []string{
+		"key         patient_key         varchar(25)  yes",
+		"INDEX                            UNIQUE  COLUMNS",
+		"patient_naam                             patient_achternaam",
+		"sqlite_autoindex_patient_data_2  yes     patient_bsn",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("TestDescribeDatabase(): expected %q in\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	text := flags.String("filter", "", "")
+	format := flags.String("format", "table", "")
+	positional, err := parseInterspersed(flags, []string{"patient", "-filter", `patient.achternaam ^= "Leeuw"`, "-format", "csv"})
+	if err != nil {
+		t.Fatalf("TestParseInterspersed(): %s", err.Error())
+	}
+	if len(positional) != 1 || positional[0] != "patient" || *text != `patient.achternaam ^= "Leeuw"` || *format != "csv" {
+		t.Errorf("TestParseInterspersed(): %v %q %q", positional, *text, *format)
+	}
+}
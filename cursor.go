@@ -0,0 +1,160 @@
+package toumin
+
+import (
+	"database/sql"
+	"iter"
+	"strings"
+)
+
+// Cursor iterates lazily over the result of a Query.
+// Rows are scanned one at a time, so the complete result set
+// never has to be held in memory.
+//
+//	c, err := registry.Query("behandeling").Cursor()
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	for c.Next() {
+//		m := c.Model()
+//	}
+//	return c.Err()
+type Cursor struct {
+	query       *Query
+	rows        *sql.Rows
+	constructor ModelConstructor
+	keyName     string
+	lastKey     string
+	reuse       bool
+	model       IModel
+	err         error
+}
+
+func newCursor(q *Query, reuse bool) (*Cursor, error) {
+	entity := q.registry.Entity(q.model)
+	if entity == nil {
+		return nil, UnknownModelError{q.model}
+	}
+	key := entity.Key()
+	if key == nil {
+		return nil, NoKeyError{entity.Name}
+	}
+	fieldPrefix := strings.Replace(q.registry.FieldPrefix(), "{model}", q.model, 1)
+
+	db, err := q.registry.Db()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(q.Sql(), q.params...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Cursor)
+	c.query = q
+	c.rows = rows
+	c.constructor = q.modelConstructor()
+	c.keyName = strings.TrimPrefix(key.Name, fieldPrefix)
+	c.reuse = reuse
+	return c, nil
+}
+
+// Cursor executes the query and returns a Cursor positioned before
+// the first model. The caller must Close the cursor.
+func (q *Query) Cursor() (*Cursor, error) {
+	return newCursor(q, q.reuse)
+}
+
+// Next advances the cursor to the next model. It returns false when
+// there are no more models or an error occurred; see Err.
+// Consecutive rows with the same key yield a single model, like All.
+func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	for c.rows.Next() {
+		model := c.model
+		if model == nil || !c.reuse {
+			model = c.constructor(c.query.model)
+			model.SetOwner(model)
+			model.SetRegistry(c.query.registry)
+		}
+		model.Scan(c.rows)
+		c.model = model
+		keyValue := model.Field(c.keyName).String()
+		if keyValue != c.lastKey {
+			c.lastKey = keyValue
+			c.query.loadRelations(model)
+			return true
+		}
+	}
+	c.err = c.rows.Err()
+	return false
+}
+
+// Model returns the current model. When model reuse is enabled the
+// same instance is returned on every call, overwritten by Next.
+func (c *Cursor) Model() IModel {
+	return c.model
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close closes the underlying rows. It is safe to call Close more than once.
+func (c *Cursor) Close() error {
+	return c.rows.Close()
+}
+
+// ReuseModel makes Cursor, Each and Iter scan every row into
+// the same model instance instead of constructing a new model per row.
+// This reduces allocations when models are not retained.
+func (q *Query) ReuseModel(reuse bool) *Query {
+	q.reuse = reuse
+	return q
+}
+
+// Each calls fn for every model in the result of the query.
+// Iteration stops at the first error returned by fn.
+func (q *Query) Each(fn func(IModel) error) error {
+	c, err := q.Cursor()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for c.Next() {
+		if err := fn(c.Model()); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// Iter returns an iterator over the models in the result of the query.
+// An error ends the iteration and is yielded with a nil model.
+//
+//	for m, err := range registry.Query("behandeling").Iter() {
+//		if err != nil {
+//			return err
+//		}
+//	}
+func (q *Query) Iter() iter.Seq2[IModel, error] {
+	return func(yield func(IModel, error) bool) {
+		c, err := q.Cursor()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer c.Close()
+		for c.Next() {
+			if !yield(c.Model(), nil) {
+				return
+			}
+		}
+		if err := c.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
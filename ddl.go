@@ -0,0 +1,430 @@
+package toumin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// normalizeType splits a database type into a name that is independent
+// of the database and its arguments: "nvarchar(25)" -> "varchar", "25";
+// "int(11) unsigned" -> "int", "". Unknown types are returned lowercased.
+func normalizeType(t string) (name, args string) {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if i := strings.Index(t, "("); i >= 0 {
+		if j := strings.Index(t[i:], ")"); j >= 0 {
+			args = strings.ReplaceAll(t[i+1:i+j], " ", "")
+			t = strings.TrimSpace(t[:i] + t[i+j+1:])
+		}
+	}
+	for _, modifier := range []string{" unsigned", " zerofill", " identity"} {
+		t = strings.TrimSuffix(t, modifier)
+	}
+
+	switch t {
+	case "tinyint", "smallint", "bigint", "float", "double", "date", "time", "char",
+		"varchar", "text", "binary", "varbinary", "blob":
+		name = t
+	case "mediumint", "int", "integer", "serial":
+		name = "int"
+	case "bigserial":
+		name = "bigint"
+	case "real", "float4":
+		name = "float"
+	case "double precision", "float8":
+		name = "double"
+	case "decimal", "numeric":
+		name = "decimal"
+	case "money", "smallmoney":
+		name, args = "decimal", "19,4"
+	case "bit", "bool", "boolean":
+		name, args = "bool", ""
+	case "datetime", "datetime2", "smalldatetime", "timestamp", "datetimeoffset",
+		"timestamp without time zone", "timestamp with time zone":
+		name = "datetime"
+	case "nchar", "character":
+		name = "char"
+	case "nvarchar", "character varying", "varchar2":
+		name = "varchar"
+	case "ntext", "tinytext", "mediumtext", "longtext", "clob":
+		name = "text"
+	case "tinyblob", "mediumblob", "longblob", "image", "bytea":
+		name = "blob"
+	default:
+		name = t
+	}
+	if args == "max" || args == "-1" {
+		switch name {
+		case "varchar", "char":
+			name, args = "text", ""
+		case "varbinary", "binary":
+			name, args = "blob", ""
+		}
+	}
+	switch name {
+	case "tinyint":
+		if args == "1" {
+			// MySQL's convention for booleans
+			name = "bool"
+		}
+		args = ""
+	case "smallint", "int", "bigint":
+		// display widths
+		args = ""
+	case "datetime", "time", "text", "blob":
+		args = ""
+	}
+	return
+}
+
+// typeLength returns the length of a database type: 25 for "varchar(25)",
+// or 0 if the type has no length.
+func typeLength(t string) int {
+	_, args := normalizeType(t)
+	length, err := strconv.Atoi(args)
+	if err != nil {
+		return 0
+	}
+	return length
+}
+
+// dialectTypes maps the normalized type names to the types of a dialect.
+// A "%s" is replaced by the arguments of the type.
+var dialectTypes = map[dialect]map[string]string{
+	"mysql": {
+		"tinyint": "tinyint", "smallint": "smallint", "int": "int", "bigint": "bigint",
+		"float": "float", "double": "double", "decimal": "decimal(%s)", "bool": "tinyint(1)",
+		"date": "date", "datetime": "datetime", "time": "time",
+		"char": "char(%s)", "varchar": "varchar(%s)", "text": "longtext",
+		"binary": "binary(%s)", "varbinary": "varbinary(%s)", "blob": "longblob",
+	},
+	"mssql": {
+		"tinyint": "tinyint", "smallint": "smallint", "int": "int", "bigint": "bigint",
+		"float": "real", "double": "float", "decimal": "decimal(%s)", "bool": "bit",
+		"date": "date", "datetime": "datetime2", "time": "time",
+		"char": "nchar(%s)", "varchar": "nvarchar(%s)", "text": "nvarchar(max)",
+		"binary": "binary(%s)", "varbinary": "varbinary(%s)", "blob": "varbinary(max)",
+	},
+	"postgres": {
+		"tinyint": "smallint", "smallint": "smallint", "int": "integer", "bigint": "bigint",
+		"float": "real", "double": "double precision", "decimal": "numeric(%s)", "bool": "boolean",
+		"date": "date", "datetime": "timestamp", "time": "time",
+		"char": "char(%s)", "varchar": "varchar(%s)", "text": "text",
+		"binary": "bytea", "varbinary": "bytea", "blob": "bytea",
+	},
+	"sqlite": {
+		"tinyint": "integer", "smallint": "integer", "int": "integer", "bigint": "integer",
+		"float": "real", "double": "real", "decimal": "numeric(%s)", "bool": "integer",
+		"date": "date", "datetime": "datetime", "time": "time",
+		"char": "char(%s)", "varchar": "varchar(%s)", "text": "text",
+		"binary": "blob", "varbinary": "blob", "blob": "blob",
+	},
+}
+
+// defaultKeyLength is the length of a varchar key without a length.
+const defaultKeyLength = 255
+
+// columnType returns the type of field in dialect d.
+func (d dialect) columnType(field *EntityField) string {
+	name, args := normalizeType(field.Type)
+	if args == "" && field.Length > 0 {
+		args = strconv.Itoa(field.Length)
+	}
+	types, ok := dialectTypes[d]
+	if !ok {
+		types = dialectTypes["mysql"]
+	}
+	t, ok := types[name]
+	if !ok {
+		return field.Type
+	}
+	if !strings.Contains(t, "%s") {
+		return t
+	}
+	if args == "" {
+		// Types that need a length get a reasonable default. MySQL and
+		// MSSQL cannot index their text type, so keys get a length.
+		switch name {
+		case "varchar", "varbinary":
+			if field.Key && (d == "mysql" || d == "mssql") {
+				return fmt.Sprintf(t, strconv.Itoa(defaultKeyLength))
+			}
+			if name == "varbinary" {
+				return types["blob"]
+			}
+			return types["text"]
+		case "binary":
+			return types["blob"]
+		case "decimal":
+			return strings.TrimSuffix(t, "(%s)")
+		}
+		args = "1"
+	}
+	return fmt.Sprintf(t, args)
+}
+
+// defaultValue returns the DEFAULT clause value of field: numbers,
+// function calls and expressions as they are, other values as a string.
+func (d dialect) defaultValue(field *EntityField) string {
+	v := strings.TrimSpace(field.Default)
+	switch {
+	case strings.HasPrefix(v, "(") || strings.HasPrefix(v, "'") || strings.Contains(v, "("):
+		return v
+	case strings.EqualFold(v, "CURRENT_TIMESTAMP"), strings.EqualFold(v, "CURRENT_DATE"):
+		return strings.ToUpper(v)
+	}
+	switch field.Kind() {
+	case "int", "float", "decimal", "bool":
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return v
+		}
+	}
+	return d.quoteString(v)
+}
+
+// columnDefinition returns the definition of column name with field.
+func (d dialect) columnDefinition(name string, field *EntityField) string {
+	def := fmt.Sprintf("%s %s", d.quoteIdent(name), d.columnType(field))
+	if field.Key || !field.Null {
+		def += " NOT NULL"
+	}
+	if field.Default != "" && !strings.EqualFold(field.Default, "NULL") {
+		def += " DEFAULT " + d.defaultValue(field)
+	}
+	return def
+}
+
+// quoteIdents returns names as a comma separated list of quoted identifiers.
+func (d dialect) quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = d.quoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// foreignKeyName returns the name of the constraint of relationship r of entity.
+func foreignKeyName(entity *Entity, r EntityRelationship) string {
+	return fmt.Sprintf("fk_%s_%s", entity.Name, r.ForeignKey)
+}
+
+// foreignKeySql returns the constraint definition of relationship r of entity.
+func (d dialect) foreignKeySql(entity *Entity, r EntityRelationship) string {
+	return fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		d.quoteIdent(foreignKeyName(entity, r)), d.quoteIdent(r.ForeignKey),
+		d.quoteIdent(r.ReferencedTable), d.quoteIdent(r.ReferencedColumn))
+}
+
+// createTableSql returns the statements that create entity: CREATE TABLE
+// with the primary key and the foreign keys for which inline(r) is true,
+// followed by CREATE INDEX for its indexes.
+func (d dialect) createTableSql(entity *Entity, inline func(EntityRelationship) bool) []string {
+	defs := make([]string, 0, len(entity.Fields)+len(entity.Relationships)+1)
+	keys := make([]string, 0)
+	for _, name := range entity.ColumnNames() {
+		field := entity.Fields[name]
+		defs = append(defs, d.columnDefinition(name, field))
+		if field.Key {
+			keys = append(keys, name)
+		}
+	}
+	if len(keys) > 0 {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", d.quoteIdents(keys)))
+	}
+	for _, fk := range sortedForeignKeys(entity) {
+		r := entity.Relationships[fk]
+		if inline(r) {
+			defs = append(defs, d.foreignKeySql(entity, r))
+		}
+	}
+
+	statements := []string{fmt.Sprintf("CREATE TABLE %s (\n\t%s\n)", d.quoteIdent(entity.Name), strings.Join(defs, ",\n\t"))}
+	indexes := make([]string, 0, len(entity.Indexes))
+	for name := range entity.Indexes {
+		indexes = append(indexes, name)
+	}
+	sort.Strings(indexes)
+	for _, name := range indexes {
+		statements = append(statements, d.createIndexSql(entity.Name, name, entity.Indexes[name]))
+	}
+	return statements
+}
+
+// indexName returns the name of index, registered under name in entity.Indexes.
+func indexName(name string, index *TableIndex) string {
+	if index.Name != "" {
+		return index.Name
+	}
+	return name
+}
+
+// createIndexSql returns the statement that creates index on table,
+// with the columns of the index.
+func (d dialect) createIndexSql(table, name string, index *TableIndex) string {
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)",
+		unique, d.quoteIdent(indexName(name, index)), d.quoteIdent(table), d.quoteIdents(index.Columns))
+}
+
+func sortedForeignKeys(entity *Entity) []string {
+	fks := make([]string, 0, len(entity.Relationships))
+	for fk := range entity.Relationships {
+		fks = append(fks, fk)
+	}
+	sort.Strings(fks)
+	return fks
+}
+
+// CreateTableSql returns the statements that create the table of entity,
+// with its primary key, indexes and foreign keys.
+func (e *Engine) CreateTableSql(entity *Entity) []string {
+	return dialect(e.driver.Name()).createTableSql(entity, func(EntityRelationship) bool { return true })
+}
+
+// CreateTable creates the table of entity, connecting the engine if it
+// is not connected. The tables that its foreign keys refer to must
+// exist, except on SQLite.
+func (e *Engine) CreateTable(entity *Entity) error {
+	return e.exec(e.CreateTableSql(entity))
+}
+
+// transactionalDdl reports whether DDL statements of dialect d can be
+// rolled back. MySQL commits implicitly before and after each of them.
+func (d dialect) transactionalDdl() bool {
+	return d != "mysql"
+}
+
+// exec executes statements, in a transaction if the dialect of the
+// engine supports transactional DDL, so that a failing statement leaves
+// the database unchanged.
+func (e *Engine) exec(statements []string) error {
+	if err := e.connectOnce(); err != nil {
+		return err
+	}
+	db := e.Db()
+	if !dialect(e.driver.Name()).transactionalDdl() {
+		for _, s := range statements {
+			if _, err := db.Exec(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EntityNames returns the names of the registered entities in
+// alphabetical order.
+func (r *Registry) EntityNames() []string {
+	entities := r.entityMap()
+	names := make([]string, 0, len(entities))
+	for name := range entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SortedEntities returns the registered entities in topological order:
+// an entity comes after the entities that its relationships refer to.
+// Entities in a cycle of relationships are added in alphabetical order.
+func (r *Registry) SortedEntities() []*Entity {
+	entities := r.entityMap()
+	names := make([]string, 0, len(entities))
+	tables := make(map[string]*Entity)
+	for name, entity := range entities {
+		names = append(names, name)
+		tables[entity.Name] = entity
+	}
+	sort.Strings(names)
+
+	sorted := make([]*Entity, 0, len(entities))
+	done := make(map[string]bool)
+	for len(sorted) < len(entities) {
+		added := false
+		for _, name := range names {
+			entity := entities[name]
+			if done[entity.Name] {
+				continue
+			}
+			ready := true
+			for _, rel := range entity.Relationships {
+				if _, ok := tables[rel.ReferencedTable]; ok && rel.ReferencedTable != entity.Name && !done[rel.ReferencedTable] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, entity)
+				done[entity.Name] = true
+				added = true
+			}
+		}
+		if !added {
+			// A cycle: add the first remaining entity and continue.
+			for _, name := range names {
+				if entity := entities[name]; !done[entity.Name] {
+					sorted = append(sorted, entity)
+					done[entity.Name] = true
+					break
+				}
+			}
+		}
+	}
+	return sorted
+}
+
+// CreateSchemaSql returns the statements that create the tables of all
+// registered entities, in topological order. Foreign keys that refer to
+// a table that is created later, in a cycle of relationships, are added
+// with ALTER TABLE at the end. SQLite does not check references on
+// creation and gets all its foreign keys in CREATE TABLE.
+func (r *Registry) CreateSchemaSql() []string {
+	d := r.dialect()
+	created := make(map[string]bool)
+	sorted := r.SortedEntities()
+	registered := make(map[string]bool)
+	for _, entity := range sorted {
+		registered[entity.Name] = true
+	}
+	statements := make([]string, 0)
+	later := make([]string, 0)
+	for _, entity := range sorted {
+		created[entity.Name] = true
+		inline := func(rel EntityRelationship) bool {
+			return d == "sqlite" || created[rel.ReferencedTable] || !registered[rel.ReferencedTable]
+		}
+		statements = append(statements, d.createTableSql(entity, inline)...)
+		for _, fk := range sortedForeignKeys(entity) {
+			if rel := entity.Relationships[fk]; !inline(rel) {
+				later = append(later, fmt.Sprintf("ALTER TABLE %s ADD %s", d.quoteIdent(entity.Name), d.foreignKeySql(entity, rel)))
+			}
+		}
+	}
+	return append(statements, later...)
+}
+
+// CreateSchema creates the tables of all registered entities in the
+// database of the registry, for instance to set up an empty test database.
+// Except on MySQL, the tables are created in a single transaction.
+func (r *Registry) CreateSchema() error {
+	engine, err := r.Engine()
+	if err != nil {
+		return err
+	}
+	return engine.exec(r.CreateSchemaSql())
+}
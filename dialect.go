@@ -0,0 +1,78 @@
+package toumin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dialect is the name of an engine driver ("mysql", "mssql", "sqlite",
+// "postgres"). It selects the SQL that differs between databases, like
+// filter.Translater.Dialect does for filters.
+type dialect string
+
+// dialect returns the dialect of the registry's engine driver.
+func (r *Registry) dialect() dialect {
+	if r.engine == nil || r.engine.Driver() == nil {
+		return ""
+	}
+	return dialect(r.engine.Driver().Name())
+}
+
+// quoteString returns s as an SQL string literal.
+func (d dialect) quoteString(s string) string {
+	s = strings.ReplaceAll(s, "'", "''")
+	if d == "mysql" {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return fmt.Sprintf("'%s'", s)
+}
+
+// quoteIdent returns name as a quoted identifier.
+func (d dialect) quoteIdent(name string) string {
+	switch d {
+	case "mysql":
+		return fmt.Sprintf("`%s`", strings.ReplaceAll(name, "`", "``"))
+	case "mssql":
+		return fmt.Sprintf("[%s]", strings.ReplaceAll(name, "]", "]]"))
+	}
+	return fmt.Sprintf(`"%s"`, strings.ReplaceAll(name, `"`, `""`))
+}
+
+// jsonObject returns the expression that builds a JSON object from
+// pairs of keys and SQL expressions. Not supported on mssql, which
+// builds objects with FOR JSON.
+func (d dialect) jsonObject(keys, exprs []string) string {
+	args := make([]string, 0, 2*len(keys))
+	for i, key := range keys {
+		args = append(args, d.quoteString(key), exprs[i])
+	}
+	function := "JSON_OBJECT"
+	switch d {
+	case "sqlite":
+		function = "json_object"
+	case "postgres":
+		function = "json_build_object"
+	}
+	return fmt.Sprintf("%s(%s)", function, strings.Join(args, ", "))
+}
+
+// jsonArrayAgg returns the aggregate expression that collects the
+// JSON values of expr in an array, or an empty array if there are no rows.
+func (d dialect) jsonArrayAgg(expr string) string {
+	switch d {
+	case "sqlite":
+		return fmt.Sprintf("json_group_array(%s)", expr)
+	case "postgres":
+		return fmt.Sprintf("COALESCE(json_agg(%s), '[]'::json)", expr)
+	}
+	return fmt.Sprintf("COALESCE(JSON_ARRAYAGG(%s), JSON_ARRAY())", expr)
+}
+
+// jsonSubquery returns the expression that embeds the JSON value
+// returned by subquery in an enclosing JSON object.
+func (d dialect) jsonSubquery(subquery string) string {
+	if d == "sqlite" {
+		return fmt.Sprintf("json((%s))", subquery)
+	}
+	return fmt.Sprintf("(%s)", subquery)
+}
@@ -0,0 +1,524 @@
+package toumin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a SchemaChange.
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	}
+	return "~"
+}
+
+// SchemaChange is a difference between two schemas. Item is "entity",
+// "key", "field", "index" or "relationship". Entity is the model name;
+// Name is the model field name of a field or relationship, the fields of
+// an index between parentheses, and empty for entities and keys.
+// Details describe what changed, from the first schema to the second:
+// "type varchar(25) -> varchar(50)".
+type SchemaChange struct {
+	Kind    ChangeKind
+	Item    string
+	Entity  string
+	Name    string
+	Details []string
+}
+
+func (c SchemaChange) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Kind, c.Item, c.Entity)
+	if c.Name != "" {
+		if c.Item == "index" {
+			s += " " + c.Name
+		} else {
+			s += "." + c.Name
+		}
+	}
+	if len(c.Details) > 0 {
+		s += ": " + strings.Join(c.Details, "; ")
+	}
+	return s
+}
+
+// Diff is the result of SchemaDiff.
+type Diff struct {
+	Changes []SchemaChange
+}
+
+// Empty reports whether the schemas are the same.
+func (d *Diff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+// String returns the changes, one per line, such as
+// "+ entity consult", "- field patient.geslacht" and
+// "~ field patient.achternaam: type varchar(50) -> varchar(60); null false -> true".
+func (d *Diff) String() string {
+	lines := make([]string, 0, len(d.Changes))
+	for _, c := range d.Changes {
+		lines = append(lines, c.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (d *Diff) add(kind ChangeKind, item, entity, name string, details ...string) {
+	d.Changes = append(d.Changes, SchemaChange{Kind: kind, Item: item, Entity: entity, Name: name, Details: details})
+}
+
+// SchemaDiff compares the entities of registry a with those of registry b
+// and returns what b adds, removes and changes. Entities are matched by
+// model name and fields by model field name, so registries with different
+// table and field affixes can be compared, e.g. a registry built with
+// RegisterStruct against one loaded from the database.
+//
+// Types are compared after normalization: nvarchar(25) equals varchar(25)
+// and int(11) equals integer. Types that are equal in the dialect of either
+// registry are equal: a boolean in MySQL equals an integer in SQLite.
+func SchemaDiff(a, b *Registry) *Diff {
+	d := new(Diff)
+	for _, model := range mergeNames(a.EntityNames(), b.EntityNames()) {
+		ea, eb := a.Entity(model), b.Entity(model)
+		switch {
+		case ea == nil:
+			d.add(Added, "entity", model, "")
+		case eb == nil:
+			d.add(Removed, "entity", model, "")
+		default:
+			diffEntity(d, model, a, ea, b, eb)
+		}
+	}
+	return d
+}
+
+// mergeNames returns the names of a and b, sorted and without duplicates.
+func mergeNames(a, b []string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(a)+len(b))
+	for _, name := range append(append([]string{}, a...), b...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// modelFields returns the fields of entity by model field name.
+func modelFields(r *Registry, model string, entity *Entity) map[string]*EntityField {
+	prefix := strings.Replace(r.FieldPrefix(), "{model}", model, 1)
+	fields := make(map[string]*EntityField)
+	for column, field := range entity.Fields {
+		fields[strings.TrimPrefix(column, prefix)] = field
+	}
+	return fields
+}
+
+// modelFieldName returns the model field name of column of the
+// entity with table name table.
+func modelFieldName(r *Registry, table, column string) string {
+	model := r.TrimTableAffixes(table)
+	return strings.TrimPrefix(column, strings.Replace(r.FieldPrefix(), "{model}", model, 1))
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func diffEntity(d *Diff, model string, a *Registry, ea *Entity, b *Registry, eb *Entity) {
+	fa, fb := modelFields(a, model, ea), modelFields(b, model, eb)
+
+	keys := func(fields map[string]*EntityField) string {
+		names := make([]string, 0)
+		for name, field := range fields {
+			if field.Key {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return "(" + strings.Join(names, ", ") + ")"
+	}
+	if ka, kb := keys(fa), keys(fb); ka != kb {
+		d.add(Changed, "key", model, "", fmt.Sprintf("%s -> %s", ka, kb))
+	}
+
+	for _, name := range mergeNames(mapKeys(fa), mapKeys(fb)) {
+		switch {
+		case fa[name] == nil:
+			d.add(Added, "field", model, name, fieldDescription(b.dialect(), fb[name]))
+		case fb[name] == nil:
+			d.add(Removed, "field", model, name)
+		default:
+			if details := diffField(a.dialect(), fa[name], b.dialect(), fb[name]); len(details) > 0 {
+				d.add(Changed, "field", model, name, details...)
+			}
+		}
+	}
+
+	ia, ib := modelIndexes(a, ea), modelIndexes(b, eb)
+	for _, name := range mergeNames(mapKeys(ia), mapKeys(ib)) {
+		switch {
+		case ia[name] == nil:
+			d.add(Added, "index", model, name)
+		case ib[name] == nil:
+			d.add(Removed, "index", model, name)
+		case ia[name].Unique != ib[name].Unique:
+			d.add(Changed, "index", model, name, fmt.Sprintf("unique %t -> %t", ia[name].Unique, ib[name].Unique))
+		}
+	}
+
+	ra, rb := modelRelationships(a, ea), modelRelationships(b, eb)
+	for _, name := range mergeNames(mapKeys(ra), mapKeys(rb)) {
+		switch ref, ok := ra[name]; {
+		case !ok:
+			d.add(Added, "relationship", model, name, "references "+rb[name])
+		case rb[name] == "":
+			d.add(Removed, "relationship", model, name)
+		case ref != rb[name]:
+			d.add(Changed, "relationship", model, name, fmt.Sprintf("references %s -> %s", ref, rb[name]))
+		}
+	}
+}
+
+// fieldDescription describes field in dialect d: "varchar(25) NOT NULL".
+func fieldDescription(d dialect, field *EntityField) string {
+	s := d.columnType(field)
+	if !field.Null {
+		s += " NOT NULL"
+	}
+	if v := normalizeDefault(field.Default); v != "" {
+		s += " DEFAULT " + v
+	}
+	return s
+}
+
+func diffField(da dialect, fa *EntityField, db dialect, fb *EntityField) []string {
+	details := make([]string, 0)
+	if da.columnType(fa) != da.columnType(fb) && db.columnType(fa) != db.columnType(fb) {
+		details = append(details, fmt.Sprintf("type %s -> %s", da.columnType(fa), db.columnType(fb)))
+	}
+	if fa.Null != fb.Null {
+		details = append(details, fmt.Sprintf("null %t -> %t", fa.Null, fb.Null))
+	}
+	if va, vb := normalizeDefault(fa.Default), normalizeDefault(fb.Default); va != vb {
+		details = append(details, fmt.Sprintf("default %q -> %q", va, vb))
+	}
+	return details
+}
+
+// normalizeDefault strips the parentheses and quotes that databases put
+// around default values: SQL Server's ((0)) and ('O') become 0 and O.
+// NULL becomes "", no default.
+func normalizeDefault(v string) string {
+	v = strings.TrimSpace(v)
+	for len(v) >= 2 && v[0] == '(' && v[len(v)-1] == ')' {
+		v = strings.TrimSpace(v[1 : len(v)-1])
+	}
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		v = strings.ReplaceAll(v[1:len(v)-1], "''", "'")
+	} else if strings.EqualFold(v, "NULL") {
+		v = ""
+	}
+	return v
+}
+
+// modelIndexes returns the indexes of entity by the model field names
+// of their columns: "(achternaam, geslacht)". Index names are not
+// compared, since they differ between databases, but they are set.
+func modelIndexes(r *Registry, entity *Entity) map[string]*TableIndex {
+	indexes := make(map[string]*TableIndex)
+	for name, index := range entity.Indexes {
+		index := &TableIndex{Name: indexName(name, index), Columns: index.Columns, Unique: index.Unique}
+		columns := make([]string, 0, len(index.Columns))
+		for _, column := range index.Columns {
+			columns = append(columns, modelFieldName(r, entity.Name, column))
+		}
+		indexes["("+strings.Join(columns, ", ")+")"] = index
+	}
+	return indexes
+}
+
+// modelRelationships returns the relationships of entity by the model
+// field name of the foreign key, with the model and field that they
+// refer to: "relatie.key".
+func modelRelationships(r *Registry, entity *Entity) map[string]string {
+	relationships := make(map[string]string)
+	for _, rel := range entity.Relationships {
+		relationships[modelFieldName(r, entity.Name, rel.ForeignKey)] = fmt.Sprintf("%s.%s",
+			r.TrimTableAffixes(rel.ReferencedTable), modelFieldName(r, rel.ReferencedTable, rel.ReferencedColumn))
+	}
+	return relationships
+}
+
+// MigrationSql returns the statements that migrate the database of
+// registry a to the schema of registry b, when d is SchemaDiff(a, b),
+// and the statements that undo the migration. New tables and columns are
+// named as in b; foreign key constraints are assumed to be named like
+// those of CreateSchema. Changes that the dialect of a cannot make, such
+// as changing a column on SQLite, are returned as SQL comments.
+//
+// New tables are created first, in topological order, and removed tables
+// are dropped last, in reverse order. As in CreateSchemaSql, foreign keys
+// between new tables that would refer to a table that does not exist yet
+// are added after the tables, and dropped before removed tables.
+func (d *Diff) MigrationSql(a, b *Registry) (up, down []string) {
+	dialect := a.dialect()
+	var undo [][]string
+	step := func(u, r []string) {
+		up = append(up, u...)
+		undo = append(undo, r)
+	}
+
+	added, removed, changes := d.entityChanges(a, b)
+	fks, dropFks := make([]string, 0), make([]string, 0)
+	for _, eb := range added {
+		u := dialect.createTableSql(eb, added.inline(dialect, eb))
+		for _, fk := range sortedForeignKeys(eb) {
+			if rel := eb.Relationships[fk]; !added.inline(dialect, eb)(rel) {
+				fks = append(fks, dialect.addForeignKeySql(eb, &rel)...)
+				dropFks = append(dropFks, dialect.dropForeignKeySql(eb, &rel)...)
+			}
+		}
+		step(u, []string{"DROP TABLE " + dialect.quoteIdent(eb.Name)})
+	}
+	step(fks, dropFks)
+
+	for _, c := range changes {
+		ea, eb := a.Entity(c.Entity), b.Entity(c.Entity)
+		var u, r []string
+		switch c.Item {
+		case "field":
+			fa, fb := modelFields(a, c.Entity, ea)[c.Name], modelFields(b, c.Entity, eb)[c.Name]
+			switch c.Kind {
+			case Added:
+				u, r = dialect.addColumnSql(ea.Name, fb), dialect.dropColumnSql(ea.Name, fb.Name)
+			case Removed:
+				u, r = dialect.dropColumnSql(ea.Name, fa.Name), dialect.addColumnSql(ea.Name, fa)
+			default:
+				u, r = dialect.alterColumnSql(ea.Name, fa.Name, fb), dialect.alterColumnSql(ea.Name, fa.Name, fa)
+			}
+		case "index":
+			ia, ib := modelIndexes(a, ea)[c.Name], modelIndexes(b, eb)[c.Name]
+			if ib != nil {
+				u = append(u, dialect.dropIndexSql(ea.Name, ia)...)
+				u = append(u, dialect.createIndexSql(ea.Name, ib.Name, indexIn(a, ea, b, eb, ib)))
+			} else {
+				u = dialect.dropIndexSql(ea.Name, ia)
+			}
+			if ia != nil {
+				r = append(r, dialect.dropIndexSql(ea.Name, ib)...)
+				r = append(r, dialect.createIndexSql(ea.Name, ia.Name, ia))
+			} else {
+				r = dialect.dropIndexSql(ea.Name, ib)
+			}
+		case "relationship":
+			ra, rb := relationshipByName(a, ea, c.Name), relationshipByName(b, eb, c.Name)
+			u = append(dialect.dropForeignKeySql(ea, ra), dialect.addForeignKeySql(ea, rb)...)
+			r = append(dialect.dropForeignKeySql(ea, rb), dialect.addForeignKeySql(ea, ra)...)
+		default:
+			u = []string{"-- " + c.String()}
+		}
+		step(u, r)
+	}
+
+	// Removed tables are recreated by the undo statements in topological
+	// order, the reverse of the order in which they are dropped.
+	fks, dropFks = make([]string, 0), make([]string, 0)
+	for _, ea := range removed {
+		for _, fk := range sortedForeignKeys(ea) {
+			if rel := ea.Relationships[fk]; !removed.inline(dialect, ea)(rel) {
+				dropFks = append(dropFks, dialect.dropForeignKeySql(ea, &rel)...)
+				fks = append(fks, dialect.addForeignKeySql(ea, &rel)...)
+			}
+		}
+	}
+	step(dropFks, fks)
+	for i := len(removed) - 1; i >= 0; i-- {
+		ea := removed[i]
+		step([]string{"DROP TABLE " + dialect.quoteIdent(ea.Name)}, dialect.createTableSql(ea, removed.inline(dialect, ea)))
+	}
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		down = append(down, undo[i]...)
+	}
+	return up, down
+}
+
+// createdTables are the tables that a migration creates, in the order
+// in which they are created.
+type createdTables []*Entity
+
+// inline returns whether a foreign key of entity can be part of its
+// CREATE TABLE: its table exists when entity is created. SQLite does not
+// check references on creation.
+func (t createdTables) inline(d dialect, entity *Entity) func(EntityRelationship) bool {
+	return func(rel EntityRelationship) bool {
+		if d == "sqlite" || rel.ReferencedTable == entity.Name {
+			return true
+		}
+		for _, e := range t {
+			if e.Name == rel.ReferencedTable {
+				return true
+			}
+			if e == entity {
+				// The referenced table is created later, if at all.
+				for _, later := range t {
+					if later.Name == rel.ReferencedTable {
+						return false
+					}
+				}
+				return true
+			}
+		}
+		return true
+	}
+}
+
+// entityChanges splits the changes of d into the entities that b adds and
+// a removes, both in topological order, and the other changes.
+func (d *Diff) entityChanges(a, b *Registry) (added, removed createdTables, changes []SchemaChange) {
+	entities := make(map[*Entity]bool)
+	for _, c := range d.Changes {
+		switch {
+		case c.Item == "entity" && c.Kind == Added:
+			entities[b.Entity(c.Entity)] = true
+		case c.Item == "entity" && c.Kind == Removed:
+			entities[a.Entity(c.Entity)] = true
+		default:
+			changes = append(changes, c)
+		}
+	}
+	for _, entity := range b.SortedEntities() {
+		if entities[entity] {
+			added = append(added, entity)
+		}
+	}
+	for _, entity := range a.SortedEntities() {
+		if entities[entity] {
+			removed = append(removed, entity)
+		}
+	}
+	return added, removed, changes
+}
+
+// indexIn returns index of entity eb of registry b with the names of
+// its columns in entity ea of registry a, whose field prefix can differ.
+// Columns that ea does not have keep their name, as they are added with
+// the name of b.
+func indexIn(a *Registry, ea *Entity, b *Registry, eb *Entity, index *TableIndex) *TableIndex {
+	columns := make(map[string]string)
+	for column := range ea.Fields {
+		columns[modelFieldName(a, ea.Name, column)] = column
+	}
+	renamed := &TableIndex{Name: index.Name, Unique: index.Unique, Columns: make([]string, 0, len(index.Columns))}
+	for _, column := range index.Columns {
+		if c, ok := columns[modelFieldName(b, eb.Name, column)]; ok {
+			column = c
+		}
+		renamed.Columns = append(renamed.Columns, column)
+	}
+	return renamed
+}
+
+// relationshipByName returns the relationship of entity whose foreign key
+// has model field name name, or nil.
+func relationshipByName(r *Registry, entity *Entity, name string) *EntityRelationship {
+	for _, rel := range entity.Relationships {
+		if modelFieldName(r, entity.Name, rel.ForeignKey) == name {
+			return &rel
+		}
+	}
+	return nil
+}
+
+func (d dialect) addColumnSql(table string, field *EntityField) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD %s", d.quoteIdent(table), d.columnDefinition(field.Name, field))}
+}
+
+func (d dialect) dropColumnSql(table, column string) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", d.quoteIdent(table), d.quoteIdent(column))}
+}
+
+// alterColumnSql returns the statements that change column of table to field.
+func (d dialect) alterColumnSql(table, column string, field *EntityField) []string {
+	switch d {
+	case "mssql":
+		null := "NULL"
+		if !field.Null {
+			null = "NOT NULL"
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s %s", d.quoteIdent(table), d.quoteIdent(column), d.columnType(field), null)}
+	case "postgres":
+		alter := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s", d.quoteIdent(table), d.quoteIdent(column))
+		statements := []string{fmt.Sprintf("%s TYPE %s", alter, d.columnType(field))}
+		if field.Null {
+			statements = append(statements, alter+" DROP NOT NULL")
+		} else {
+			statements = append(statements, alter+" SET NOT NULL")
+		}
+		if normalizeDefault(field.Default) == "" {
+			statements = append(statements, alter+" DROP DEFAULT")
+		} else {
+			statements = append(statements, alter+" SET DEFAULT "+d.defaultValue(field))
+		}
+		return statements
+	case "sqlite":
+		return []string{fmt.Sprintf("-- SQLite cannot change column %s of %s to %s",
+			column, table, d.columnDefinition(column, field))}
+	}
+	return []string{fmt.Sprintf("ALTER TABLE %s MODIFY %s", d.quoteIdent(table), d.columnDefinition(column, field))}
+}
+
+// dropIndexSql returns the statement that drops the index of table,
+// or nothing if index is nil.
+func (d dialect) dropIndexSql(table string, index *TableIndex) []string {
+	if index == nil {
+		return nil
+	}
+	if d == "mysql" || d == "mssql" {
+		return []string{fmt.Sprintf("DROP INDEX %s ON %s", d.quoteIdent(index.Name), d.quoteIdent(table))}
+	}
+	return []string{"DROP INDEX " + d.quoteIdent(index.Name)}
+}
+
+func (d dialect) addForeignKeySql(entity *Entity, r *EntityRelationship) []string {
+	if r == nil {
+		return nil
+	}
+	if d == "sqlite" {
+		return []string{"-- SQLite cannot add " + d.foreignKeySql(entity, *r)}
+	}
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD %s", d.quoteIdent(entity.Name), d.foreignKeySql(entity, *r))}
+}
+
+func (d dialect) dropForeignKeySql(entity *Entity, r *EntityRelationship) []string {
+	if r == nil {
+		return nil
+	}
+	name := d.quoteIdent(foreignKeyName(entity, *r))
+	switch d {
+	case "sqlite":
+		return []string{"-- SQLite cannot drop constraint " + name}
+	case "mysql":
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", d.quoteIdent(entity.Name), name)}
+	}
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", d.quoteIdent(entity.Name), name)}
+}
@@ -0,0 +1,269 @@
+package toumin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DocumentQuery selects models with their related models as nested
+// JSON documents, built by the database in a single round trip:
+//
+//	data, err := registry.Query("patient").Filter(...).Document().
+//		HasMany("behandelingen").HasOne("huisarts").Bytes()
+//
+// returns
+//
+//	[{"key": "PJJG-AA0010", ..., "behandelingen": [{...}, ...], "huisarts": {...}}, ...]
+//
+// Keys follow the registry's JSONOptions; null values are always included.
+type DocumentQuery struct {
+	query     *Query
+	relations []documentRelation
+	err       error
+}
+
+type documentRelation struct {
+	name         string
+	model        string
+	entity       *Entity
+	many         bool
+	column       string // column of the related entity
+	parentColumn string // column of the parent entity
+}
+
+// Document returns a DocumentQuery for the models selected by q.
+func (q *Query) Document() *DocumentQuery {
+	return &DocumentQuery{query: q}
+}
+
+// HasOne adds the model that foreign key name refers to, like Ref:
+// HasOne("huisarts") follows patient_huisarts.
+func (d *DocumentQuery) HasOne(name string) *DocumentQuery {
+	r := d.query.registry
+	parent := r.Entity(d.query.model)
+	if parent == nil {
+		d.err = UnknownModelError{d.query.model}
+		return d
+	}
+	fk := parent.TranslateModelField(d.query.model, name)
+	relationship, ok := parent.Relationship(fk)
+	if !ok {
+		d.err = fmt.Errorf("Model '%s' has no foreign key '%s'", d.query.model, fk)
+		return d
+	}
+	model := r.TrimTableAffixes(relationship.ReferencedTable)
+	entity := r.Entity(model)
+	if entity == nil {
+		d.err = UnknownModelError{model}
+		return d
+	}
+	d.relations = append(d.relations, documentRelation{
+		name:         name,
+		model:        model,
+		entity:       entity,
+		column:       relationship.ReferencedColumn,
+		parentColumn: fk,
+	})
+	return d
+}
+
+// HasMany adds the models that refer to the selected models, like BackRef.
+// The related model is name itself, or name without a plural ending
+// "en" or "s": HasMany("behandelingen") adds the behandeling models.
+func (d *DocumentQuery) HasMany(name string) *DocumentQuery {
+	r := d.query.registry
+	for _, model := range []string{name, strings.TrimSuffix(name, "en"), strings.TrimSuffix(name, "s")} {
+		if r.Entity(model) != nil {
+			return d.HasManyVia(name, model, "")
+		}
+	}
+	d.err = UnknownModelError{name}
+	return d
+}
+
+// HasManyVia adds the models of model that refer to the selected models
+// through foreign key fk, under key name. If fk is empty, the foreign key
+// is taken from the relationships of model.
+func (d *DocumentQuery) HasManyVia(name, model, fk string) *DocumentQuery {
+	r := d.query.registry
+	parent := r.Entity(d.query.model)
+	entity := r.Entity(model)
+	if parent == nil || entity == nil {
+		d.err = UnknownModelError{model}
+		if parent == nil {
+			d.err = UnknownModelError{d.query.model}
+		}
+		return d
+	}
+	var relationship EntityRelationship
+	ok := false
+	if fk != "" {
+		relationship, ok = entity.Relationship(entity.TranslateModelField(model, fk))
+	} else {
+		relationship, ok = entity.RelationshipTo(parent.Name)
+	}
+	if !ok {
+		d.err = fmt.Errorf("Model '%s' has no foreign key to model '%s'", model, d.query.model)
+		return d
+	}
+	d.relations = append(d.relations, documentRelation{
+		name:         name,
+		model:        model,
+		entity:       entity,
+		many:         true,
+		column:       relationship.ForeignKey,
+		parentColumn: relationship.ReferencedColumn,
+	})
+	return d
+}
+
+// documentKeys returns the sorted columns of entity and their JSON keys.
+func (d *DocumentQuery) documentKeys(model string, entity *Entity) (columns, keys []string) {
+	r := d.query.registry
+	fieldPrefix := strings.Replace(r.FieldPrefix(), "{model}", model, 1)
+	for name := range entity.Fields {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		key := strings.TrimPrefix(column, fieldPrefix)
+		if r.JSONOptions().Keys == ColumnKeys {
+			key = column
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// Sql returns the SQL of the document query and its parameters.
+func (d *DocumentQuery) Sql() (string, []interface{}, error) {
+	if d.err != nil {
+		return "", nil, d.err
+	}
+	q := d.query
+	entity := q.registry.Entity(q.model)
+	if entity == nil {
+		return "", nil, UnknownModelError{q.model}
+	}
+	if q.fromSql {
+		return "", nil, fmt.Errorf("Document queries cannot be built from SQL")
+	}
+	dialect := q.registry.dialect()
+
+	var sql string
+	if dialect == "mssql" {
+		sql = d.mssqlSql(entity)
+	} else {
+		columns, keys := d.documentKeys(q.model, entity)
+		exprs := make([]string, 0, len(columns))
+		for _, column := range columns {
+			exprs = append(exprs, fmt.Sprintf("%s.%s", entity.Name, column))
+		}
+		for i, r := range d.relations {
+			alias := fmt.Sprintf("t%d", i+1)
+			rColumns, rKeys := d.documentKeys(r.model, r.entity)
+			rExprs := make([]string, 0, len(rColumns))
+			for _, column := range rColumns {
+				rExprs = append(rExprs, fmt.Sprintf("%s.%s", alias, column))
+			}
+			object := dialect.jsonObject(rKeys, rExprs)
+			if r.many {
+				object = dialect.jsonArrayAgg(object)
+			}
+			keys = append(keys, r.name)
+			exprs = append(exprs, dialect.jsonSubquery(fmt.Sprintf("SELECT %s FROM %s %s WHERE %s.%s = %s.%s",
+				object, r.entity.Name, alias, alias, r.column, entity.Name, r.parentColumn)))
+		}
+		sql = fmt.Sprintf("SELECT %s FROM %s", dialect.jsonObject(keys, exprs), entity.Name)
+	}
+
+	where, params := q.where()
+	if where != "" {
+		sql += fmt.Sprintf(" WHERE %s", where)
+	}
+	if dialect == "mssql" {
+		sql += " FOR JSON PATH, INCLUDE_NULL_VALUES"
+	}
+	return sql, params, nil
+}
+
+// mssqlSql returns the SELECT ... FROM of a document query for
+// SQL Server, which builds JSON with FOR JSON PATH.
+func (d *DocumentQuery) mssqlSql(entity *Entity) string {
+	dialect := dialect("mssql")
+	q := d.query
+	selectList := func(model, table string, e *Entity) string {
+		columns, keys := d.documentKeys(model, e)
+		l := make([]string, 0, len(columns))
+		for i, column := range columns {
+			l = append(l, fmt.Sprintf("%s.%s AS %s", table, column, dialect.quoteIdent(keys[i])))
+		}
+		return strings.Join(l, ", ")
+	}
+
+	l := []string{selectList(q.model, entity.Name, entity)}
+	for i, r := range d.relations {
+		alias := fmt.Sprintf("t%d", i+1)
+		sub := fmt.Sprintf("SELECT %s FROM %s %s WHERE %s.%s = %s.%s FOR JSON PATH, INCLUDE_NULL_VALUES",
+			selectList(r.model, alias, r.entity), r.entity.Name, alias, alias, r.column, entity.Name, r.parentColumn)
+		if r.many {
+			sub = fmt.Sprintf("JSON_QUERY(ISNULL((%s), '[]'))", sub)
+		} else {
+			sub = fmt.Sprintf("JSON_QUERY((%s, WITHOUT_ARRAY_WRAPPER))", sub)
+		}
+		l = append(l, fmt.Sprintf("%s AS %s", sub, dialect.quoteIdent(r.name)))
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(l, ", "), entity.Name)
+}
+
+// Bytes executes the document query and returns a JSON array
+// with a document per selected model.
+func (d *DocumentQuery) Bytes() ([]byte, error) {
+	sql, params, err := d.Sql()
+	if err != nil {
+		return nil, err
+	}
+	db, err := d.query.registry.Db()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(sql, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// SQL Server returns one JSON array, split over rows;
+	// the other databases return a JSON object per row.
+	mssql := d.query.registry.dialect() == "mssql"
+	docs := make([]string, 0)
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, string(doc))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if mssql {
+		if len(docs) == 0 {
+			return []byte("[]"), nil
+		}
+		return []byte(strings.Join(docs, "")), nil
+	}
+	return []byte("[" + strings.Join(docs, ",") + "]"), nil
+}
+
+// Decode executes the document query and decodes the JSON array into v,
+// e.g. a pointer to a slice of structs.
+func (d *DocumentQuery) Decode(v interface{}) error {
+	data, err := d.Bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -1,8 +1,11 @@
 package toumin
 
 import (
+	"crypto/sha256"
 	"database/sql"
-	//	"fmt"
+	"encoding/hex"
+	"fmt"
+	"sync"
 )
 
 type IEngineDriver interface {
@@ -14,7 +17,13 @@ type IEngineDriver interface {
 	LoadRelationships(e *Engine, registry *Registry)
 }
 
+// Engine connects to a database with a driver. Connect opens the
+// connection pool of the engine once and returns the same pool on later
+// calls, so a pool that is in use is never replaced; Connect and
+// Registry.Engine are safe for concurrent use. Configure an engine
+// before it is shared.
 type Engine struct {
+	mu        sync.Mutex // guards db and connected
 	db        *sql.DB
 	driver    IEngineDriver
 	host      string
@@ -31,7 +40,11 @@ func NewEngine(d IEngineDriver) *Engine {
 	return e
 }
 
+// Db returns the connection pool of the engine, or nil if the engine
+// is not connected.
 func (e *Engine) Db() *sql.DB {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.db
 }
 
@@ -96,7 +109,15 @@ func (e *Engine) Password() string {
 //	}
 //}
 
+// Connect opens the connection pool of the engine, or returns it if the
+// engine is connected already. The pool is shared by every user of the
+// engine: close it only when the engine is no longer used.
 func (e *Engine) Connect() (*sql.DB, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.connected {
+		return e.db, nil
+	}
 	db, err := sql.Open(e.driver.Name(), e.driver.ConnectionString(e))
 	if err == nil {
 		e.db = db
@@ -105,6 +126,12 @@ func (e *Engine) Connect() (*sql.DB, error) {
 	return db, err
 }
 
+// connectOnce connects the engine if it is not connected.
+func (e *Engine) connectOnce() error {
+	_, err := e.Connect()
+	return err
+}
+
 func (e *Engine) LoadRelationships(registry *Registry) {
 	e.driver.LoadRelationships(e, registry)
 }
@@ -118,3 +145,99 @@ func (e *Engine) TableStructure(name string) *Entity {
 	e.driver.TableStructure(e, name, entity)
 	return entity
 }
+
+// TableRelationshipLoader is implemented by drivers that load the
+// relationships of a single table, for lazy loading of entities.
+// TableRelationships returns the relationships in which table is the
+// referring or the referenced table, by referring table. A lazily loaded
+// entity is not registered if they cannot be queried.
+type TableRelationshipLoader interface {
+	TableRelationships(e *Engine, table string) (map[string][]EntityRelationship, error)
+}
+
+// scanRelationships returns the relationships in rows with the columns
+// of the LoadRelationships queries, by referring table.
+func scanRelationships(rows *sql.Rows) map[string][]EntityRelationship {
+	relationships := make(map[string][]EntityRelationship)
+	for rows.Next() {
+		m := NewModel("relationship")
+		m.Scan(rows)
+		table := m.Field("TableName").String()
+		relationships[table] = append(relationships[table], EntityRelationship{
+			ForeignKey:       m.Field("ColumnName").String(),
+			ReferencedTable:  m.Field("ReferencedTableName").String(),
+			ReferencedColumn: m.Field("ReferencedColumnName").String(),
+		})
+	}
+	return relationships
+}
+
+// scanIndexes adds the indexes in rows, with the columns IndexName,
+// ColumnName and NonUnique ordered by index and column position, to entity.
+func scanIndexes(rows *sql.Rows, entity *Entity) {
+	for rows.Next() {
+		m := NewModel("index")
+		m.Scan(rows)
+		name := m.Field("IndexName").String()
+		index, ok := entity.Indexes[name]
+		if !ok {
+			index = &TableIndex{Name: name, Unique: m.Field("NonUnique").Int() == 0}
+			entity.Indexes[name] = index
+		}
+		index.Columns = append(index.Columns, m.Field("ColumnName").String())
+	}
+}
+
+// SchemaChecksummer is implemented by drivers that compute a checksum
+// of the schema of a database in a single query, much faster than
+// introspecting every table. The checksum changes when tables, columns,
+// indexes or foreign keys change.
+type SchemaChecksummer interface {
+	SchemaChecksum(e *Engine) (string, error)
+}
+
+// SchemaChecksum returns the checksum of the schema of the database,
+// if the driver is a SchemaChecksummer.
+func (e *Engine) SchemaChecksum() (string, error) {
+	c, ok := e.driver.(SchemaChecksummer)
+	if !ok {
+		return "", fmt.Errorf("Driver '%s' has no schema checksum", e.driver.Name())
+	}
+	return c.SchemaChecksum(e)
+}
+
+// checksumQuery returns the SHA-256 checksum of the rows of a query.
+func checksumQuery(e *Engine, query string, args ...interface{}) (string, error) {
+	rows, err := e.Db().Query(query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.NullString, len(columns))
+	pValues := make([]interface{}, len(columns))
+	for i := range values {
+		pValues[i] = &values[i]
+	}
+	h := sha256.New()
+	for rows.Next() {
+		if err := rows.Scan(pValues...); err != nil {
+			return "", err
+		}
+		for _, v := range values {
+			if v.Valid {
+				fmt.Fprintf(h, "%q\t", v.String)
+			} else {
+				fmt.Fprint(h, "NULL\t")
+			}
+		}
+		fmt.Fprintln(h)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -23,7 +23,7 @@ func (d mssqlDriver) ConnectionString(e *Engine) string {
 
 func (d mssqlDriver) TableNames(e *Engine) []string {
 	names := make([]string, 0)
-	rows, err := e.db.Query(`SELECT table_name FROM information_schema.tables
+	rows, err := e.Db().Query(`SELECT table_name FROM information_schema.tables
 		WHERE table_type = 'BASE TABLE'`)
 
 	if err != nil {
@@ -42,8 +42,8 @@ func (d mssqlDriver) TableNames(e *Engine) []string {
 }
 
 func (d mssqlDriver) TableStructure(e *Engine, name string, entity *Entity) {
-	rows, err := e.db.Query(`select COLUMN_NAME, DATA_TYPE, IS_NULLABLE,
-		COLUMN_DEFAULT 
+	rows, err := e.Db().Query(`select COLUMN_NAME, DATA_TYPE, IS_NULLABLE,
+		COLUMN_DEFAULT, CHARACTER_MAXIMUM_LENGTH
  		from information_schema.columns 
  		where table_name = ?
  		order by ordinal_position`, name)
@@ -58,43 +58,104 @@ func (d mssqlDriver) TableStructure(e *Engine, name string, entity *Entity) {
 		f := &EntityField{
 			Name:   ts.Field("COLUMN_NAME").String(),
 			Type:   ts.Field("DATA_TYPE").String(),
-			Length: 0,
+			Length: int(ts.Field("CHARACTER_MAXIMUM_LENGTH").Int()),
 			//Key:     ts.Field("Key").String() == "PRI",
 			Null:    ts.Field("IS_NULLABLE").String() == "YES",
 			Default: ts.Field("COLUMN_DEFAULT").String(),
 		}
 		entity.Fields[f.Name] = f
 	}
+	d.tableIndexes(e, name, entity)
 }
 
+// tableIndexes adds the indexes of table name, except the primary key,
+// to entity. Included columns are not part of an index.
+func (d mssqlDriver) tableIndexes(e *Engine, name string, entity *Entity) {
+	rows, err := e.Db().Query(`
+		SELECT i.name AS IndexName, c.name AS ColumnName,
+		CASE WHEN i.is_unique = 1 THEN 0 ELSE 1 END AS NonUnique
+		FROM sys.indexes AS i
+		JOIN sys.index_columns AS ic
+		ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+		JOIN sys.columns AS c
+		ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+		WHERE i.object_id = OBJECT_ID(?) AND i.is_primary_key = 0
+		AND i.is_hypothetical = 0 AND ic.is_included_column = 0
+		ORDER BY i.name, ic.key_ordinal`, name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer rows.Close()
+	scanIndexes(rows, entity)
+}
+
+// mssqlRelationships selects the foreign key columns from sys.foreign_keys,
+// with the columns that scanRelationships reads.
+const mssqlRelationships = `
+	SELECT fk.name AS ConstraintName,
+	OBJECT_NAME(fk.parent_object_id) AS TableName, pc.name AS ColumnName,
+	OBJECT_NAME(fk.referenced_object_id) AS ReferencedTableName,
+	rc.name AS ReferencedColumnName
+	FROM sys.foreign_keys AS fk
+	JOIN sys.foreign_key_columns AS fkc
+	ON fkc.constraint_object_id = fk.object_id
+	JOIN sys.columns AS pc
+	ON pc.object_id = fkc.parent_object_id AND pc.column_id = fkc.parent_column_id
+	JOIN sys.columns AS rc
+	ON rc.object_id = fkc.referenced_object_id AND rc.column_id = fkc.referenced_column_id`
+
 func (d mssqlDriver) LoadRelationships(e *Engine, registry *Registry) {
-	rows, err := e.db.Query(`
-		SELECT rc.CONSTRAINT_NAME AS ConstraintName, 
-		rc.TABLE_NAME AS TableName, kc.COLUMN_NAME AS ColumnName, 
-		rc.REFERENCED_TABLE_NAME AS ReferencedTableName, 
-		kc.REFERENCED_COLUMN_NAME AS ReferencedColumnName, 
-		rc.UPDATE_RULE AS UpdateRule, rc.DELETE_RULE AS DeleteRule 
-		FROM INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS AS rc
-		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kc
-		ON rc.CONSTRAINT_NAME = kc.CONSTRAINT_NAME
-		WHERE rc.CONSTRAINT_SCHEMA = ?
-		ORDER BY rc.TABLE_NAME, kc.COLUMN_NAME`, e.database)
+	rows, err := e.Db().Query(mssqlRelationships + `
+		ORDER BY TableName, ColumnName`)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 	defer rows.Close()
-	for rows.Next() {
-		m := NewModel("relationship")
-		m.Scan(rows)
-		r := EntityRelationship{
-			ForeignKey:       m.Field("ColumnName").String(),
-			ReferencedTable:  m.Field("ReferencedTableName").String(),
-			ReferencedColumn: m.Field("ReferencedColumnName").String(),
+	for table, relationships := range scanRelationships(rows) {
+		entity := registry.loadedEntity(registry.TrimTableAffixes(table))
+		if entity == nil {
+			continue
 		}
-		entity := registry.Entity(registry.TrimTableAffixes(m.Field("TableName").String()))
-		if entity != nil {
+		for _, r := range relationships {
 			entity.AddRelationship(r)
 		}
 	}
 }
+
+// TableRelationships implements TableRelationshipLoader.
+func (d mssqlDriver) TableRelationships(e *Engine, table string) (map[string][]EntityRelationship, error) {
+	rows, err := e.Db().Query(mssqlRelationships+`
+		WHERE fk.parent_object_id = OBJECT_ID(?) OR fk.referenced_object_id = OBJECT_ID(?)
+		ORDER BY TableName, ColumnName`, table, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRelationships(rows), rows.Err()
+}
+
+// SchemaChecksum implements SchemaChecksummer with the columns and
+// foreign keys in INFORMATION_SCHEMA and the indexes in sys.indexes.
+func (d mssqlDriver) SchemaChecksum(e *Engine) (string, error) {
+	return checksumQuery(e, `
+		SELECT 'column' AS item, c.TABLE_NAME AS table_name, c.COLUMN_NAME AS name,
+		c.DATA_TYPE AS type, CAST(c.CHARACTER_MAXIMUM_LENGTH AS nvarchar(20)) AS length,
+		c.IS_NULLABLE AS nullable, c.COLUMN_DEFAULT AS def, rc.CONSTRAINT_NAME AS constraint_name
+		FROM INFORMATION_SCHEMA.COLUMNS AS c
+		LEFT JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kc
+		ON kc.TABLE_NAME = c.TABLE_NAME AND kc.COLUMN_NAME = c.COLUMN_NAME
+		LEFT JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS AS rc
+		ON rc.CONSTRAINT_NAME = kc.CONSTRAINT_NAME
+		UNION ALL
+		SELECT 'index', OBJECT_NAME(i.object_id), i.name, c.name,
+		CAST(ic.key_ordinal AS nvarchar(20)), CAST(i.is_unique AS nvarchar(1)), NULL, NULL
+		FROM sys.indexes AS i
+		JOIN sys.index_columns AS ic
+		ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+		JOIN sys.columns AS c
+		ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+		WHERE OBJECTPROPERTY(i.object_id, 'IsUserTable') = 1 AND ic.is_included_column = 0
+		ORDER BY item, table_name, name, type, constraint_name`)
+}
@@ -24,7 +24,7 @@ func (d mysqlDriver) ConnectionString(e *Engine) string {
 
 func (d mysqlDriver) TableNames(e *Engine) []string {
 	names := make([]string, 0)
-	rows, err := e.db.Query(`SHOW TABLES`)
+	rows, err := e.Db().Query(`SHOW TABLES`)
 
 	if err != nil {
 		return names
@@ -42,7 +42,7 @@ func (d mysqlDriver) TableNames(e *Engine) []string {
 }
 
 func (d mysqlDriver) TableStructure(e *Engine, name string, entity *Entity) {
-	rows, err := e.db.Query(fmt.Sprintf("DESCRIBE %s", name))
+	rows, err := e.Db().Query(fmt.Sprintf("DESCRIBE %s", name))
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -54,17 +54,34 @@ func (d mysqlDriver) TableStructure(e *Engine, name string, entity *Entity) {
 		f := &EntityField{
 			Name:    ts.Field("Field").String(),
 			Type:    ts.Field("Type").String(),
-			Length:  0, // TODO: lengte distilleren uit het type (varchar(8))
+			Length:  typeLength(ts.Field("Type").String()),
 			Key:     ts.Field("Key").String() == "PRI",
 			Null:    ts.Field("Null").String() == "YES",
 			Default: ts.Field("Default").String(),
 		}
 		entity.Fields[f.Name] = f
 	}
+	d.tableIndexes(e, name, entity)
+}
+
+// tableIndexes adds the indexes of table name, except the primary key,
+// to entity.
+func (d mysqlDriver) tableIndexes(e *Engine, name string, entity *Entity) {
+	rows, err := e.Db().Query(`
+		SELECT INDEX_NAME AS IndexName, COLUMN_NAME AS ColumnName, NON_UNIQUE AS NonUnique
+		FROM INFORMATION_SCHEMA.STATISTICS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND INDEX_NAME <> 'PRIMARY'
+		ORDER BY INDEX_NAME, SEQ_IN_INDEX`, e.database, name)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer rows.Close()
+	scanIndexes(rows, entity)
 }
 
 func (d mysqlDriver) LoadRelationships(e *Engine, registry *Registry) {
-	rows, err := e.db.Query(`
+	rows, err := e.Db().Query(`
 		SELECT rc.CONSTRAINT_NAME AS ConstraintName, 
 		rc.TABLE_NAME AS TableName, kc.COLUMN_NAME AS ColumnName, 
 		rc.REFERENCED_TABLE_NAME AS ReferencedTableName, 
@@ -88,9 +105,51 @@ func (d mysqlDriver) LoadRelationships(e *Engine, registry *Registry) {
 			ReferencedTable:  m.Field("ReferencedTableName").String(),
 			ReferencedColumn: m.Field("ReferencedColumnName").String(),
 		}
-		entity := registry.Entity(registry.TrimTableAffixes(m.Field("TableName").String()))
+		entity := registry.loadedEntity(registry.TrimTableAffixes(m.Field("TableName").String()))
 		if entity != nil {
 			entity.AddRelationship(r)
 		}
 	}
 }
+
+// TableRelationships implements TableRelationshipLoader.
+func (d mysqlDriver) TableRelationships(e *Engine, table string) (map[string][]EntityRelationship, error) {
+	rows, err := e.Db().Query(`
+		SELECT rc.CONSTRAINT_NAME AS ConstraintName, 
+		rc.TABLE_NAME AS TableName, kc.COLUMN_NAME AS ColumnName, 
+		rc.REFERENCED_TABLE_NAME AS ReferencedTableName, 
+		kc.REFERENCED_COLUMN_NAME AS ReferencedColumnName, 
+		rc.UPDATE_RULE AS UpdateRule, rc.DELETE_RULE AS DeleteRule 
+		FROM INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS AS rc
+		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kc
+		ON rc.CONSTRAINT_NAME = kc.CONSTRAINT_NAME
+		WHERE rc.CONSTRAINT_SCHEMA = ?
+		AND (rc.TABLE_NAME = ? OR rc.REFERENCED_TABLE_NAME = ?)
+		ORDER BY rc.TABLE_NAME, kc.COLUMN_NAME`, e.database, table, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRelationships(rows), rows.Err()
+}
+
+// SchemaChecksum implements SchemaChecksummer with the columns, indexes
+// and foreign keys in INFORMATION_SCHEMA.
+func (d mysqlDriver) SchemaChecksum(e *Engine) (string, error) {
+	return checksumQuery(e, `
+		SELECT 'column' AS item, c.TABLE_NAME AS table_name, c.COLUMN_NAME AS name,
+		c.COLUMN_TYPE AS type, c.IS_NULLABLE AS nullable, c.COLUMN_DEFAULT AS def,
+		c.COLUMN_KEY AS col_key, kc.REFERENCED_TABLE_NAME AS ref_table,
+		kc.REFERENCED_COLUMN_NAME AS ref_column
+		FROM INFORMATION_SCHEMA.COLUMNS AS c
+		LEFT JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kc
+		ON kc.TABLE_SCHEMA = c.TABLE_SCHEMA AND kc.TABLE_NAME = c.TABLE_NAME
+		AND kc.COLUMN_NAME = c.COLUMN_NAME AND kc.REFERENCED_TABLE_NAME IS NOT NULL
+		WHERE c.TABLE_SCHEMA = ?
+		UNION ALL
+		SELECT 'index', s.TABLE_NAME, s.INDEX_NAME, s.COLUMN_NAME, s.NON_UNIQUE,
+		s.SEQ_IN_INDEX, NULL, NULL, NULL
+		FROM INFORMATION_SCHEMA.STATISTICS AS s
+		WHERE s.TABLE_SCHEMA = ?
+		ORDER BY item, table_name, name, type, ref_table`, e.database, e.database)
+}
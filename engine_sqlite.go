@@ -16,15 +16,17 @@ func (d sqliteDriver) Version() string {
 	return "0.0.1"
 }
 
+// ConnectionString returns the database of the engine: the name of
+// the database file.
 func (d sqliteDriver) ConnectionString(e *Engine) string {
-	return fmt.Sprintf("%s:%s@/%s", e.user, e.password, e.database)
-	//return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
-	//	engine.User, engine.Password, engine.Host, engine.Port, engine.Database)
+	return e.database
 }
 
 func (d sqliteDriver) TableNames(e *Engine) []string {
 	names := make([]string, 0)
-	rows, err := e.db.Query(`SHOW TABLES`)
+	rows, err := e.Db().Query(`SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		ORDER BY name`)
 
 	if err != nil {
 		return names
@@ -42,7 +44,7 @@ func (d sqliteDriver) TableNames(e *Engine) []string {
 }
 
 func (d sqliteDriver) TableStructure(e *Engine, name string, entity *Entity) {
-	rows, err := e.db.Query(fmt.Sprintf("DESCRIBE %s", name))
+	rows, err := e.Db().Query(fmt.Sprintf("PRAGMA table_info(%s)", dialect("sqlite").quoteIdent(name)))
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -52,45 +54,98 @@ func (d sqliteDriver) TableStructure(e *Engine, name string, entity *Entity) {
 		ts := NewModel("fieldstructure")
 		ts.Scan(rows)
 		f := &EntityField{
-			Name:    ts.Field("Field").String(),
-			Type:    ts.Field("Type").String(),
-			Length:  0, // TODO: lengte distilleren uit het type (varchar(8))
-			Key:     ts.Field("Key").String() == "PRI",
-			Null:    ts.Field("Null").String() == "YES",
-			Default: ts.Field("Default").String(),
+			Name:   ts.Field("name").String(),
+			Type:   ts.Field("type").String(),
+			Length: typeLength(ts.Field("type").String()),
+			Key:    ts.Field("pk").Int() > 0,
+			Null:   ts.Field("notnull").Int() == 0 && ts.Field("pk").Int() == 0,
+		}
+		if !ts.Field("dflt_value").IsNil() {
+			f.Default = ts.Field("dflt_value").String()
 		}
 		entity.Fields[f.Name] = f
 	}
+	rows.Close()
+	d.tableIndexes(e, name, entity)
 }
 
-func (d sqliteDriver) LoadRelationships(e *Engine, registry *Registry) {
-	rows, err := e.db.Query(`
-		SELECT rc.CONSTRAINT_NAME AS ConstraintName, 
-		rc.TABLE_NAME AS TableName, kc.COLUMN_NAME AS ColumnName, 
-		rc.REFERENCED_TABLE_NAME AS ReferencedTableName, 
-		kc.REFERENCED_COLUMN_NAME AS ReferencedColumnName, 
-		rc.UPDATE_RULE AS UpdateRule, rc.DELETE_RULE AS DeleteRule 
-		FROM INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS AS rc
-		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE AS kc
-		ON rc.CONSTRAINT_NAME = kc.CONSTRAINT_NAME
-		WHERE rc.CONSTRAINT_SCHEMA = ?
-		ORDER BY rc.TABLE_NAME, kc.COLUMN_NAME`, e.database)
+// tableIndexes adds the indexes of table name, except the one of the
+// primary key, to entity. Those of UNIQUE constraints are included.
+func (d sqliteDriver) tableIndexes(e *Engine, name string, entity *Entity) {
+	rows, err := e.Db().Query(fmt.Sprintf("PRAGMA index_list(%s)", dialect("sqlite").quoteIdent(name)))
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
-	defer rows.Close()
+	indexes := make([]*TableIndex, 0)
 	for rows.Next() {
-		m := NewModel("relationship")
+		m := NewModel("index")
 		m.Scan(rows)
-		r := EntityRelationship{
-			ForeignKey:       m.Field("ColumnName").String(),
-			ReferencedTable:  m.Field("ReferencedTableName").String(),
-			ReferencedColumn: m.Field("ReferencedColumnName").String(),
+		if m.Field("origin").String() == "pk" {
+			continue
+		}
+		indexes = append(indexes, &TableIndex{Name: m.Field("name").String(), Unique: m.Field("unique").Int() == 1})
+	}
+	rows.Close()
+
+	for _, index := range indexes {
+		rows, err := e.Db().Query(fmt.Sprintf("PRAGMA index_info(%s)", dialect("sqlite").quoteIdent(index.Name)))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		for rows.Next() {
+			m := NewModel("indexcolumn")
+			m.Scan(rows)
+			index.Columns = append(index.Columns, m.Field("name").String())
+		}
+		rows.Close()
+		entity.Indexes[index.Name] = index
+	}
+}
+
+// LoadRelationships adds the foreign keys of every table, from
+// TableRelationships, to the registered entities.
+func (d sqliteDriver) LoadRelationships(e *Engine, registry *Registry) {
+	for _, table := range d.TableNames(e) {
+		entity := registry.loadedEntity(registry.TrimTableAffixes(table))
+		if entity == nil {
+			continue
 		}
-		entity := registry.Entity(registry.TrimTableAffixes(m.Field("TableName").String()))
-		if entity != nil {
+		relationships, err := d.TableRelationships(e, table)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		for _, r := range relationships[table] {
 			entity.AddRelationship(r)
 		}
 	}
 }
+
+// TableRelationships implements TableRelationshipLoader. SQLite only
+// lists the foreign keys of table itself, not those that refer to it.
+func (d sqliteDriver) TableRelationships(e *Engine, table string) (map[string][]EntityRelationship, error) {
+	rows, err := e.Db().Query(fmt.Sprintf("PRAGMA foreign_key_list(%s)", dialect("sqlite").quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	relationships := make(map[string][]EntityRelationship)
+	for rows.Next() {
+		m := NewModel("relationship")
+		m.Scan(rows)
+		relationships[table] = append(relationships[table], EntityRelationship{
+			ForeignKey:       m.Field("from").String(),
+			ReferencedTable:  m.Field("table").String(),
+			ReferencedColumn: m.Field("to").String(),
+		})
+	}
+	return relationships, rows.Err()
+}
+
+// SchemaChecksum implements SchemaChecksummer with the definitions
+// of the tables and indexes in sqlite_master.
+func (d sqliteDriver) SchemaChecksum(e *Engine) (string, error) {
+	return checksumQuery(e, `SELECT type, name, sql FROM sqlite_master ORDER BY type, name`)
+}
@@ -2,8 +2,12 @@ package toumin
 
 import (
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"path/filepath"
+	"sort"
 	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
 )
 
 func makeEngine() *Engine {
@@ -14,6 +18,83 @@ func makeEngine() *Engine {
 	return e
 }
 
+// makeSqliteEngine returns an engine connected to a new SQLite database
+// with the statements executed.
+func makeSqliteEngine(t *testing.T, statements ...string) *Engine {
+	e := NewEngine(SqliteDriver)
+	e.SetDatabase(filepath.Join(t.TempDir(), "toumin.db"))
+	db, err := e.Connect()
+	if err != nil {
+		t.Fatalf("makeSqliteEngine(): %s", err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("makeSqliteEngine(): %s: %s", s, err.Error())
+		}
+	}
+	return e
+}
+
+func TestSqliteTableStructure(t *testing.T) {
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE relatie_data (relatie_key varchar(25) PRIMARY KEY)`,
+		`CREATE TABLE patient_data (
+			patient_key varchar(25) NOT NULL PRIMARY KEY,
+			patient_achternaam varchar(50) NOT NULL,
+			patient_geslacht char(1) DEFAULT 'O',
+			patient_bsn varchar(9) UNIQUE,
+			patient_huisarts varchar(25) REFERENCES relatie_data (relatie_key)
+		)`,
+		`CREATE INDEX patient_naam ON patient_data (patient_achternaam, patient_geslacht)`)
+
+	if names := engine.TableNames(); fmt.Sprint(names) != "[patient_data relatie_data]" {
+		t.Errorf("TestSqliteTableStructure(): table names %v", names)
+	}
+	entity := engine.TableStructure("patient_data")
+	if f := entity.Fields["patient_key"]; f == nil || !f.Key || f.Null || f.Length != 25 {
+		t.Errorf("TestSqliteTableStructure(): key field %+v", f)
+	}
+	if f := entity.Fields["patient_geslacht"]; f == nil || !f.Null || f.Default != "'O'" {
+		t.Errorf("TestSqliteTableStructure(): field %+v", f)
+	}
+
+	names := make([]string, 0)
+	for name, index := range entity.Indexes {
+		names = append(names, fmt.Sprintf("%s%v:%t", name, index.Columns, index.Unique))
+	}
+	sort.Strings(names)
+	expected := "[patient_naam[patient_achternaam patient_geslacht]:false" +
+		" sqlite_autoindex_patient_data_2[patient_bsn]:true]"
+	if fmt.Sprint(names) != expected {
+		t.Errorf("TestSqliteTableStructure(): indexes %v", names)
+	}
+
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.LoadEntities()
+	if rel, ok := registry.Entity("patient").Relationship("patient_huisarts"); !ok || rel.ReferencedTable != "relatie_data" {
+		t.Errorf("TestSqliteTableStructure(): relationship %+v", rel)
+	}
+	if keys := upsertKeys(registry.Entity("relatie")); fmt.Sprint(keys) != "[relatie_key]" {
+		t.Errorf("TestSqliteTableStructure(): keys %v", keys)
+	}
+
+	// The introspected indexes match those of an entity defined in code.
+	defined := NewRegistry(NewEngine(SqliteDriver))
+	defined.SetTableSuffix("_data")
+	patient := registry.Entity("patient").clone()
+	patient.Indexes = map[string]*TableIndex{
+		"ix_naam": {Columns: []string{"patient_achternaam", "patient_geslacht"}},
+		"ix_bsn":  {Columns: []string{"patient_bsn"}, Unique: true},
+	}
+	defined.RegisterEntity("patient", patient)
+	defined.RegisterEntity("relatie", registry.Entity("relatie").clone())
+	if d := SchemaDiff(registry, defined); !d.Empty() {
+		t.Errorf("TestSqliteTableStructure(): %s", d)
+	}
+}
+
 func TestConnect(t *testing.T) {
 	engine := makeEngine()
 	db, err := engine.Connect()
@@ -2,6 +2,7 @@ package toumin
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -13,6 +14,14 @@ func (e NoKeyError) Error() string {
 	return fmt.Sprintf("No key defined for table '%s'", e.TableName)
 }
 
+type UnknownModelError struct {
+	Model string
+}
+
+func (e UnknownModelError) Error() string {
+	return fmt.Sprintf("No entity registered for model '%s'", e.Model)
+}
+
 type EntityField struct {
 	Name    string
 	Type    string
@@ -22,7 +31,40 @@ type EntityField struct {
 	Default string
 }
 
+// Kind returns the kind of the field's database type, independent of
+// the database: "int", "float", "decimal", "bool", "date", "datetime",
+// "time", "bytes" or "string".
+func (f *EntityField) Kind() string {
+	t := strings.ToLower(strings.TrimSpace(f.Type))
+	if i := strings.IndexAny(t, "( "); i >= 0 {
+		t = t[:i]
+	}
+	switch t {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "serial", "bigserial":
+		return "int"
+	case "float", "double", "real":
+		return "float"
+	case "decimal", "numeric", "money", "smallmoney":
+		return "decimal"
+	case "bit", "bool", "boolean":
+		return "bool"
+	case "date":
+		return "date"
+	case "datetime", "datetime2", "smalldatetime", "timestamp", "datetimeoffset":
+		return "datetime"
+	case "time":
+		return "time"
+	case "blob", "tinyblob", "mediumblob", "longblob", "binary", "varbinary", "image", "bytea":
+		return "bytes"
+	}
+	return "string"
+}
+
+// TableIndex is an index on the columns of a table.
 type TableIndex struct {
+	Name    string
+	Columns []string
+	Unique  bool
 }
 
 type EntityRelationship struct {
@@ -37,6 +79,7 @@ type Entity struct {
 	Fields        map[string]*EntityField
 	Indexes       map[string]*TableIndex
 	Relationships map[string]EntityRelationship
+	structFields  map[string]string // column -> struct field, from EntityFromStruct
 }
 
 func NewEntity(name string) *Entity {
@@ -48,6 +91,36 @@ func NewEntity(name string) *Entity {
 	return e
 }
 
+// clone returns a copy of e with its own maps of fields, indexes and
+// relationships. The fields and indexes themselves are shared.
+func (e *Entity) clone() *Entity {
+	c := NewEntity(e.Name)
+	c.registry = e.registry
+	for name, field := range e.Fields {
+		c.Fields[name] = field
+	}
+	for name, index := range e.Indexes {
+		c.Indexes[name] = index
+	}
+	for fk, relationship := range e.Relationships {
+		c.Relationships[fk] = relationship
+	}
+	c.structFields = e.structFields
+	return c
+}
+
+// structField returns the name of the struct field that column binds to
+// if the entity is built by EntityFromStruct. The column of a field need
+// not be its name with underscores: PatientID is patient_id, and a tag
+// may set the name of the column.
+func (e *Entity) structField(column string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	name, ok := e.structFields[column]
+	return name, ok
+}
+
 func (e *Entity) KeyCount() int {
 	count := 0
 	for _, field := range e.Fields {
@@ -84,6 +157,18 @@ func (e *Entity) Relationship(fk string) (relationship EntityRelationship, ok bo
 	return
 }
 
+// RelationshipTo returns the relationship of e that refers to table.
+// If there are several, the one with the first foreign key in
+// alphabetical order is returned.
+func (e *Entity) RelationshipTo(table string) (relationship EntityRelationship, ok bool) {
+	for fk, r := range e.Relationships {
+		if r.ReferencedTable == table && (!ok || fk < relationship.ForeignKey) {
+			relationship, ok = r, true
+		}
+	}
+	return
+}
+
 func (e *Entity) Keys() []*EntityField {
 	keyFields := make([]*EntityField, 0)
 	for _, field := range e.Fields {
@@ -94,6 +179,23 @@ func (e *Entity) Keys() []*EntityField {
 	return keyFields
 }
 
+// ColumnNames returns the names of the fields of e: the key fields
+// first, then the other fields, both in alphabetical order.
+func (e *Entity) ColumnNames() []string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ki, kj := e.Fields[names[i]].Key, e.Fields[names[j]].Key
+		if ki != kj {
+			return ki
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
 func (e *Entity) TranslateModelField(model, f string) string {
 	if e.registry == nil {
 		return f
@@ -0,0 +1,231 @@
+package toumin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DiagramOptions select the entities of an ER diagram.
+type DiagramOptions struct {
+	// Model restricts the diagram to this model and the models within
+	// Hops relationships of it. If Model is empty, the diagram has all
+	// registered entities.
+	Model string
+	Hops  int
+}
+
+// diagramEdge is a relationship in an ER diagram: the foreign key of
+// child refers to parent.
+type diagramEdge struct {
+	child, parent string
+	fk            string
+	// cardinality of the child and the parent: "*" or "0..1", "1" or "0..1".
+	many, one string
+}
+
+// diagram returns the models and relationships of the diagram, ordered
+// by name. Relationships to tables without a registered model are left out.
+func (r *Registry) diagram(opts DiagramOptions) ([]string, []diagramEdge, error) {
+	entities := r.entityMap()
+	byTable := make(map[string]string)
+	for model, entity := range entities {
+		byTable[entity.Name] = model
+	}
+
+	edges := make([]diagramEdge, 0)
+	for model, entity := range entities {
+		for _, fk := range sortedForeignKeys(entity) {
+			rel := entity.Relationships[fk]
+			parent, ok := byTable[rel.ReferencedTable]
+			if !ok {
+				continue
+			}
+			e := diagramEdge{child: model, parent: parent, fk: fk, many: "*", one: "1"}
+			if uniqueColumn(entity, fk) {
+				e.many = "0..1"
+			}
+			if f := entity.Fields[fk]; f != nil && f.Null {
+				e.one = "0..1"
+			}
+			edges = append(edges, e)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].child != edges[j].child {
+			return edges[i].child < edges[j].child
+		}
+		return edges[i].fk < edges[j].fk
+	})
+
+	models := make([]string, 0, len(entities))
+	if opts.Model == "" {
+		for model := range entities {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		return models, edges, nil
+	}
+	if _, ok := entities[opts.Model]; !ok {
+		return nil, nil, UnknownModelError{opts.Model}
+	}
+
+	// Breadth-first search along the relationships in both directions.
+	hops := map[string]int{opts.Model: 0}
+	queue := []string{opts.Model}
+	for len(queue) > 0 {
+		model := queue[0]
+		queue = queue[1:]
+		if hops[model] == opts.Hops {
+			continue
+		}
+		for _, e := range edges {
+			for _, next := range [][2]string{{e.child, e.parent}, {e.parent, e.child}} {
+				if _, ok := hops[next[1]]; next[0] == model && !ok {
+					hops[next[1]] = hops[model] + 1
+					queue = append(queue, next[1])
+				}
+			}
+		}
+	}
+	for model := range hops {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	selected := edges[:0]
+	for _, e := range edges {
+		_, child := hops[e.child]
+		_, parent := hops[e.parent]
+		if child && parent {
+			selected = append(selected, e)
+		}
+	}
+	return models, selected, nil
+}
+
+// uniqueColumn reports whether column is the only column of the primary
+// key or of a unique index of entity.
+func uniqueColumn(entity *Entity, column string) bool {
+	if keys := entity.Keys(); len(keys) == 1 && keys[0].Name == column {
+		return true
+	}
+	for _, index := range entity.Indexes {
+		if index.Unique && len(index.Columns) == 1 && index.Columns[0] == column {
+			return true
+		}
+	}
+	return false
+}
+
+// diagramFields returns the key and foreign key fields of the entity of model.
+func (r *Registry) diagramFields(model string) []*EntityField {
+	entity := r.loadedEntity(model)
+	fields := make([]*EntityField, 0)
+	for _, name := range entity.ColumnNames() {
+		if _, fk := entity.Relationships[name]; fk || entity.Fields[name].Key {
+			fields = append(fields, entity.Fields[name])
+		}
+	}
+	return fields
+}
+
+// fieldMarks returns the marks of field f of entity: PK for a key, FK for
+// a foreign key. A field of a diagram has at least one of them.
+func fieldMarks(entity *Entity, f *EntityField) []string {
+	marks := make([]string, 0, 2)
+	if f.Key {
+		marks = append(marks, "PK")
+	}
+	if _, fk := entity.Relationships[f.Name]; fk {
+		marks = append(marks, "FK")
+	}
+	return marks
+}
+
+// WriteDot writes an ER diagram of the registered entities in the
+// Graphviz DOT language. A node lists the key (PK) and foreign key (FK)
+// fields of an entity; an edge leads from the entity with the foreign key
+// to the entity it refers to, and is labelled with the foreign key and
+// the cardinalities of both ends:
+//
+//	behandeling -> patient [label="behandeling_patient", taillabel="*", headlabel="1"]
+func (r *Registry) WriteDot(w io.Writer, opts DiagramOptions) error {
+	models, edges, err := r.diagram(opts)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph toumin {")
+	fmt.Fprintln(b, "\tnode [shape=record, fontname=\"Helvetica\"];")
+	fmt.Fprintln(b, "\tedge [fontname=\"Helvetica\", fontsize=10];")
+	for _, model := range models {
+		rows := make([]string, 0)
+		entity := r.loadedEntity(model)
+		for _, f := range r.diagramFields(model) {
+			row := fmt.Sprintf("%s %s %s", strings.Join(fieldMarks(entity, f), ","), f.Name, f.Type)
+			rows = append(rows, dotRecord(row)+"\\l")
+		}
+		fmt.Fprintf(b, "\t%q [label=\"{%s|%s}\"];\n", model, dotRecord(model), strings.Join(rows, ""))
+	}
+	for _, e := range edges {
+		fmt.Fprintf(b, "\t%q -> %q [label=%q, taillabel=%q, headlabel=%q];\n",
+			e.child, e.parent, e.fk, e.many, e.one)
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// dotRecord escapes the characters of s that are special in record labels.
+func dotRecord(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "{", `\{`, "}", `\}`, "|", `\|`,
+		"<", `\<`, ">", `\>`).Replace(s)
+}
+
+// mermaidCardinality maps the cardinalities of diagramEdge to the
+// notation of Mermaid, for the left (parent) and right (child) side.
+var mermaidCardinality = map[string][2]string{
+	"1":    {"||", "||"},
+	"0..1": {"|o", "o|"},
+	"*":    {"}o", "o{"},
+}
+
+// WriteMermaid writes an ER diagram of the registered entities as
+// a Mermaid erDiagram, with the entities and relationships of WriteDot:
+//
+//	patient ||--o{ behandeling : "behandeling_patient"
+func (r *Registry) WriteMermaid(w io.Writer, opts DiagramOptions) error {
+	models, edges, err := r.diagram(opts)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "erDiagram")
+	for _, model := range models {
+		entity := r.loadedEntity(model)
+		fmt.Fprintf(b, "    %s {\n", mermaidName(model))
+		for _, f := range r.diagramFields(model) {
+			name, _ := normalizeType(f.Type)
+			fmt.Fprintf(b, "        %s %s %s\n", mermaidName(name), mermaidName(f.Name),
+				strings.Join(fieldMarks(entity, f), ", "))
+		}
+		fmt.Fprintln(b, "    }")
+	}
+	for _, e := range edges {
+		fmt.Fprintf(b, "    %s %s--%s %s : %q\n", mermaidName(e.parent), mermaidCardinality[e.one][0],
+			mermaidCardinality[e.many][1], mermaidName(e.child), e.fk)
+	}
+	return b.Flush()
+}
+
+// mermaidName replaces the characters that Mermaid does not accept in
+// names of entities, attributes and types by underscores.
+func mermaidName(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			return c
+		}
+		return '_'
+	}, s)
+}
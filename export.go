@@ -0,0 +1,384 @@
+package toumin
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportOptions configure the export of the models of a query.
+type ExportOptions struct {
+	// Fields are the model fields to export, in order; default all
+	// fields of the entity, keys first.
+	Fields []string
+	// Comma is the field delimiter of CSV; default ','.
+	Comma rune
+	// Sheet is the name of the XLSX worksheet; default the model name.
+	// It is cut to 31 characters, with those Excel forbids replaced by _.
+	Sheet string
+}
+
+// exportField is a column of an export: a model field and its entity field.
+type exportField struct {
+	name  string
+	field *EntityField
+}
+
+// exporter writes the models of a query in an export format.
+type exporter interface {
+	header(fields []exportField) error
+	row(fields []exportField, m IModel) error
+	close() error
+}
+
+// ExportCSV writes the models of the query to w as CSV, with a header of
+// model field names. Null values are empty. It returns the number of
+// models written.
+func (q *Query) ExportCSV(w io.Writer, opts ExportOptions) (int, error) {
+	c := csv.NewWriter(w)
+	if opts.Comma != 0 {
+		c.Comma = opts.Comma
+	}
+	return q.export(opts, &csvExporter{w: c})
+}
+
+// ExportJSONL writes the models of the query to w as JSON Lines: one
+// JSON object per line. Without Fields, the objects are those of
+// MarshalJSON, including preloaded relations.
+func (q *Query) ExportJSONL(w io.Writer, opts ExportOptions) (int, error) {
+	return q.export(opts, &jsonlExporter{w: bufio.NewWriter(w), all: len(opts.Fields) == 0})
+}
+
+// ExportXLSX writes the models of the query to w as an Excel workbook
+// with a single worksheet. Cells are typed by the kinds of the entity
+// fields: numbers, booleans, dates and times are Excel values, the
+// other kinds text. Rows are streamed, so large results do not have to
+// fit in memory.
+func (q *Query) ExportXLSX(w io.Writer, opts ExportOptions) (int, error) {
+	sheet := opts.Sheet
+	if sheet == "" {
+		sheet = q.model
+	}
+	return q.export(opts, &xlsxExporter{zip: zip.NewWriter(w), sheet: sheet})
+}
+
+// export writes the models of q with e.
+func (q *Query) export(opts ExportOptions, e exporter) (int, error) {
+	fields, err := q.exportFields(opts.Fields)
+	if err != nil {
+		return 0, err
+	}
+	if err := e.header(fields); err != nil {
+		return 0, err
+	}
+	c, err := newCursor(q, true)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	n := 0
+	for c.Next() {
+		if err := e.row(fields, c.Model()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := c.Err(); err != nil {
+		return n, err
+	}
+	return n, e.close()
+}
+
+// exportFields returns the columns of an export of the fields names
+// of the model of q; both model field names and column names are accepted.
+func (q *Query) exportFields(names []string) ([]exportField, error) {
+	entity := q.registry.Entity(q.model)
+	if entity == nil {
+		return nil, UnknownModelError{q.model}
+	}
+	fieldPrefix := strings.Replace(q.registry.FieldPrefix(), "{model}", q.model, 1)
+	columns := entity.ColumnNames()
+	if len(names) > 0 {
+		columns = make([]string, 0, len(names))
+		for _, name := range names {
+			column := entity.TranslateModelField(q.model, name)
+			if _, ok := entity.Fields[column]; !ok {
+				return nil, fmt.Errorf("Model '%s' has no field '%s'", q.model, name)
+			}
+			columns = append(columns, column)
+		}
+	}
+	fields := make([]exportField, 0, len(columns))
+	for _, column := range columns {
+		fields = append(fields, exportField{name: strings.TrimPrefix(column, fieldPrefix), field: entity.Fields[column]})
+	}
+	return fields, nil
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) header(fields []exportField) error {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.name
+	}
+	return e.w.Write(names)
+}
+
+func (e *csvExporter) row(fields []exportField, m IModel) error {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		if v := m.Field(f.name); !v.IsNil() {
+			values[i] = v.String()
+		}
+	}
+	return e.w.Write(values)
+}
+
+func (e *csvExporter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExporter struct {
+	w   *bufio.Writer
+	all bool
+}
+
+func (e *jsonlExporter) header(fields []exportField) error {
+	return nil
+}
+
+func (e *jsonlExporter) row(fields []exportField, m IModel) error {
+	var data []byte
+	var err error
+	if e.all {
+		data, err = json.Marshal(m)
+	} else {
+		doc := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			doc[f.name] = jsonValue(m.Field(f.name), f.field)
+		}
+		data, err = json.Marshal(doc)
+	}
+	if err != nil {
+		return err
+	}
+	e.w.Write(data)
+	return e.w.WriteByte('\n')
+}
+
+func (e *jsonlExporter) close() error {
+	return e.w.Flush()
+}
+
+// The parts of a workbook besides the worksheet. Cell styles 1, 2 and 3
+// are the built-in date, date-time and time formats of Excel, style 4
+// is bold for the header.
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="5"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="21" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs></styleSheet>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+const (
+	xlsxDate     = 1
+	xlsxDateTime = 2
+	xlsxTime     = 3
+	xlsxHeader   = 4
+)
+
+// xlsxExporter writes a workbook. The fixed parts are written by header,
+// the worksheet is streamed row by row and finished by close.
+type xlsxExporter struct {
+	zip   *zip.Writer
+	sheet string
+	w     *bufio.Writer
+	rows  int
+}
+
+func (e *xlsxExporter) header(fields []exportField) error {
+	parts := [][2]string{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xmlEscape(xlsxSheetName(e.sheet)))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		f, err := e.zip.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part[1]); err != nil {
+			return err
+		}
+	}
+	f, err := e.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	e.w = bufio.NewWriter(f)
+	e.w.WriteString(xlsxSheetStart)
+
+	e.startRow()
+	for i, f := range fields {
+		e.inlineString(i, f.name, xlsxHeader)
+	}
+	_, err = e.w.WriteString("</row>")
+	return err
+}
+
+// xlsxSheetName returns name as a valid worksheet name: at most 31
+// characters, with the characters that Excel does not allow replaced by _.
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > 31 {
+		name = string(r[:31])
+	}
+	return name
+}
+
+func (e *xlsxExporter) row(fields []exportField, m IModel) error {
+	e.startRow()
+	for i, f := range fields {
+		e.cell(i, m.Field(f.name), f.field)
+	}
+	_, err := e.w.WriteString("</row>")
+	return err
+}
+
+func (e *xlsxExporter) close() error {
+	e.w.WriteString(xlsxSheetEnd)
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
+
+func (e *xlsxExporter) startRow() {
+	e.rows++
+	fmt.Fprintf(e.w, `<row r="%d">`, e.rows)
+}
+
+// cell writes the value v of field in column i of the current row.
+func (e *xlsxExporter) cell(i int, v *FieldValue, field *EntityField) {
+	value := jsonValue(v, field)
+	if value == nil {
+		return
+	}
+	ref := xlsxColumn(i) + strconv.Itoa(e.rows)
+	switch x := value.(type) {
+	case bool:
+		b := 0
+		if x {
+			b = 1
+		}
+		fmt.Fprintf(e.w, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+		return
+	case int64, int, int32, int16, int8, float64, float32, json.Number:
+		// NaN and infinity are not numbers in a worksheet.
+		if f, err := strconv.ParseFloat(fmt.Sprint(x), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			fmt.Fprintf(e.w, `<c r="%s"><v>%v</v></c>`, ref, x)
+			return
+		}
+	case time.Time:
+		fmt.Fprintf(e.w, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxDateTime, excelSerial(x))
+		return
+	}
+
+	s := fmt.Sprint(value)
+	if field != nil {
+		style := 0
+		switch field.Kind() {
+		case "date":
+			style = xlsxDate
+		case "datetime":
+			style = xlsxDateTime
+		case "time":
+			style = xlsxTime
+		}
+		if style != 0 {
+			if t, ok := parseExcelTime(s, style); ok {
+				fmt.Fprintf(e.w, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, excelSerial(t))
+				return
+			}
+		}
+	}
+	e.inlineString(i, s, 0)
+}
+
+func (e *xlsxExporter) inlineString(i int, s string, style int) {
+	ref := xlsxColumn(i) + strconv.Itoa(e.rows)
+	if style != 0 {
+		fmt.Fprintf(e.w, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xmlEscape(s))
+	} else {
+		fmt.Fprintf(e.w, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xmlEscape(s))
+	}
+}
+
+// xlsxColumn returns the name of column i: 0 -> A, 26 -> AA.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// parseExcelTime parses the text of a date, date-time or time value.
+func parseExcelTime(s string, style int) (time.Time, bool) {
+	layouts := []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"}
+	if style == xlsxTime {
+		layouts = []string{"15:04:05.999999999", "15:04"}
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			if style == xlsxTime {
+				t = time.Date(1899, 12, 30, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// excelSerial returns t as an Excel serial date: the days since
+// 30 December 1899, with the time of day as fraction.
+func excelSerial(t time.Time) string {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	seconds := t.Unix() - time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Unix()
+	days := (float64(seconds) + float64(t.Nanosecond())/1e9) / 86400
+	return strconv.FormatFloat(days, 'f', -1, 64)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,327 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Document is a structured query, such as a MongoDB filter document
+// or an Elasticsearch query clause. It can be encoded with encoding/json.
+type Document map[string]interface{}
+
+// DocumentTranslater translates a Filter to a Document instead of
+// an SQL string, for targets that take structured queries.
+type DocumentTranslater interface {
+	TranslateDocument(f *Filter) (Document, error)
+}
+
+// fieldPath returns the path of field f of entity e in a document:
+// the name returned by names, or else "e.f".
+func fieldPath(names NameTranslater, e, f string) string {
+	if names != nil {
+		return names.TranslateField(e, f)
+	}
+	return fmt.Sprintf("%s.%s", e, f)
+}
+
+// translateDocument translates the Params of f with param and combines
+// them with and. A filter without params translates to all, the
+// document that matches everything.
+func translateDocument(f *Filter, param func(interface{}) (Document, error),
+	and func([]interface{}) Document, all Document) (Document, error) {
+	docs := make([]interface{}, 0, len(f.Params))
+	for _, p := range f.Params {
+		d, err := param(p)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	switch len(docs) {
+	case 0:
+		return all, nil
+	case 1:
+		return docs[0].(Document), nil
+	}
+	return and(docs), nil
+}
+
+// MongoTranslater translates filters to MongoDB query documents:
+//
+//	{"$and": [{"patient.geslacht": {"$eq": "M"}}, {"onderzoek.datum": {"$regex": "^2015"}}]}
+//
+// Field paths are "entity.field", unless Names is set. An empty filter
+// or AND translates to {}, which matches every document; an empty OR
+// or NOT to {"$expr": false}, which matches none.
+type MongoTranslater struct {
+	Names NameTranslater
+}
+
+func (t MongoTranslater) TranslateDocument(f *Filter) (Document, error) {
+	return translateDocument(f, t.param, func(docs []interface{}) Document {
+		return Document{"$and": docs}
+	}, Document{})
+}
+
+func (t MongoTranslater) param(p interface{}) (Document, error) {
+	switch e := p.(type) {
+	case Connective:
+		docs := make([]interface{}, 0, len(e.Operands))
+		for _, op := range e.Operands {
+			d, err := t.param(op)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, d)
+		}
+		if len(docs) == 0 {
+			if e.Operator == "OR" || e.Operator == "NOT" {
+				return Document{"$expr": false}, nil
+			}
+			return Document{}, nil
+		}
+		switch e.Operator {
+		case "OR":
+			return Document{"$or": docs}, nil
+		case "NOT":
+			return Document{"$nor": []interface{}{Document{"$and": docs}}}, nil
+		}
+		return Document{"$and": docs}, nil
+	case Selectable:
+		return t.selectable(e)
+	case *Filter:
+		return t.TranslateDocument(e)
+	}
+	return nil, fmt.Errorf("filter: cannot translate %T", p)
+}
+
+var mongoOperators = map[string]string{
+	"EQ": "$eq", "NE": "$ne", "GT": "$gt", "GTE": "$gte", "LT": "$lt", "LTE": "$lte",
+	"IN": "$in", "NIN": "$nin",
+}
+
+func (t MongoTranslater) selectable(s Selectable) (Document, error) {
+	path := fieldPath(t.Names, s.Entity, s.Field)
+	if s.Part != "" {
+		return t.part(s, path)
+	}
+	value := s.Param.Value
+
+	switch s.Param.Operator {
+	case "EQ", "NE", "GT", "GTE", "LT", "LTE":
+		return Document{path: Document{mongoOperators[s.Param.Operator]: value}}, nil
+	case "IN", "NIN":
+		return Document{path: Document{mongoOperators[s.Param.Operator]: s.Param.Values}}, nil
+	case "PFX":
+		return Document{path: Document{"$regex": "^" + regexp.QuoteMeta(toString(value))}}, nil
+	case "SFX":
+		return Document{path: Document{"$regex": regexp.QuoteMeta(toString(value)) + "$"}}, nil
+	case "CONTAINS":
+		return Document{path: Document{"$regex": regexp.QuoteMeta(toString(value))}}, nil
+	case "LIKE":
+		return Document{path: Document{"$regex": likeRegexp(toString(value))}}, nil
+	case "ILIKE":
+		return Document{path: Document{"$regex": likeRegexp(toString(value)), "$options": "i"}}, nil
+	case "BETWEEN":
+		if len(s.Param.Values) != 2 {
+			return nil, fmt.Errorf("filter: BETWEEN on %s needs 2 values", path)
+		}
+		return Document{path: Document{"$gte": s.Param.Values[0], "$lte": s.Param.Values[1]}}, nil
+	case "ISNULL":
+		return Document{path: Document{"$eq": nil}}, nil
+	case "NOTNULL":
+		return Document{path: Document{"$ne": nil}}, nil
+	}
+	return nil, fmt.Errorf("filter: operator %s on %s cannot be translated to MongoDB", s.Param.Operator, path)
+}
+
+// part translates a condition on a date part to an $expr.
+func (t MongoTranslater) part(s Selectable, path string) (Document, error) {
+	function := map[string]string{"YEAR": "$year", "MONTH": "$month", "DAY": "$dayOfMonth"}[s.Part]
+	operand := Document{function: "$" + path}
+
+	switch s.Param.Operator {
+	case "EQ", "NE", "GT", "GTE", "LT", "LTE":
+		return Document{"$expr": Document{
+			mongoOperators[s.Param.Operator]: []interface{}{operand, s.Param.Value}}}, nil
+	case "IN":
+		return Document{"$expr": Document{"$in": []interface{}{operand, s.Param.Values}}}, nil
+	case "NIN":
+		return Document{"$expr": Document{"$not": []interface{}{
+			Document{"$in": []interface{}{operand, s.Param.Values}}}}}, nil
+	case "BETWEEN":
+		if len(s.Param.Values) == 2 {
+			return Document{"$expr": Document{"$and": []interface{}{
+				Document{"$gte": []interface{}{operand, s.Param.Values[0]}},
+				Document{"$lte": []interface{}{operand, s.Param.Values[1]}}}}}, nil
+		}
+	}
+	return nil, fmt.Errorf("filter: operator %s on %s of %s cannot be translated to MongoDB",
+		s.Param.Operator, strings.ToLower(s.Part), path)
+}
+
+// ElasticTranslater translates filters to Elasticsearch query clauses:
+//
+//	{"bool": {"filter": [{"term": {"patient.geslacht": "M"}}, {"prefix": {"onderzoek.datum": "2015"}}]}}
+//
+// The clause is the value of "query" in a search request. Field paths are
+// "entity.field", unless Names is set. Conditions on a date part are
+// supported for the year only, as ranges. An empty filter or AND
+// translates to match_all, an empty OR or NOT to match_none.
+type ElasticTranslater struct {
+	Names NameTranslater
+}
+
+func (t ElasticTranslater) TranslateDocument(f *Filter) (Document, error) {
+	return translateDocument(f, t.param, func(docs []interface{}) Document {
+		return elasticBool("filter", docs)
+	}, Document{"match_all": Document{}})
+}
+
+func elasticBool(occur string, docs []interface{}) Document {
+	return Document{"bool": Document{occur: docs}}
+}
+
+func (t ElasticTranslater) param(p interface{}) (Document, error) {
+	switch e := p.(type) {
+	case Connective:
+		docs := make([]interface{}, 0, len(e.Operands))
+		for _, op := range e.Operands {
+			d, err := t.param(op)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, d)
+		}
+		if len(docs) == 0 {
+			if e.Operator == "OR" || e.Operator == "NOT" {
+				return Document{"match_none": Document{}}, nil
+			}
+			return Document{"match_all": Document{}}, nil
+		}
+		switch e.Operator {
+		case "OR":
+			return Document{"bool": Document{"should": docs, "minimum_should_match": 1}}, nil
+		case "NOT":
+			if len(docs) == 1 {
+				return elasticBool("must_not", docs), nil
+			}
+			return elasticBool("must_not", []interface{}{elasticBool("filter", docs)}), nil
+		}
+		return elasticBool("filter", docs), nil
+	case Selectable:
+		return t.selectable(e)
+	case *Filter:
+		return t.TranslateDocument(e)
+	}
+	return nil, fmt.Errorf("filter: cannot translate %T", p)
+}
+
+var elasticRanges = map[string]string{"GT": "gt", "GTE": "gte", "LT": "lt", "LTE": "lte"}
+
+// escapeWildcard escapes the wildcards of an Elasticsearch wildcard query.
+func escapeWildcard(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`).Replace(s)
+}
+
+// likeWildcard translates a LIKE pattern to a wildcard pattern.
+func likeWildcard(pattern string) string {
+	var w strings.Builder
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			w.WriteString(escapeWildcard(string(c)))
+			escaped = false
+		case string(c) == LikeEscape:
+			escaped = true
+		case c == '%':
+			w.WriteString("*")
+		case c == '_':
+			w.WriteString("?")
+		default:
+			w.WriteString(escapeWildcard(string(c)))
+		}
+	}
+	return w.String()
+}
+
+func (t ElasticTranslater) selectable(s Selectable) (Document, error) {
+	path := fieldPath(t.Names, s.Entity, s.Field)
+	if s.Part != "" {
+		return t.part(s, path)
+	}
+	value := s.Param.Value
+	wildcard := func(pattern string, fold bool) Document {
+		query := Document{"value": pattern}
+		if fold {
+			query["case_insensitive"] = true
+		}
+		return Document{"wildcard": Document{path: query}}
+	}
+
+	switch s.Param.Operator {
+	case "EQ":
+		return Document{"term": Document{path: value}}, nil
+	case "NE":
+		return elasticBool("must_not", []interface{}{Document{"term": Document{path: value}}}), nil
+	case "GT", "GTE", "LT", "LTE":
+		return Document{"range": Document{path: Document{elasticRanges[s.Param.Operator]: value}}}, nil
+	case "IN":
+		return Document{"terms": Document{path: s.Param.Values}}, nil
+	case "NIN":
+		return elasticBool("must_not", []interface{}{Document{"terms": Document{path: s.Param.Values}}}), nil
+	case "PFX":
+		return Document{"prefix": Document{path: value}}, nil
+	case "SFX":
+		return wildcard("*"+escapeWildcard(toString(value)), false), nil
+	case "CONTAINS":
+		return wildcard("*"+escapeWildcard(toString(value))+"*", false), nil
+	case "LIKE":
+		return wildcard(likeWildcard(toString(value)), false), nil
+	case "ILIKE":
+		return wildcard(likeWildcard(toString(value)), true), nil
+	case "BETWEEN":
+		if len(s.Param.Values) != 2 {
+			return nil, fmt.Errorf("filter: BETWEEN on %s needs 2 values", path)
+		}
+		return Document{"range": Document{path: Document{
+			"gte": s.Param.Values[0], "lte": s.Param.Values[1]}}}, nil
+	case "ISNULL":
+		return elasticBool("must_not", []interface{}{Document{"exists": Document{"field": path}}}), nil
+	case "NOTNULL":
+		return Document{"exists": Document{"field": path}}, nil
+	}
+	return nil, fmt.Errorf("filter: operator %s on %s cannot be translated to Elasticsearch", s.Param.Operator, path)
+}
+
+// part translates a condition on the year of a date to a range with
+// date math: "2015||/y" rounds to the start or end of 2015, depending
+// on the range operator.
+func (t ElasticTranslater) part(s Selectable, path string) (Document, error) {
+	if s.Part == "YEAR" {
+		year := func(v interface{}) string {
+			return fmt.Sprintf("%s||/y", toString(v))
+		}
+		r := Document{"format": "yyyy"}
+		switch s.Param.Operator {
+		case "EQ":
+			r["gte"], r["lte"] = year(s.Param.Value), year(s.Param.Value)
+		case "GT", "GTE", "LT", "LTE":
+			r[elasticRanges[s.Param.Operator]] = year(s.Param.Value)
+		case "BETWEEN":
+			if len(s.Param.Values) != 2 {
+				return nil, fmt.Errorf("filter: BETWEEN on %s needs 2 values", path)
+			}
+			r["gte"], r["lte"] = year(s.Param.Values[0]), year(s.Param.Values[1])
+		default:
+			r = nil
+		}
+		if r != nil {
+			return Document{"range": Document{path: r}}, nil
+		}
+	}
+	return nil, fmt.Errorf("filter: operator %s on %s of %s cannot be translated to Elasticsearch",
+		s.Param.Operator, strings.ToLower(s.Part), path)
+}
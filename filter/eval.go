@@ -0,0 +1,396 @@
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is implemented by items that look up their own field values,
+// such as toumin models.
+type Record interface {
+	Lookup(entity, field string) (interface{}, bool)
+}
+
+// Test reports whether item satisfies all conditions of the filter.
+// item is a Record, a map with string keys or a struct (or a pointer to one).
+//
+// Map keys are matched against "entity.field" and "field"; struct fields
+// against the CamelCase form of the field name: lokale_code -> LokaleCode.
+// If t is not nil, the name returned by t.TranslateField is tried as well.
+// A condition on a field that item does not have is not satisfied.
+func (f *Filter) Test(item interface{}, t FilterTranslater) bool {
+	for _, p := range f.Params {
+		if !testParam(p, item, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func testParam(p interface{}, item interface{}, t FilterTranslater) bool {
+	switch e := p.(type) {
+	case Connective:
+		return testConnective(e, item, t)
+	case Selectable:
+		return testSelectable(e, item, t)
+	case *Filter:
+		return e.Test(item, t)
+	}
+	return true
+}
+
+func testConnective(con Connective, item interface{}, t FilterTranslater) bool {
+	switch con.Operator {
+	case "OR":
+		for _, op := range con.Operands {
+			if testParam(op, item, t) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, op := range con.Operands {
+			if !testParam(op, item, t) {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, op := range con.Operands {
+			if !testParam(op, item, t) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// testSelectable evaluates s. Conditions on a Subquery cannot be
+// evaluated in memory and are not satisfied.
+func testSelectable(s Selectable, item interface{}, t FilterTranslater) bool {
+	if _, ok := s.Param.Value.(Subquery); ok {
+		return false
+	}
+	value, ok := lookup(item, s.Entity, s.Field, t)
+	if !ok {
+		return false
+	}
+	if s.Part != "" && value != nil {
+		if value, ok = datePart(s.Part, value); !ok {
+			return false
+		}
+	}
+
+	switch s.Param.Operator {
+	case "EQ":
+		return equal(value, s.Param.Value)
+	case "NE":
+		// Like SQL, a comparison with NULL is never true.
+		return value != nil && s.Param.Value != nil && !equal(value, s.Param.Value)
+	case "GT":
+		c, ok := compare(value, s.Param.Value)
+		return ok && c > 0
+	case "GTE":
+		c, ok := compare(value, s.Param.Value)
+		return ok && c >= 0
+	case "LT":
+		c, ok := compare(value, s.Param.Value)
+		return ok && c < 0
+	case "LTE":
+		c, ok := compare(value, s.Param.Value)
+		return ok && c <= 0
+	case "IN":
+		return in(value, s.Param.Values)
+	case "NIN":
+		return value != nil && !in(value, s.Param.Values) && !in(nil, s.Param.Values)
+	case "PFX":
+		return value != nil && strings.HasPrefix(toString(value), toString(s.Param.Value))
+	case "SFX":
+		return value != nil && strings.HasSuffix(toString(value), toString(s.Param.Value))
+	case "CONTAINS":
+		return value != nil && strings.Contains(toString(value), toString(s.Param.Value))
+	case "LIKE":
+		return value != nil && like(toString(value), toString(s.Param.Value), false)
+	case "ILIKE":
+		return value != nil && like(toString(value), toString(s.Param.Value), true)
+	case "BETWEEN":
+		if len(s.Param.Values) != 2 {
+			return false
+		}
+		low, ok := compare(value, s.Param.Values[0])
+		if !ok || low < 0 {
+			return false
+		}
+		high, ok := compare(value, s.Param.Values[1])
+		return ok && high <= 0
+	case "ISNULL":
+		return value == nil
+	case "NOTNULL":
+		return value != nil
+	}
+	return false
+}
+
+// datePart returns the year, month or day of the date value.
+func datePart(part string, value interface{}) (interface{}, bool) {
+	d, ok := toTime(value)
+	if !ok {
+		return nil, false
+	}
+	switch part {
+	case "YEAR":
+		return d.Year(), true
+	case "MONTH":
+		return int(d.Month()), true
+	case "DAY":
+		return d.Day(), true
+	}
+	return nil, false
+}
+
+// like reports whether s matches the LIKE pattern.
+func like(s, pattern string, fold bool) bool {
+	re := "(?s)" + likeRegexp(pattern)
+	if fold {
+		re = "(?i)" + re
+	}
+	matched, err := regexp.MatchString(re, s)
+	return err == nil && matched
+}
+
+// likeRegexp translates a LIKE pattern, in which % matches any sequence
+// of characters, _ a single character and LikeEscape escapes the next
+// character, to an anchored regular expression.
+func likeRegexp(pattern string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case string(c) == LikeEscape:
+			escaped = true
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// lookup returns the value of field f of entity e in item.
+func lookup(item interface{}, e, f string, t FilterTranslater) (interface{}, bool) {
+	if r, ok := item.(Record); ok {
+		v, ok := r.Lookup(e, f)
+		return deref(v), ok
+	}
+
+	names := []string{e + "." + f, f}
+	if t != nil {
+		names = append(names, t.TranslateField(e, f))
+	}
+
+	v := reflect.ValueOf(item)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		for _, name := range names {
+			mv := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if mv.IsValid() {
+				return deref(mv.Interface()), true
+			}
+		}
+	case reflect.Struct:
+		for _, name := range names[1:] {
+			camel := strings.ReplaceAll(name, "_", "")
+			for i := 0; i < v.NumField(); i++ {
+				sf := v.Type().Field(i)
+				if sf.IsExported() && strings.EqualFold(sf.Name, camel) {
+					return deref(v.Field(i).Interface()), true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// deref returns the value that v points to, or nil for a nil pointer.
+func deref(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	return rv.Interface()
+}
+
+func in(value interface{}, values []interface{}) bool {
+	for _, v := range values {
+		if equal(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	a, b = deref(a), deref(b)
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	c, ok := compare(a, b)
+	return ok && c == 0
+}
+
+// compare compares a and b and returns -1, 0 or +1.
+// Numbers are compared numerically, also when one of them is
+// a numeric string; times are compared chronologically, also against
+// strings in one of the timeLayouts. Other values are compared
+// as strings. ok is false if a or b is nil.
+func compare(a, b interface{}) (c int, ok bool) {
+	a, b = deref(a), deref(b)
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := toTime(b); ok {
+			return ta.Compare(tb), true
+		}
+	}
+	if tb, ok := b.(time.Time); ok {
+		if ta, ok := toTime(a); ok {
+			return ta.Compare(tb), true
+		}
+	}
+
+	if ba, ok := a.(bool); ok {
+		if bb, ok := toBool(b); ok {
+			return compareBool(ba, bb), true
+		}
+	}
+	if bb, ok := b.(bool); ok {
+		if ba, ok := toBool(a); ok {
+			return compareBool(ba, bb), true
+		}
+	}
+
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum && bNum && (isNumber(a) || isNumber(b)) {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return strings.Compare(toString(a), toString(b)), true
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+func isNumber(v interface{}) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+	return f, err == nil
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0, true
+	}
+	b, err := strconv.ParseBool(toString(v))
+	return b, err == nil
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
+	s := toString(v)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func toString(v interface{}) string {
+	switch s := deref(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case time.Time:
+		return s.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(s)
+	}
+}
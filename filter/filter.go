@@ -5,10 +5,9 @@ import (
 	"strings"
 )
 
-
 func Values(items []interface{}) []interface{} {
 	values := make([]interface{}, 0)
-	
+
 	for _, op := range items {
 		switch v := op.(type) {
 		case Connective:
@@ -20,9 +19,12 @@ func Values(items []interface{}) []interface{} {
 	return values
 }
 
+// Filter is a set of conditions that must all hold. Syntax selects
+// the text produced by String.
 type Filter struct {
 	Params []interface{}
-	Values []interface{}	
+	Values []interface{}
+	Syntax Syntax
 }
 
 // NewFilter expects zero or more arguments of the type *Selectable
@@ -37,13 +39,15 @@ func NewFilter(args ...interface{}) *Filter {
 }
 
 func (f *Filter) String() string {
-	return Translater{}.Translate(f)	
-}
-
-func (f *Filter) Test(item interface{}, t FilterTranslater) bool {
-	return true
+	if f.Syntax == TouminSyntax {
+		s, _ := Format(f)
+		return s
+	}
+	return Translater{}.Translate(f)
 }
 
+// FilterTranslater translates a Filter to a string, such as an SQL
+// condition. See DocumentTranslater for structured targets.
 type FilterTranslater interface {
 	Translate(f *Filter) string
 	TranslateOperator(o string) string
@@ -53,10 +57,48 @@ type FilterTranslater interface {
 	ProcessSelectable(f *Filter, s Selectable) string
 }
 
-type Translater struct {}
+// NameTranslater maps the entity and field names used in a filter
+// to the names used by the target of a translation, e.g. table and
+// column names.
+type NameTranslater interface {
+	TranslateEntity(e string) string
+	TranslateField(e, f string) string
+}
+
+// Translater translates a Filter to an SQL condition.
+// Entity and field names are passed through Names, if set.
+// Dialect is the name of the database driver ("mysql", "mssql",
+// "sqlite", "postgres"); it selects the SQL for operators that
+// differ between databases. The empty Dialect produces standard SQL.
+// Entity is the entity of the enclosing query, which subqueries
+// in Exists and NotExists conditions are correlated with.
+type Translater struct {
+	Names   NameTranslater
+	Dialect string
+	Entity  string
+}
+
+// Subquery is a query that is used as the operand of InQuery, NotInQuery,
+// Exists or NotExists. *toumin.Query implements it.
+type Subquery interface {
+	// SubquerySql returns the SQL of the subquery and its parameters.
+	// For Exists and NotExists, exists is true and outer is the entity of
+	// the enclosing query, which the subquery may correlate with.
+	// For InQuery and NotInQuery, outer is the entity of the field whose
+	// value the single column of the subquery is compared with.
+	SubquerySql(outer string, exists bool) (string, []interface{})
+}
 
+// LikeEscape is the escape character of the LIKE patterns
+// that Translater generates.
+const LikeEscape = "!"
+
+// ProcessConnective translates con. A connective without operands emits
+// no condition for AND and a condition that never matches for OR and NOT;
+// within an OR, it makes the OR match every row.
 func (t Translater) ProcessConnective(f *Filter, con Connective) string {
 	args := make([]string, 0)
+	values := len(f.Values)
 
 	for _, op := range con.Operands {
 		switch c := op.(type) {
@@ -64,6 +106,9 @@ func (t Translater) ProcessConnective(f *Filter, con Connective) string {
 			r := t.ProcessConnective(f, c)
 			if r != "" {
 				args = append(args, r)
+			} else if con.Operator == "OR" {
+				f.Values = f.Values[:values]
+				return ""
 			}
 		case Selectable:
 			r := t.ProcessSelectable(f, c)
@@ -72,6 +117,15 @@ func (t Translater) ProcessConnective(f *Filter, con Connective) string {
 			}
 		}
 	}
+	if len(args) == 0 {
+		if con.Operator == "OR" || con.Operator == "NOT" {
+			return "1 = 0"
+		}
+		return ""
+	}
+	if con.Operator == "NOT" {
+		return fmt.Sprintf("NOT (%s)", strings.Join(args, " AND "))
+	}
 	return fmt.Sprintf("(%s)", strings.Join(args, fmt.Sprintf(" %s ", con.Operator)))
 }
 
@@ -93,27 +147,89 @@ func (t Translater) TranslateOperator(o string) string {
 		return "IN"
 	case "NIN":
 		return "NOT IN"
-	case "PFX":
+	case "PFX", "SFX", "CONTAINS", "LIKE":
 		return "LIKE"
-	case "SFX":
+	case "ILIKE":
+		if t.Dialect == "postgres" {
+			return "ILIKE"
+		}
 		return "LIKE"
+	case "BETWEEN":
+		return "BETWEEN"
+	case "INQ":
+		return "IN"
+	case "NINQ":
+		return "NOT IN"
+	case "EXISTS":
+		return "EXISTS"
+	case "NEXISTS":
+		return "NOT EXISTS"
+	case "ISNULL":
+		return "IS NULL"
+	case "NOTNULL":
+		return "IS NOT NULL"
 	}
 	return "!OPERATOR ERROR!"
 }
 
 func (t Translater) TranslateEntity(e string) string {
+	if t.Names != nil {
+		return t.Names.TranslateEntity(e)
+	}
 	return e
 }
 
 func (t Translater) TranslateField(e, f string) string {
+	if t.Names != nil {
+		return t.Names.TranslateField(e, f)
+	}
 	return f
 }
 
+// TranslatePart returns the SQL expression that extracts the date part
+// ("YEAR", "MONTH" or "DAY") from column.
+func (t Translater) TranslatePart(part, column string) string {
+	switch t.Dialect {
+	case "mysql", "mssql":
+		return fmt.Sprintf("%s(%s)", part, column)
+	case "sqlite":
+		format := map[string]string{"YEAR": "%Y", "MONTH": "%m", "DAY": "%d"}[part]
+		return fmt.Sprintf("CAST(strftime('%s', %s) AS INTEGER)", format, column)
+	}
+	return fmt.Sprintf("EXTRACT(%s FROM %s)", part, column)
+}
+
+// EscapeLike escapes the wildcards in s, so that s matches literally
+// in a LIKE pattern with escape character LikeEscape.
+func (t Translater) EscapeLike(s string) string {
+	s = strings.ReplaceAll(s, LikeEscape, LikeEscape+LikeEscape)
+	s = strings.ReplaceAll(s, "%", LikeEscape+"%")
+	s = strings.ReplaceAll(s, "_", LikeEscape+"_")
+	if t.Dialect == "mssql" {
+		s = strings.ReplaceAll(s, "[", LikeEscape+"[")
+	}
+	return s
+}
+
 func (t Translater) ProcessSelectable(f *Filter, s Selectable) string {
 	operator := t.TranslateOperator(s.Param.Operator)
+	if s.Param.Operator == "EXISTS" || s.Param.Operator == "NEXISTS" {
+		q, ok := s.Param.Value.(Subquery)
+		if !ok {
+			return ""
+		}
+		sql, values := q.SubquerySql(t.Entity, true)
+		f.Values = append(f.Values, values...)
+		return fmt.Sprintf("%s (%s)", operator, sql)
+	}
 	entity := t.TranslateEntity(s.Entity)
 	field := t.TranslateField(s.Entity, s.Field)
-	
+	column := fmt.Sprintf("%s.%s", entity, field)
+	if s.Part != "" {
+		column = t.TranslatePart(s.Part, column)
+	}
+	escape := fmt.Sprintf("ESCAPE '%s'", LikeEscape)
+
 	switch s.Param.Operator {
 	case "IN":
 		fallthrough
@@ -123,16 +239,41 @@ func (t Translater) ProcessSelectable(f *Filter, s Selectable) string {
 			l = append(l, "?")
 			f.Values = append(f.Values, v)
 		}
-		return fmt.Sprintf("%s.%s %s (%s)", entity, field, operator, strings.Join(l, ", "))
+		return fmt.Sprintf("%s %s (%s)", column, operator, strings.Join(l, ", "))
 	case "PFX":
-		f.Values = append(f.Values, fmt.Sprintf("%s%%", s.Param.Value))
-		return fmt.Sprintf("%s.%s %s ?", entity, field, operator)
+		f.Values = append(f.Values, fmt.Sprintf("%s%%", t.EscapeLike(fmt.Sprint(s.Param.Value))))
+		return fmt.Sprintf("%s %s ? %s", column, operator, escape)
 	case "SFX":
-		f.Values = append(f.Values, fmt.Sprintf("%%%s", s.Param.Value))
-		return fmt.Sprintf("%s.%s %s ?", entity, field, operator)
-	default:	
+		f.Values = append(f.Values, fmt.Sprintf("%%%s", t.EscapeLike(fmt.Sprint(s.Param.Value))))
+		return fmt.Sprintf("%s %s ? %s", column, operator, escape)
+	case "CONTAINS":
+		f.Values = append(f.Values, fmt.Sprintf("%%%s%%", t.EscapeLike(fmt.Sprint(s.Param.Value))))
+		return fmt.Sprintf("%s %s ? %s", column, operator, escape)
+	case "LIKE":
+		f.Values = append(f.Values, s.Param.Value)
+		return fmt.Sprintf("%s %s ? %s", column, operator, escape)
+	case "ILIKE":
 		f.Values = append(f.Values, s.Param.Value)
-		return fmt.Sprintf("%s.%s %s ?", entity, field, operator)
+		if t.Dialect == "postgres" {
+			return fmt.Sprintf("%s %s ? %s", column, operator, escape)
+		}
+		return fmt.Sprintf("LOWER(%s) %s LOWER(?) %s", column, operator, escape)
+	case "BETWEEN":
+		f.Values = append(f.Values, s.Param.Values...)
+		return fmt.Sprintf("%s %s ? AND ?", column, operator)
+	case "ISNULL", "NOTNULL":
+		return fmt.Sprintf("%s %s", column, operator)
+	case "INQ", "NINQ":
+		q, ok := s.Param.Value.(Subquery)
+		if !ok {
+			return ""
+		}
+		sql, values := q.SubquerySql(s.Entity, false)
+		f.Values = append(f.Values, values...)
+		return fmt.Sprintf("%s %s (%s)", column, operator, sql)
+	default:
+		f.Values = append(f.Values, s.Param.Value)
+		return fmt.Sprintf("%s %s ?", column, operator)
 	}
 }
 
@@ -179,20 +320,37 @@ func Or(ops ...interface{}) Connective {
 	return Connective{"OR", ops}
 }
 
+// Not negates the conjunction of ops.
+func Not(ops ...interface{}) Connective {
+	return Connective{"NOT", ops}
+}
+
 type Param struct {
 	Operator string
-	Value interface{}
-	Values []interface{}
+	Value    interface{}
+	Values   []interface{}
 }
 
+// Selectable is a condition on a field of an entity. If Part is set
+// ("YEAR", "MONTH" or "DAY"), the condition applies to that part of
+// the date in the field.
 type Selectable struct {
 	Entity string
-	Field string
-	Param Param
+	Field  string
+	Part   string
+	Param  Param
 }
 
+// Values returns the values of the condition. Conditions on
+// a Subquery have no values of their own.
 func (s Selectable) Values() []interface{} {
 	values := make([]interface{}, 0)
+	if _, ok := s.Param.Value.(Subquery); ok {
+		return values
+	}
+	if s.Param.Operator == "ISNULL" || s.Param.Operator == "NOTNULL" {
+		return values
+	}
 	if len(s.Param.Values) > 0 {
 		for _, v := range s.Param.Values {
 			values = append(values, v)
@@ -252,3 +410,84 @@ func (e Selectable) Nin(values []interface{}) Selectable {
 	e.Param = Param{Operator: "NIN", Values: values}
 	return e
 }
+
+// Contains selects values that contain value.
+func (e Selectable) Contains(value interface{}) Selectable {
+	e.Param = Param{Operator: "CONTAINS", Value: value}
+	return e
+}
+
+// Like selects values that match pattern, with the wildcards % and _.
+// LikeEscape makes the character after it match literally.
+func (e Selectable) Like(pattern string) Selectable {
+	e.Param = Param{Operator: "LIKE", Value: pattern}
+	return e
+}
+
+// ILike is the case-insensitive variant of Like.
+func (e Selectable) ILike(pattern string) Selectable {
+	e.Param = Param{Operator: "ILIKE", Value: pattern}
+	return e
+}
+
+// Between selects values from low up to and including high.
+func (e Selectable) Between(low, high interface{}) Selectable {
+	e.Param = Param{Operator: "BETWEEN", Values: []interface{}{low, high}}
+	return e
+}
+
+func (e Selectable) IsNull() Selectable {
+	e.Param = Param{Operator: "ISNULL"}
+	return e
+}
+
+func (e Selectable) NotNull() Selectable {
+	e.Param = Param{Operator: "NOTNULL"}
+	return e
+}
+
+// Year makes the condition apply to the year of a date field:
+//
+//	Selectable{Entity: "onderzoek", Field: "datum"}.Year().Eq(2015)
+func (e Selectable) Year() Selectable {
+	e.Part = "YEAR"
+	return e
+}
+
+// Month makes the condition apply to the month (1-12) of a date field.
+func (e Selectable) Month() Selectable {
+	e.Part = "MONTH"
+	return e
+}
+
+// Day makes the condition apply to the day of the month of a date field.
+func (e Selectable) Day() Selectable {
+	e.Part = "DAY"
+	return e
+}
+
+// InQuery selects values that occur in the single column of q.
+func (e Selectable) InQuery(q Subquery) Selectable {
+	e.Param = Param{Operator: "INQ", Value: q}
+	return e
+}
+
+// NotInQuery selects values that do not occur in the single column of q.
+func (e Selectable) NotInQuery(q Subquery) Selectable {
+	e.Param = Param{Operator: "NINQ", Value: q}
+	return e
+}
+
+// Exists is satisfied if q returns at least one row.
+//
+//	q := registry.Query("patient")
+//	q.Filter(filter.Exists(q.BackRef("behandeling").Filter(
+//		filter.Selectable{Entity: "behandeling", Field: "datum"}.Year().Eq(2015))))
+func Exists(q Subquery) Selectable {
+	return Selectable{Param: Param{Operator: "EXISTS", Value: q}}
+}
+
+// NotExists is satisfied if q returns no rows.
+func NotExists(q Subquery) Selectable {
+	return Selectable{Param: Param{Operator: "NEXISTS", Value: q}}
+}
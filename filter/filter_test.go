@@ -1,9 +1,12 @@
 package filter
 
 import (
+	"encoding/json"
+	"fmt"
 	"strconv"
+	"strings"
 	"testing"
-	"fmt"
+	"time"
 )
 
 func selecteerJaar(jaar int) Selectable {
@@ -25,8 +28,377 @@ func TestFilter(t *testing.T) {
 			selecteerCentrum("ACH"),
 			selecteerGeslacht("M")))
 	fmt.Println(filter)
-	for _, v := range filter.Values() {
+	for _, v := range filter.Values {
 		fmt.Printf("%s\n", v)
 	}
 }
 
+type onderzoek struct {
+	Centrum string
+	Datum   string
+	Aantal  *int
+}
+
+func TestTestMap(t *testing.T) {
+	filter := NewFilter(
+		And(
+			selecteerJaar(2015),
+			selecteerCentrum("ACH"),
+			selecteerGeslacht("M")))
+	item := map[string]interface{}{
+		"onderzoek.datum":   "2015-03-01",
+		"onderzoek.centrum": "ACH",
+		"geslacht":          "M",
+	}
+	if !filter.Test(item, nil) {
+		t.Errorf("TestTestMap(): item does not match")
+	}
+	item["geslacht"] = "V"
+	if filter.Test(item, nil) {
+		t.Errorf("TestTestMap(): item with geslacht V matches")
+	}
+	delete(item, "geslacht")
+	if filter.Test(item, nil) {
+		t.Errorf("TestTestMap(): item without geslacht matches")
+	}
+}
+
+func TestTestStruct(t *testing.T) {
+	aantal := 12
+	item := &onderzoek{Centrum: "ACH", Datum: "2015-03-01", Aantal: &aantal}
+	for _, c := range []struct {
+		s     Selectable
+		match bool
+	}{
+		{Selectable{Entity: "onderzoek", Field: "centrum"}.In([]interface{}{"AMC", "ACH"}), true},
+		{Selectable{Entity: "onderzoek", Field: "centrum"}.Nin([]interface{}{"AMC", "ACH"}), false},
+		{Selectable{Entity: "onderzoek", Field: "centrum"}.Ne("AMC"), true},
+		{Selectable{Entity: "onderzoek", Field: "datum"}.Sfx("03-01"), true},
+		{Selectable{Entity: "onderzoek", Field: "datum"}.Gte("2015-01-01"), true},
+		{Selectable{Entity: "onderzoek", Field: "datum"}.Lt("2015-01-01"), false},
+		{Selectable{Entity: "onderzoek", Field: "aantal"}.Gt(9), true},
+		{Selectable{Entity: "onderzoek", Field: "aantal"}.Gt("9"), true},
+		{Selectable{Entity: "onderzoek", Field: "aantal"}.Lte(11.5), false},
+		{Selectable{Entity: "onderzoek", Field: "aantal"}.Eq(int64(12)), true},
+		{Selectable{Entity: "onderzoek", Field: "onbekend"}.Ne("x"), false},
+	} {
+		if NewFilter(c.s).Test(item, nil) != c.match {
+			t.Errorf("TestTestStruct(): %s %s %v should be %v",
+				c.s.Field, c.s.Param.Operator, c.s.Values(), c.match)
+		}
+	}
+	if !NewFilter(Or(selecteerCentrum("AMC"), selecteerJaar(2015))).Test(item, nil) {
+		t.Errorf("TestTestStruct(): OR does not match")
+	}
+}
+
+func TestOperatorsSql(t *testing.T) {
+	datum := Selectable{Entity: "onderzoek", Field: "datum"}
+	naam := Selectable{Entity: "patient", Field: "achternaam"}
+	for _, c := range []struct {
+		dialect string
+		s       interface{}
+		sql     string
+		values  string
+	}{
+		{"mysql", datum.Year().Eq(2015), "YEAR(onderzoek.datum) = ?", "[2015]"},
+		{"sqlite", datum.Month().Gte(6), "CAST(strftime('%m', onderzoek.datum) AS INTEGER) >= ?", "[6]"},
+		{"postgres", datum.Year().Eq(2015), "EXTRACT(YEAR FROM onderzoek.datum) = ?", "[2015]"},
+		{"mysql", datum.Between("2015-01-01", "2015-12-31"), "onderzoek.datum BETWEEN ? AND ?", "[2015-01-01 2015-12-31]"},
+		{"mysql", datum.IsNull(), "onderzoek.datum IS NULL", "[]"},
+		{"mysql", datum.NotNull(), "onderzoek.datum IS NOT NULL", "[]"},
+		{"mysql", naam.Contains("50%_!"), "patient.achternaam LIKE ? ESCAPE '!'", "[%50!%!_!!%]"},
+		{"mssql", naam.Pfx("[a]"), "patient.achternaam LIKE ? ESCAPE '!'", "[![a]%]"},
+		{"mysql", naam.ILike("leeuw%"), "LOWER(patient.achternaam) LIKE LOWER(?) ESCAPE '!'", "[leeuw%]"},
+		{"postgres", naam.ILike("leeuw%"), "patient.achternaam ILIKE ? ESCAPE '!'", "[leeuw%]"},
+		{"sqlite", naam.Like("Leeuw!_%"), "patient.achternaam LIKE ? ESCAPE '!'", "[Leeuw!_%]"},
+		{"mysql", Not(naam.Eq("Merel"), datum.IsNull()), "NOT (patient.achternaam = ? AND onderzoek.datum IS NULL)", "[Merel]"},
+		{"mysql", And(), "", "[]"},
+		{"mysql", Or(), "1 = 0", "[]"},
+		{"mysql", Or(naam.Eq("Merel"), And()), "", "[]"},
+		{"mysql", And(Or(), naam.Eq("Merel")), "(1 = 0 AND patient.achternaam = ?)", "[Merel]"},
+		{"mysql", Not(And()), "1 = 0", "[]"},
+	} {
+		f := NewFilter(c.s)
+		sql := Translater{Dialect: c.dialect}.Translate(f)
+		if sql != c.sql {
+			t.Errorf("TestOperatorsSql(): %s: %s, want %s", c.dialect, sql, c.sql)
+		}
+		if values := fmt.Sprint(f.Values); values != c.values {
+			t.Errorf("TestOperatorsSql(): %s: values %s, want %s", c.sql, values, c.values)
+		}
+	}
+}
+
+func TestOperatorsTest(t *testing.T) {
+	item := map[string]interface{}{
+		"datum":      "2015-03-01",
+		"achternaam": "Leeuwerik",
+		"voornaam":   nil,
+	}
+	datum := Selectable{Entity: "onderzoek", Field: "datum"}
+	naam := Selectable{Entity: "patient", Field: "achternaam"}
+	voornaam := Selectable{Entity: "patient", Field: "voornaam"}
+	for _, c := range []struct {
+		s     interface{}
+		match bool
+	}{
+		{datum.Year().Eq(2015), true},
+		{datum.Month().Gt(3), false},
+		{datum.Between("2015-01-01", "2015-12-31"), true},
+		{voornaam.IsNull(), true},
+		{voornaam.NotNull(), false},
+		{naam.Contains("uwe"), true},
+		{naam.Like("Leeuw_rik"), true},
+		{naam.Like("leeuw%"), false},
+		{naam.ILike("leeuw%"), true},
+		{Not(naam.Eq("Leeuwerik")), false},
+		{Not(naam.Eq("Merel")), true},
+		{naam.Like("Leeuw!_%"), false},
+		{naam.Ne("Merel"), true},
+		{voornaam.Ne("Merel"), false},
+		{naam.Ne(nil), false},
+		{naam.Nin([]interface{}{"Merel"}), true},
+		{voornaam.Nin([]interface{}{"Merel"}), false},
+		{naam.Nin([]interface{}{"Merel", nil}), false},
+	} {
+		if NewFilter(c.s).Test(item, nil) != c.match {
+			t.Errorf("TestOperatorsTest(): %v should be %v", c.s, c.match)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	filter := NewFilter(
+		And(
+			selecteerJaar(2015),
+			Or(selecteerCentrum("ACH"), Selectable{Entity: "onderzoek", Field: "centrum"}.In([]interface{}{"AMC", ""})),
+			Not(Selectable{Entity: "patient", Field: "overleden"}.IsNull()),
+			selecteerGeslacht("M")))
+	data, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatalf("TestJSON(): %s", err.Error())
+	}
+	expected := `{"and":[` +
+		`{"entity":"onderzoek","field":"datum","op":"PFX","value":"2015"},` +
+		`{"or":[{"entity":"onderzoek","field":"centrum","op":"EQ","value":"ACH"},` +
+		`{"entity":"onderzoek","field":"centrum","op":"IN","values":["AMC",""]}]},` +
+		`{"not":[{"entity":"patient","field":"overleden","op":"ISNULL"}]},` +
+		`{"entity":"patient","field":"geslacht","op":"EQ","value":"M"}]}`
+	if string(data) != expected {
+		t.Errorf("TestJSON(): %s", data)
+	}
+
+	parsed := new(Filter)
+	if err := json.Unmarshal(data, parsed); err != nil {
+		t.Fatalf("TestJSON(): %s", err.Error())
+	}
+	if parsed.String() != filter.String() {
+		t.Errorf("TestJSON(): %s != %s", parsed, filter)
+	}
+
+	for _, invalid := range []string{
+		`{"entity":"patient","field":"geslacht","op":"DROP","value":"M"}`,
+		`{"entity":"patient","op":"EQ","value":"M"}`,
+		`{"xor":[]}`,
+		`{"entity":"patient","field":"geslacht","op":"EQ","value":{"$ne":1}}`,
+		`{"and":[{"entity":"patient","field":"geslacht","op":"BETWEEN","values":[1]}]}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), new(Filter)); err == nil {
+			t.Errorf("TestJSON(): no error for %s", invalid)
+		}
+	}
+}
+
+func TestYear(t *testing.T) {
+	jaar := Selectable{Entity: "onderzoek", Field: "datum"}.Year()
+	f := NewFilter(jaar.Eq(2015))
+
+	for datum, match := range map[interface{}]bool{
+		"2015-03-01":          true,
+		"2015-12-31 23:59:59": true,
+		"2016-01-01":          false,
+		time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC): true,
+	} {
+		if f.Test(map[string]interface{}{"onderzoek.datum": datum}, nil) != match {
+			t.Errorf("TestYear(): %v should be %v", datum, match)
+		}
+	}
+	if sql := (Translater{Dialect: "sqlite"}).Translate(f); sql != "CAST(strftime('%Y', onderzoek.datum) AS INTEGER) = ?" {
+		t.Errorf("TestYear(): %s", sql)
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil || string(data) != `{"entity":"onderzoek","field":"datum","part":"YEAR","op":"EQ","value":2015}` {
+		t.Fatalf("TestYear(): %s %v", data, err)
+	}
+	parsed := new(Filter)
+	if err := json.Unmarshal(data, parsed); err != nil {
+		t.Fatalf("TestYear(): %s", err.Error())
+	}
+	if parsed.String() != f.String() || fmt.Sprintf("%T", parsed.Values[0]) != "int64" {
+		t.Errorf("TestYear(): parsed %s %T", parsed, parsed.Values[0])
+	}
+
+	for translater, expected := range map[DocumentTranslater]string{
+		MongoTranslater{}:   `{"$expr":{"$eq":[{"$year":"$onderzoek.datum"},2015]}}`,
+		ElasticTranslater{}: `{"range":{"onderzoek.datum":{"format":"yyyy","gte":"2015||/y","lte":"2015||/y"}}}`,
+	} {
+		doc, err := translater.TranslateDocument(NewFilter(jaar.Eq(2015)))
+		if data, _ := json.Marshal(doc); err != nil || string(data) != expected {
+			t.Errorf("TestYear(): %T: %s %v", translater, data, err)
+		}
+	}
+	doc, _ := ElasticTranslater{}.TranslateDocument(NewFilter(jaar.Between(2014, 2015)))
+	if data, _ := json.Marshal(doc); string(data) != `{"range":{"onderzoek.datum":{"format":"yyyy","gte":"2014||/y","lte":"2015||/y"}}}` {
+		t.Errorf("TestYear(): %s", data)
+	}
+}
+
+func TestParse(t *testing.T) {
+	text := `onderzoek.centrum = "ACH" and patient.geslacht in ("M","V") and onderzoek.datum ^= "2015"`
+	filter, err := Parse(text)
+	if err != nil {
+		t.Fatalf("TestParse(): %s", err.Error())
+	}
+	if sql := (Translater{}).Translate(filter); sql != "onderzoek.centrum = ? AND patient.geslacht IN (?, ?) AND onderzoek.datum LIKE ? ESCAPE '!'" {
+		t.Errorf("TestParse(): %s", sql)
+	}
+	if fmt.Sprint(filter.Values) != "[ACH M V 2015%]" {
+		t.Errorf("TestParse(): values %v", filter.Values)
+	}
+	if s := filter.String(); s != `onderzoek.centrum = "ACH" and patient.geslacht in ("M", "V") and onderzoek.datum ^= "2015"` {
+		t.Errorf("TestParse(): %s", s)
+	}
+
+	for _, text := range []string{
+		`(onderzoek.centrum = "ACH" or not onderzoek.centrum ~= "\"x\"") and year(onderzoek.datum) >= 2015`,
+		`onderzoek.centrum not in ("AMC") and onderzoek.aantal between 1 and 2.5`,
+		`not (patient.overleden is null and patient.geslacht != "M") and patient.naam ilike "leeuw%"`,
+		`patient.actief = true or patient.naam like "L_eu%" or patient.datum is not null`,
+		`patiënt.straße = "Ærø" and patient.code in ("A", null)`,
+		``,
+	} {
+		filter, err := Parse(text)
+		if err != nil {
+			t.Fatalf("TestParse(): %s: %s", text, err.Error())
+		}
+		if s := filter.String(); s != text {
+			t.Errorf("TestParse(): %s\n != %s", s, text)
+		}
+		again, err := Parse(filter.String())
+		if err != nil || again.String() != text {
+			t.Errorf("TestParse(): no round trip for %s", text)
+		}
+	}
+}
+
+func TestFormatNull(t *testing.T) {
+	overleden := Selectable{Entity: "patient", Field: "overleden"}
+	s, err := Format(NewFilter(overleden.Eq(nil), Not(overleden.Ne(nil))))
+	if err != nil || s != "patient.overleden is null and not patient.overleden is not null" {
+		t.Errorf("TestFormatNull(): %s, %v", s, err)
+	}
+	filter, err := Parse(`patient.overleden = null or patient.overleden != null`)
+	if err != nil {
+		t.Fatalf("TestFormatNull(): %s", err.Error())
+	}
+	if sql := (Translater{}).Translate(filter); sql != "(patient.overleden IS NULL OR patient.overleden IS NOT NULL)" {
+		t.Errorf("TestFormatNull(): %s", sql)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for text, expected := range map[string]string{
+		`onderzoek.centrum = "ACH" and`:              "filter: line 1, column 30: expected entity, found end of filter",
+		`onderzoek.centrum == "ACH"`:                 "filter: line 1, column 20: expected value, found \"=\"",
+		"onderzoek.centrum = \"ACH\"\nand datum > 1": "filter: line 2, column 11: expected \".\", found \">\"",
+		`onderzoek.centrum in ("A" "B")`:             "filter: line 1, column 27: expected \",\" or \")\", found \"B\"",
+		`week(onderzoek.datum) = 1`:                  "filter: line 1, column 1: unknown function \"week\"",
+		`onderzoek.centrum = "ACH`:                   "filter: line 1, column 21: unterminated string",
+		`onderzoek.centrum = 'ACH'`:                  "filter: line 1, column 21: unexpected character '\\''",
+		`onderzoek.centrum = «ACH»`:                  "filter: line 1, column 21: unexpected character '«'",
+		`onderzoek.aantal = ٣`:                       "filter: line 1, column 20: unexpected character '٣'",
+		strings.Repeat("(", 101) + `onderzoek.centrum = "ACH"` + strings.Repeat(")", 101): "filter: line 1, column 101: filter nested deeper than 100 levels",
+		strings.Repeat("not ", 101) + `onderzoek.centrum = "ACH"`:                         "filter: line 1, column 401: filter nested deeper than 100 levels",
+	} {
+		_, err := Parse(text)
+		if err == nil {
+			t.Errorf("TestParseError(): no error for %s", text)
+		} else if err.Error() != expected {
+			t.Errorf("TestParseError(): %s: %s", text, err.Error())
+		}
+	}
+}
+
+func TestDocumentTranslaters(t *testing.T) {
+	filter := NewFilter(
+		And(
+			selecteerJaar(2015),
+			Or(selecteerCentrum("ACH"), Selectable{Entity: "onderzoek", Field: "centrum"}.Pfx("A*")),
+			Not(Selectable{Entity: "patient", Field: "overleden"}.IsNull()),
+			Selectable{Entity: "patient", Field: "achternaam"}.ILike("leeuw%")),
+		selecteerGeslacht("M"))
+
+	for _, c := range []struct {
+		translater DocumentTranslater
+		expected   string
+	}{
+		{MongoTranslater{}, `{"$and":[{"$and":[` +
+			`{"onderzoek.datum":{"$regex":"^2015"}},` +
+			`{"$or":[{"onderzoek.centrum":{"$eq":"ACH"}},{"onderzoek.centrum":{"$regex":"^A\\*"}}]},` +
+			`{"$nor":[{"$and":[{"patient.overleden":{"$eq":null}}]}]},` +
+			`{"patient.achternaam":{"$options":"i","$regex":"^leeuw.*$"}}]},` +
+			`{"patient.geslacht":{"$eq":"M"}}]}`},
+		{ElasticTranslater{}, `{"bool":{"filter":[{"bool":{"filter":[` +
+			`{"prefix":{"onderzoek.datum":"2015"}},` +
+			`{"bool":{"minimum_should_match":1,"should":[{"term":{"onderzoek.centrum":"ACH"}},{"prefix":{"onderzoek.centrum":"A*"}}]}},` +
+			`{"bool":{"must_not":[{"bool":{"must_not":[{"exists":{"field":"patient.overleden"}}]}}]}},` +
+			`{"wildcard":{"patient.achternaam":{"case_insensitive":true,"value":"leeuw*"}}}]}},` +
+			`{"term":{"patient.geslacht":"M"}}]}}`},
+	} {
+		doc, err := c.translater.TranslateDocument(filter)
+		if err != nil {
+			t.Fatalf("TestDocumentTranslaters(): %T: %s", c.translater, err.Error())
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatalf("TestDocumentTranslaters(): %T: %s", c.translater, err.Error())
+		}
+		if string(data) != c.expected {
+			t.Errorf("TestDocumentTranslaters(): %T: %s", c.translater, data)
+		}
+	}
+
+	// Empty filters and connectives match everything, or nothing for OR.
+	for _, c := range []struct {
+		filter  *Filter
+		mongo   string
+		elastic string
+	}{
+		{NewFilter(), `{}`, `{"match_all":{}}`},
+		{NewFilter(And()), `{}`, `{"match_all":{}}`},
+		{NewFilter(Or()), `{"$expr":false}`, `{"match_none":{}}`},
+		{NewFilter(selecteerGeslacht("M"), Or()),
+			`{"$and":[{"patient.geslacht":{"$eq":"M"}},{"$expr":false}]}`,
+			`{"bool":{"filter":[{"term":{"patient.geslacht":"M"}},{"match_none":{}}]}}`},
+	} {
+		for translater, expected := range map[DocumentTranslater]string{
+			MongoTranslater{}: c.mongo, ElasticTranslater{}: c.elastic} {
+			doc, err := translater.TranslateDocument(c.filter)
+			if data, _ := json.Marshal(doc); err != nil || string(data) != expected {
+				t.Errorf("TestDocumentTranslaters(): %T: %s %v, want %s", translater, data, err, expected)
+			}
+		}
+	}
+
+	month := NewFilter(Selectable{Entity: "onderzoek", Field: "datum"}.Month().Eq(3))
+	if _, err := (ElasticTranslater{}).TranslateDocument(month); err == nil {
+		t.Errorf("TestDocumentTranslaters(): no error for month in Elasticsearch")
+	}
+	contains := NewFilter(Selectable{Entity: "patient", Field: "naam"}.Contains("a?b"))
+	doc, _ := ElasticTranslater{}.TranslateDocument(contains)
+	if data, _ := json.Marshal(doc); string(data) != `{"wildcard":{"patient.naam":{"value":"*a\\?b*"}}}` {
+		t.Errorf("TestDocumentTranslaters(): %s", data)
+	}
+}
@@ -0,0 +1,198 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Filters are serialised to JSON as a tree of connectives and conditions:
+//
+//	{"and": [
+//		{"entity": "patient", "field": "geslacht", "op": "EQ", "value": "M"},
+//		{"or": [
+//			{"entity": "onderzoek", "field": "centrum", "op": "IN", "values": ["ACH", "AMC"]},
+//			{"entity": "onderzoek", "field": "datum", "part": "YEAR", "op": "EQ", "value": 2015}
+//		]}
+//	]}
+//
+// A Filter is serialised as the conjunction of its Params, or as its only
+// Param. Connectives are objects with the single key "and", "or" or "not".
+// Whole numbers are decoded as int64, other numbers as float64.
+// Conditions on a Subquery cannot be serialised.
+
+// operators lists the operators that can be serialised.
+var operators = map[string]bool{
+	"EQ": true, "NE": true, "GT": true, "GTE": true, "LT": true, "LTE": true,
+	"IN": true, "NIN": true, "PFX": true, "SFX": true, "CONTAINS": true,
+	"LIKE": true, "ILIKE": true, "BETWEEN": true, "ISNULL": true, "NOTNULL": true,
+}
+
+// parts lists the valid date parts of a Selectable.
+var parts = map[string]bool{"": true, "YEAR": true, "MONTH": true, "DAY": true}
+
+type jsonSelectable struct {
+	Entity string        `json:"entity"`
+	Field  string        `json:"field"`
+	Part   string        `json:"part,omitempty"`
+	Op     string        `json:"op"`
+	Value  *interface{}  `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+func (s Selectable) MarshalJSON() ([]byte, error) {
+	if !operators[s.Param.Operator] {
+		return nil, fmt.Errorf("filter: operator %s of %s.%s cannot be serialised",
+			s.Param.Operator, s.Entity, s.Field)
+	}
+	j := jsonSelectable{
+		Entity: s.Entity,
+		Field:  s.Field,
+		Part:   s.Part,
+		Op:     s.Param.Operator,
+	}
+	switch s.Param.Operator {
+	case "IN", "NIN", "BETWEEN":
+		j.Values = s.Param.Values
+		if j.Values == nil {
+			j.Values = make([]interface{}, 0)
+		}
+	case "ISNULL", "NOTNULL":
+	default:
+		j.Value = &s.Param.Value
+	}
+	return json.Marshal(j)
+}
+
+func (s *Selectable) UnmarshalJSON(data []byte) error {
+	var j jsonSelectable
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&j); err != nil {
+		return err
+	}
+	j.Op = strings.ToUpper(j.Op)
+	j.Part = strings.ToUpper(j.Part)
+	if j.Entity == "" || j.Field == "" {
+		return fmt.Errorf("filter: condition without entity or field")
+	}
+	if !operators[j.Op] {
+		return fmt.Errorf("filter: unknown operator %q", j.Op)
+	}
+	if !parts[j.Part] {
+		return fmt.Errorf("filter: unknown date part %q", j.Part)
+	}
+	if j.Op == "BETWEEN" && len(j.Values) != 2 {
+		return fmt.Errorf("filter: BETWEEN needs 2 values, got %d", len(j.Values))
+	}
+
+	if j.Value != nil && !scalar(*j.Value) {
+		return fmt.Errorf("filter: value of %s.%s is not a string, number or boolean", j.Entity, j.Field)
+	}
+	for _, v := range j.Values {
+		if !scalar(v) {
+			return fmt.Errorf("filter: value of %s.%s is not a string, number or boolean", j.Entity, j.Field)
+		}
+	}
+
+	*s = Selectable{Entity: j.Entity, Field: j.Field, Part: j.Part}
+	s.Param.Operator = j.Op
+	if j.Value != nil {
+		s.Param.Value = jsonValue(*j.Value)
+	}
+	for _, v := range j.Values {
+		s.Param.Values = append(s.Param.Values, jsonValue(v))
+	}
+	return nil
+}
+
+func (c Connective) MarshalJSON() ([]byte, error) {
+	operands := c.Operands
+	if operands == nil {
+		operands = make([]interface{}, 0)
+	}
+	return json.Marshal(map[string][]interface{}{strings.ToLower(c.Operator): operands})
+}
+
+func (c *Connective) UnmarshalJSON(data []byte) error {
+	var j map[string][]json.RawMessage
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if len(j) != 1 {
+		return fmt.Errorf("filter: connective must have exactly one of the keys and, or, not")
+	}
+	for key, raw := range j {
+		operator := strings.ToUpper(key)
+		if operator != "AND" && operator != "OR" && operator != "NOT" {
+			return fmt.Errorf("filter: unknown connective %q", key)
+		}
+		operands := make([]interface{}, 0, len(raw))
+		for _, r := range raw {
+			op, err := unmarshalParam(r)
+			if err != nil {
+				return err
+			}
+			operands = append(operands, op)
+		}
+		*c = Connective{operator, operands}
+	}
+	return nil
+}
+
+func (f *Filter) MarshalJSON() ([]byte, error) {
+	if len(f.Params) == 1 {
+		return json.Marshal(f.Params[0])
+	}
+	return json.Marshal(And(f.Params...))
+}
+
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	p, err := unmarshalParam(data)
+	if err != nil {
+		return err
+	}
+	*f = *NewFilter(p)
+	return nil
+}
+
+// unmarshalParam decodes a Connective or a Selectable.
+func unmarshalParam(data []byte) (interface{}, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	if _, ok := keys["op"]; ok {
+		var s Selectable
+		err := json.Unmarshal(data, &s)
+		return s, err
+	}
+	var c Connective
+	err := json.Unmarshal(data, &c)
+	return c, err
+}
+
+// scalar reports whether the decoded JSON value v is not an object or array.
+func scalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+// jsonValue converts a json.Number to int64 or float64.
+func jsonValue(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
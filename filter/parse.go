@@ -0,0 +1,523 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The toumin syntax is a text form of filters for people:
+//
+//	onderzoek.centrum = "ACH" and patient.geslacht in ("M", "V")
+//		and (onderzoek.datum ^= "2015" or year(onderzoek.datum) >= 2016)
+//
+// Conditions compare entity.field, or year(), month() or day() of it, with
+// a value. The operators are =, !=, >, >=, <, <=, ^= (prefix), $= (suffix),
+// ~= (contains), in (...), not in (...), like, ilike, between ... and ...,
+// is null and is not null. Conditions are combined with and, or and not,
+// and grouped with parentheses. Values are double-quoted strings with Go
+// escapes, numbers, true, false and null; = null and != null are is null
+// and is not null. Keywords are case-insensitive. The empty text is the
+// filter without conditions.
+
+// Syntax selects the text that Filter.String produces.
+type Syntax int
+
+const (
+	// SqlSyntax is the SQL condition produced by Translater.
+	SqlSyntax Syntax = iota
+	// TouminSyntax is the text that Parse accepts.
+	TouminSyntax
+)
+
+// SyntaxError is returned by Parse for text that is not a valid filter.
+type SyntaxError struct {
+	Pos    int // byte offset in the text
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter: line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOperator
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// is reports whether t is the keyword or symbol s.
+func (t token) is(s string) bool {
+	if t.kind == tokIdent {
+		return strings.EqualFold(t.text, s)
+	}
+	return (t.kind == tokOperator || t.kind == tokPunct) && t.text == s
+}
+
+var symbolOperators = map[string]string{
+	"=": "EQ", "!=": "NE", "<>": "NE", ">": "GT", ">=": "GTE", "<": "LT", "<=": "LTE",
+	"^=": "PFX", "$=": "SFX", "~=": "CONTAINS",
+}
+
+// maxDepth is the maximum nesting of parentheses and not in a filter.
+const maxDepth = 100
+
+type parser struct {
+	text   string
+	tokens []token
+	pos    int
+	depth  int
+}
+
+// Parse parses a filter in the toumin syntax.
+// The Syntax of the returned filter is TouminSyntax.
+func Parse(text string) (*Filter, error) {
+	p := &parser{text: text}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokEOF {
+		f := NewFilter()
+		f.Syntax = TouminSyntax
+		return f, nil
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	f := NewFilter()
+	if c, ok := expr.(Connective); ok && c.Operator == "AND" {
+		f.Params = c.Operands
+	} else {
+		f.Params = append(f.Params, expr)
+	}
+	f.Syntax = TouminSyntax
+	return f, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.text[:t.pos], "\n")
+	column := t.pos - strings.LastIndex(p.text[:t.pos], "\n")
+	return &SyntaxError{Pos: t.pos, Line: line, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) lex() error {
+	s := p.text
+	i := 0
+	for i < len(s) {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return p.errorf(token{pos: i}, "unterminated string")
+			}
+			p.tokens = append(p.tokens, token{tokString, s[i : j+1], i})
+			i = j + 1
+		case isDigit(c) || (c == '-' && i+1 < len(s) && isDigit(rune(s[i+1]))):
+			j := i + 1
+			for j < len(s) && (isDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				((s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokNumber, s[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + size
+			for j < len(s) {
+				r, n := utf8.DecodeRuneInString(s[j:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				j += n
+			}
+			p.tokens = append(p.tokens, token{tokIdent, s[i:j], i})
+			i = j
+		case strings.ContainsRune("(),.", c):
+			p.tokens = append(p.tokens, token{tokPunct, string(c), i})
+			i++
+		default:
+			if i+1 < len(s) {
+				if _, ok := symbolOperators[s[i:i+2]]; ok {
+					p.tokens = append(p.tokens, token{tokOperator, s[i : i+2], i})
+					i += 2
+					continue
+				}
+			}
+			if _, ok := symbolOperators[s[i:i+1]]; ok {
+				p.tokens = append(p.tokens, token{tokOperator, s[i : i+1], i})
+				i++
+				continue
+			}
+			return p.errorf(token{pos: i}, "unexpected character %q", c)
+		}
+	}
+	p.tokens = append(p.tokens, token{tokEOF, "", len(s)})
+	return nil
+}
+
+// isDigit reports whether c is an ASCII digit, as strconv parses them.
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(s string) error {
+	if t := p.next(); !t.is(s) {
+		return p.errorf(t, "expected %q, found %s", s, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (interface{}, error) {
+	return p.parseConnective("OR", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (interface{}, error) {
+	return p.parseConnective("AND", p.parseUnary)
+}
+
+func (p *parser) parseConnective(operator string, operand func() (interface{}, error)) (interface{}, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	operands := []interface{}{first}
+	for p.peek().is(operator) {
+		p.next()
+		op, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, op)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return Connective{operator, operands}, nil
+}
+
+func (p *parser) parseUnary() (interface{}, error) {
+	t := p.peek()
+	if t.is("not") || t.is("(") {
+		if p.depth++; p.depth > maxDepth {
+			return nil, p.errorf(t, "filter nested deeper than %d levels", maxDepth)
+		}
+		defer func() { p.depth-- }()
+	}
+	switch {
+	case t.is("not"):
+		p.next()
+		op, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(op), nil
+	case t.is("("):
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *parser) parseCondition() (interface{}, error) {
+	s := Selectable{}
+	t := p.peek()
+	if t.kind == tokIdent && p.tokens[p.pos+1].is("(") {
+		part := strings.ToUpper(t.text)
+		if part != "YEAR" && part != "MONTH" && part != "DAY" {
+			return nil, p.errorf(t, "unknown function %s", t)
+		}
+		s.Part = part
+		p.next()
+		p.next()
+	}
+	if err := p.parseField(&s); err != nil {
+		return nil, err
+	}
+	if s.Part != "" {
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	t = p.next()
+	if operator, ok := symbolOperators[t.text]; ok && t.kind == tokOperator {
+		v, err := p.parseValue()
+		switch {
+		case v == nil && err == nil && operator == "EQ":
+			return s.IsNull(), nil
+		case v == nil && err == nil && operator == "NE":
+			return s.NotNull(), nil
+		}
+		s.Param = Param{Operator: operator, Value: v}
+		return s, err
+	}
+	switch {
+	case t.is("in"):
+		values, err := p.parseList()
+		return s.In(values), err
+	case t.is("not"):
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		values, err := p.parseList()
+		return s.Nin(values), err
+	case t.is("like"), t.is("ilike"):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		s.Param = Param{Operator: strings.ToUpper(t.text), Value: v}
+		return s, nil
+	case t.is("between"):
+		low, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseValue()
+		return s.Between(low, high), err
+	case t.is("is"):
+		if p.peek().is("not") {
+			p.next()
+			return s.NotNull(), p.expect("null")
+		}
+		return s.IsNull(), p.expect("null")
+	}
+	return nil, p.errorf(t, "expected operator, found %s", t)
+}
+
+func (p *parser) parseField(s *Selectable) error {
+	t := p.next()
+	if t.kind != tokIdent {
+		return p.errorf(t, "expected entity, found %s", t)
+	}
+	s.Entity = t.text
+	if err := p.expect("."); err != nil {
+		return err
+	}
+	t = p.next()
+	if t.kind != tokIdent {
+		return p.errorf(t, "expected field, found %s", t)
+	}
+	s.Field = t.text
+	return nil
+}
+
+func (p *parser) parseList() ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		t := p.next()
+		if t.is(")") {
+			return values, nil
+		}
+		if !t.is(",") {
+			return nil, p.errorf(t, "expected \",\" or \")\", found %s", t)
+		}
+	}
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid string %s", t.text)
+		}
+		return s, nil
+	case tokNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t.text)
+		}
+		return f, nil
+	case tokIdent:
+		if t.is("true") {
+			return true, nil
+		}
+		if t.is("false") {
+			return false, nil
+		}
+		if t.is("null") {
+			return nil, nil
+		}
+	}
+	return nil, p.errorf(t, "expected value, found %s", t)
+}
+
+// Format returns f in the toumin syntax. Conditions on a Subquery
+// have no text form; Format returns an error for them.
+func Format(f *Filter) (string, error) {
+	args := make([]string, 0, len(f.Params))
+	for _, param := range f.Params {
+		s, err := formatParam(param, len(f.Params) == 1)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, s)
+	}
+	return strings.Join(args, " and "), nil
+}
+
+func formatParam(param interface{}, top bool) (string, error) {
+	switch e := param.(type) {
+	case Connective:
+		args := make([]string, 0, len(e.Operands))
+		for _, op := range e.Operands {
+			s, err := formatParam(op, false)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, s)
+		}
+		if e.Operator == "NOT" {
+			if len(args) == 1 {
+				return "not " + args[0], nil
+			}
+			return fmt.Sprintf("not (%s)", strings.Join(args, " and ")), nil
+		}
+		s := strings.Join(args, fmt.Sprintf(" %s ", strings.ToLower(e.Operator)))
+		if top {
+			return s, nil
+		}
+		return fmt.Sprintf("(%s)", s), nil
+	case Selectable:
+		return formatSelectable(e)
+	case *Filter:
+		s, err := Format(e)
+		if err != nil || top {
+			return s, err
+		}
+		return fmt.Sprintf("(%s)", s), nil
+	}
+	return "", fmt.Errorf("filter: cannot format %T", param)
+}
+
+func formatSelectable(s Selectable) (string, error) {
+	field := fmt.Sprintf("%s.%s", s.Entity, s.Field)
+	if s.Part != "" {
+		field = fmt.Sprintf("%s(%s)", strings.ToLower(s.Part), field)
+	}
+	if deref(s.Param.Value) == nil {
+		switch s.Param.Operator {
+		case "EQ":
+			return fmt.Sprintf("%s is null", field), nil
+		case "NE":
+			return fmt.Sprintf("%s is not null", field), nil
+		}
+	}
+	for symbol, operator := range symbolOperators {
+		if operator == s.Param.Operator && symbol != "<>" {
+			return fmt.Sprintf("%s %s %s", field, symbol, formatValue(s.Param.Value)), nil
+		}
+	}
+	switch s.Param.Operator {
+	case "IN", "NIN":
+		values := make([]string, 0, len(s.Param.Values))
+		for _, v := range s.Param.Values {
+			values = append(values, formatValue(v))
+		}
+		operator := "in"
+		if s.Param.Operator == "NIN" {
+			operator = "not in"
+		}
+		return fmt.Sprintf("%s %s (%s)", field, operator, strings.Join(values, ", ")), nil
+	case "LIKE", "ILIKE":
+		return fmt.Sprintf("%s %s %s", field, strings.ToLower(s.Param.Operator), formatValue(s.Param.Value)), nil
+	case "BETWEEN":
+		if len(s.Param.Values) == 2 {
+			return fmt.Sprintf("%s between %s and %s", field,
+				formatValue(s.Param.Values[0]), formatValue(s.Param.Values[1])), nil
+		}
+	case "ISNULL":
+		return fmt.Sprintf("%s is null", field), nil
+	case "NOTNULL":
+		return fmt.Sprintf("%s is not null", field), nil
+	}
+	return "", fmt.Errorf("filter: operator %s of %s cannot be formatted", s.Param.Operator, field)
+}
+
+func formatValue(v interface{}) string {
+	switch value := deref(v).(type) {
+	case bool:
+		return strconv.FormatBool(value)
+	case time.Time:
+		return strconv.Quote(value.Format(time.RFC3339Nano))
+	case nil:
+		return "null"
+	}
+	if isNumber(deref(v)) {
+		return fmt.Sprint(deref(v))
+	}
+	return strconv.Quote(toString(v))
+}
@@ -0,0 +1,330 @@
+// Package gen generates Go model types from the entities of a toumin
+// Registry, like the hand-written models of the toumin tests:
+//
+//	type Patient struct {
+//		*toumin.Model
+//		Achternaam string // patient_achternaam
+//	}
+//
+//	func NewPatient(name string) toumin.IModel {
+//		m := new(Patient)
+//		m.Model = toumin.NewModel(name).(*toumin.Model)
+//		m.Model.SetOwner(m)
+//		return m
+//	}
+//
+// The fields are named the way Model.Scan binds columns: the column
+// without the field prefix, in camel case. Each model gets a Ref accessor
+// per foreign key, a BackRef accessor per model that refers to it, and
+// RegisterAll registers the constructors of all models.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/henkburgstra/toumin"
+)
+
+// Options configure the generated code.
+type Options struct {
+	// Package is the name of the generated package; default "models".
+	Package string
+	// Models are the models to generate; default all registered models.
+	Models []string
+}
+
+// modelMethods are the names that a generated field may not have,
+// because it would hide a method of the embedded *toumin.Model.
+var modelMethods = func() map[string]bool {
+	names := map[string]bool{"Model": true}
+	t := reflect.TypeFor[*toumin.Model]()
+	for i := 0; i < t.NumMethod(); i++ {
+		names[t.Method(i).Name] = true
+	}
+	return names
+}()
+
+type field struct {
+	column string
+	name   string // model field name
+	ident  string // struct field; empty if it would hide a method
+	goType string
+}
+
+type ref struct {
+	method string
+	fk     string // argument of Model.Ref
+	model  string
+}
+
+type backRef struct {
+	method string
+	model  string
+	fk     string // column of the foreign key
+}
+
+type model struct {
+	name     string
+	ident    string
+	fields   []field
+	refs     []ref
+	backRefs []backRef
+}
+
+// Generate writes the Go source of the models of registry r to w.
+func Generate(w io.Writer, r *toumin.Registry, opts Options) error {
+	if opts.Package == "" {
+		opts.Package = "models"
+	}
+	names := opts.Models
+	if len(names) == 0 {
+		names = r.EntityNames()
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	models, err := buildModels(r, names)
+	if err != nil {
+		return err
+	}
+	idents := make(map[string]string)
+	for _, m := range models {
+		idents[m.name] = m.ident
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by toumin-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", opts.Package)
+	fmt.Fprintf(&b, "import \"github.com/henkburgstra/toumin\"\n\n")
+	for _, m := range models {
+		writeModel(&b, m, idents)
+	}
+
+	fmt.Fprintf(&b, "// RegisterAll registers the constructors of the generated models.\n")
+	fmt.Fprintf(&b, "func RegisterAll(registry *toumin.Registry) {\n")
+	for _, m := range models {
+		fmt.Fprintf(&b, "registry.RegisterModel(%q, New%s)\n", m.name, m.ident)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("gen: formatting generated code: %w", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// buildModels collects the fields and relations of the models names.
+func buildModels(r *toumin.Registry, names []string) ([]*model, error) {
+	models := make([]*model, 0, len(names))
+	byTable := make(map[string]*model)
+	seen := make(map[string]string)
+	for _, name := range names {
+		entity := r.Entity(name)
+		if entity == nil {
+			return nil, toumin.UnknownModelError{Model: name}
+		}
+		m := &model{name: name, ident: identifier(name)}
+		if other, ok := seen[m.ident]; ok {
+			return nil, fmt.Errorf("gen: models %s and %s both map to type %s", other, name, m.ident)
+		}
+		seen[m.ident] = name
+
+		fieldPrefix := strings.Replace(r.FieldPrefix(), "{model}", name, 1)
+		for _, column := range entity.ColumnNames() {
+			f := entity.Fields[column]
+			m.fields = append(m.fields, field{column: column, name: strings.TrimPrefix(column, fieldPrefix), goType: goType(f)})
+		}
+
+		// Model.Ref finds the relationship of foreign key "{model}_{fk}".
+		fks := make([]string, 0, len(entity.Relationships))
+		for fk := range entity.Relationships {
+			fks = append(fks, fk)
+		}
+		sort.Strings(fks)
+		for _, column := range fks {
+			fk, ok := strings.CutPrefix(column, name+"_")
+			if !ok {
+				continue
+			}
+			rel := entity.Relationships[column]
+			m.refs = append(m.refs, ref{method: "Ref" + identifier(fk), fk: fk,
+				model: r.TrimTableAffixes(rel.ReferencedTable)})
+		}
+
+		models = append(models, m)
+		byTable[entity.Name] = m
+	}
+
+	for _, child := range models {
+		entity := r.Entity(child.name)
+		byParent := make(map[string][]string)
+		for fk, rel := range entity.Relationships {
+			if _, ok := byTable[rel.ReferencedTable]; ok {
+				byParent[rel.ReferencedTable] = append(byParent[rel.ReferencedTable], fk)
+			}
+		}
+		for table, fks := range byParent {
+			sort.Strings(fks)
+			parent := byTable[table]
+			fieldPrefix := strings.Replace(r.FieldPrefix(), "{model}", child.name, 1)
+			for _, fk := range fks {
+				method := "BackRef" + child.ident
+				if len(fks) > 1 {
+					method += "By" + identifier(strings.TrimPrefix(fk, fieldPrefix))
+				}
+				parent.backRefs = append(parent.backRefs, backRef{method: method, model: child.name, fk: fk})
+			}
+		}
+	}
+	for _, m := range models {
+		sort.Slice(m.backRefs, func(i, j int) bool { return m.backRefs[i].method < m.backRefs[j].method })
+		if err := m.fieldIdents(); err != nil {
+			return nil, err
+		}
+	}
+	return models, nil
+}
+
+// fieldIdents names the struct fields of m. A field that would have the
+// name of a method of Model, of a generated Ref, BackRef or Value method,
+// or of an earlier field gets no struct field but a Value method.
+func (m *model) fieldIdents() error {
+	methods := make(map[string]bool)
+	for _, r := range m.refs {
+		methods[r.method] = true
+	}
+	for _, br := range m.backRefs {
+		methods[br.method] = true
+	}
+	hidden := make([]bool, len(m.fields))
+	for changed := true; changed; {
+		changed = false
+		values := make(map[string]bool)
+		for i, f := range m.fields {
+			if hidden[i] {
+				values[identifier(f.name)+"Value"] = true
+			}
+		}
+		idents := make(map[string]bool)
+		for i, f := range m.fields {
+			ident := identifier(f.name)
+			if hidden[i] {
+				continue
+			}
+			if modelMethods[ident] || methods[ident] || values[ident] || idents[ident] {
+				hidden[i], changed = true, true
+				continue
+			}
+			idents[ident] = true
+		}
+	}
+	for i := range m.fields {
+		if !hidden[i] {
+			m.fields[i].ident = identifier(m.fields[i].name)
+			continue
+		}
+		method := identifier(m.fields[i].name) + "Value"
+		if modelMethods[method] || methods[method] {
+			return fmt.Errorf("gen: method %s of model %s is generated twice", method, m.name)
+		}
+		methods[method] = true
+	}
+	return nil
+}
+
+func writeModel(b *bytes.Buffer, m *model, idents map[string]string) {
+	fmt.Fprintf(b, "// %s is the model %s.\n", m.ident, m.name)
+	fmt.Fprintf(b, "type %s struct {\n*toumin.Model\n", m.ident)
+	for _, f := range m.fields {
+		if f.ident != "" {
+			fmt.Fprintf(b, "%s %s // %s\n", f.ident, f.goType, f.column)
+		}
+	}
+	fmt.Fprintf(b, "}\n\n")
+
+	fmt.Fprintf(b, "// New%s constructs a new %s; it is the ModelConstructor of %s.\n", m.ident, m.ident, m.name)
+	fmt.Fprintf(b, "func New%s(name string) toumin.IModel {\n", m.ident)
+	fmt.Fprintf(b, "m := new(%s)\nm.Model = toumin.NewModel(name).(*toumin.Model)\nm.Model.SetOwner(m)\nreturn m\n}\n\n", m.ident)
+
+	// Fields without a struct field, see fieldIdents, are not bound by
+	// Scan, but are available through Field.
+	for _, f := range m.fields {
+		if f.ident == "" {
+			method := identifier(f.name) + "Value"
+			fmt.Fprintf(b, "// %s returns the value of %s.\n", method, f.column)
+			fmt.Fprintf(b, "func (m *%s) %s() *toumin.FieldValue {\nreturn m.Field(%q)\n}\n\n", m.ident, method, f.name)
+		}
+	}
+
+	for _, r := range m.refs {
+		ident, ok := idents[r.model]
+		fmt.Fprintf(b, "// %s returns the %s that %s refers to.\n", r.method, r.model, r.fk)
+		if !ok {
+			fmt.Fprintf(b, "func (m *%s) %s() (toumin.IModel, bool) {\nreturn m.Ref(%q)\n}\n\n", m.ident, r.method, r.fk)
+			continue
+		}
+		fmt.Fprintf(b, "func (m *%s) %s() (*%s, bool) {\n", m.ident, r.method, ident)
+		fmt.Fprintf(b, "ref, ok := m.Ref(%q)\nif !ok {\nreturn nil, false\n}\n", r.fk)
+		fmt.Fprintf(b, "model, ok := ref.(*%s)\nreturn model, ok\n}\n\n", ident)
+	}
+
+	for _, br := range m.backRefs {
+		ident := idents[br.model]
+		fmt.Fprintf(b, "// %s returns the %s models whose %s refers to this %s.\n", br.method, br.model, br.fk, m.name)
+		fmt.Fprintf(b, "func (m *%s) %s() []*%s {\n", m.ident, br.method, ident)
+		fmt.Fprintf(b, "models := make([]*%s, 0)\n", ident)
+		fmt.Fprintf(b, "for _, model := range m.BackRef(%q, %q).All() {\n", br.model, br.fk)
+		fmt.Fprintf(b, "if model, ok := model.(*%s); ok {\nmodels = append(models, model)\n}\n}\nreturn models\n}\n\n", ident)
+	}
+}
+
+// goType returns the type of the struct field of f. Model.Scan binds
+// ints, strings and byte slices; the other kinds are scanned as strings.
+func goType(f *toumin.EntityField) string {
+	switch f.Kind() {
+	case "int":
+		if strings.HasPrefix(strings.ToLower(f.Type), "bigint") ||
+			strings.HasPrefix(strings.ToLower(f.Type), "bigserial") {
+			return "int64"
+		}
+		return "int"
+	case "bytes":
+		return "[]byte"
+	}
+	return "string"
+}
+
+// identifier returns name as an exported Go identifier, the way
+// Model.Scan finds the struct field of a column: the_name -> TheName.
+func identifier(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' {
+			return c
+		}
+		return '_'
+	}, name)
+	parts := strings.Split(name, "_")
+	words := parts[:0]
+	for _, p := range parts {
+		if p != "" {
+			words = append(words, p)
+		}
+	}
+	if len(words) == 0 {
+		return "X"
+	}
+	ident := toumin.Underscore2Camel(strings.Join(words, "_"))
+	if !unicode.IsLetter([]rune(ident)[0]) {
+		ident = "X" + ident
+	}
+	return ident
+}
@@ -0,0 +1,100 @@
+package gen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/henkburgstra/toumin"
+)
+
+func makeRegistry() *toumin.Registry {
+	registry := toumin.NewRegistry(toumin.NewEngine(toumin.MysqlDriver))
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	patient := toumin.NewEntity("patient_data")
+	patient.Fields["patient_key"] = &toumin.EntityField{Name: "patient_key", Type: "varchar(25)", Key: true}
+	patient.Fields["patient_achternaam"] = &toumin.EntityField{Name: "patient_achternaam", Type: "varchar(50)"}
+	patient.Fields["patient_foto"] = &toumin.EntityField{Name: "patient_foto", Type: "blob"}
+	registry.RegisterEntity("patient", patient)
+	behandeling := toumin.NewEntity("behandeling_data")
+	behandeling.Fields["behandeling_key"] = &toumin.EntityField{Name: "behandeling_key", Type: "varchar(25)", Key: true}
+	behandeling.Fields["behandeling_patient"] = &toumin.EntityField{Name: "behandeling_patient", Type: "varchar(25)"}
+	behandeling.Fields["behandeling_verwijzer"] = &toumin.EntityField{Name: "behandeling_verwijzer", Type: "varchar(25)"}
+	behandeling.Fields["behandeling_aantal"] = &toumin.EntityField{Name: "behandeling_aantal", Type: "int(11)"}
+	behandeling.Fields["behandeling_volgnummer"] = &toumin.EntityField{Name: "behandeling_volgnummer", Type: "bigint"}
+	for _, fk := range []string{"behandeling_patient", "behandeling_verwijzer"} {
+		behandeling.AddRelationship(toumin.EntityRelationship{
+			ForeignKey:       fk,
+			ReferencedTable:  "patient_data",
+			ReferencedColumn: "patient_key",
+		})
+	}
+	registry.RegisterEntity("behandeling", behandeling)
+	return registry
+}
+
+func TestGenerate(t *testing.T) {
+	var b bytes.Buffer
+	if err := Generate(&b, makeRegistry(), Options{Package: "amersfoort"}); err != nil {
+		t.Fatalf("TestGenerate(): %s", err.Error())
+	}
+	src := b.String()
+	for _, expected := range []string{
+		"package amersfoort",
+		"type Patient struct {\n\t*toumin.Model\n\tAchternaam string // patient_achternaam\n\tFoto       []byte // patient_foto\n}",
+		"\tAantal     int    // behandeling_aantal\n",
+		"\tVolgnummer int64  // behandeling_volgnummer\n",
+		"func NewBehandeling(name string) toumin.IModel {",
+		"func (m *Patient) KeyValue() *toumin.FieldValue {\n\treturn m.Field(\"key\")\n}",
+		"func (m *Behandeling) RefPatient() (*Patient, bool) {\n\tref, ok := m.Ref(\"patient\")",
+		"func (m *Behandeling) RefVerwijzer() (*Patient, bool) {",
+		"func (m *Patient) BackRefBehandelingByPatient() []*Behandeling {",
+		"m.BackRef(\"behandeling\", \"behandeling_verwijzer\").All()",
+		"registry.RegisterModel(\"behandeling\", NewBehandeling)\n\tregistry.RegisterModel(\"patient\", NewPatient)\n}",
+	} {
+		if !strings.Contains(src, expected) {
+			t.Errorf("TestGenerate(): expected %q in\n%s", expected, src)
+		}
+	}
+	if strings.Contains(src, "\tKey ") {
+		t.Errorf("TestGenerate(): field Key hides Model.Key")
+	}
+
+	b.Reset()
+	if err := Generate(&b, makeRegistry(), Options{Models: []string{"behandeling"}}); err != nil {
+		t.Fatalf("TestGenerate(): %s", err.Error())
+	}
+	if !strings.Contains(b.String(), "func (m *Behandeling) RefPatient() (toumin.IModel, bool) {") {
+		t.Errorf("TestGenerate(): expected an untyped Ref accessor in\n%s", b.String())
+	}
+	if err := Generate(&b, makeRegistry(), Options{Models: []string{"arts"}}); err == nil {
+		t.Errorf("TestGenerate(): expected an error for an unknown model")
+	}
+	// Columns named like the generated methods get no struct field.
+	registry := makeRegistry()
+	behandeling := registry.Entity("behandeling")
+	behandeling.Fields["behandeling_ref_patient"] = &toumin.EntityField{Name: "behandeling_ref_patient", Type: "varchar(25)"}
+	behandeling.Fields["behandeling_key_value"] = &toumin.EntityField{Name: "behandeling_key_value", Type: "varchar(25)"}
+	registry.Entity("patient").Fields["patient_back_ref_behandeling_by_patient"] = &toumin.EntityField{
+		Name: "patient_back_ref_behandeling_by_patient", Type: "int(11)"}
+	b.Reset()
+	if err := Generate(&b, registry, Options{}); err != nil {
+		t.Fatalf("TestGenerate(): %s", err.Error())
+	}
+	src = b.String()
+	for _, expected := range []string{
+		"func (m *Behandeling) RefPatientValue() *toumin.FieldValue {\n\treturn m.Field(\"ref_patient\")\n}",
+		"func (m *Behandeling) KeyValueValue() *toumin.FieldValue {\n\treturn m.Field(\"key_value\")\n}",
+		"func (m *Patient) BackRefBehandelingByPatientValue() *toumin.FieldValue {",
+	} {
+		if !strings.Contains(src, expected) {
+			t.Errorf("TestGenerate(): expected %q in\n%s", expected, src)
+		}
+	}
+	for _, field := range []string{"\tRefPatient ", "\tKeyValue ", "\tBackRefBehandelingByPatient "} {
+		if strings.Contains(src, field) {
+			t.Errorf("TestGenerate(): field %s hides a generated method in\n%s", strings.TrimSpace(field), src)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package toumin
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ImportOptions configure the import of rows into a model.
+type ImportOptions struct {
+	// Comma is the field delimiter of CSV; default ','.
+	Comma rune
+	// BatchSize is the number of rows per INSERT statement; default 100,
+	// and at most the parameter limit of the database allows.
+	BatchSize int
+	// DryRun validates the rows without inserting them.
+	DryRun bool
+}
+
+// RowError reports an invalid row of an import.
+type RowError struct {
+	Line  int
+	Field string // empty if the error concerns the row as a whole
+	Msg   string
+}
+
+func (e RowError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("line %d: field %s: %s", e.Line, e.Field, e.Msg)
+}
+
+// ImportReport is the result of an import: the number of rows read and
+// inserted, and the errors of the rows that were skipped.
+type ImportReport struct {
+	Rows     int
+	Inserted int
+	Errors   []RowError
+}
+
+// String returns the report as text, one line per error.
+func (r *ImportReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d rows read, %d inserted, %d errors\n", r.Rows, r.Inserted, len(r.Errors))
+	for _, e := range r.Errors {
+		fmt.Fprintln(&b, e.Error())
+	}
+	return b.String()
+}
+
+// importRow is a row of an import: its values by column.
+type importRow struct {
+	line   int
+	values map[string]interface{}
+}
+
+// ImportCSV inserts the rows of the CSV in rd into model. The header
+// names the fields, as model field names or column names. Empty values
+// are NULL, except for fields of a string type that are not nullable and
+// not a key. Fields with a default get their default for NULL.
+// See ImportJSONL for the validation of the rows.
+func (r *Registry) ImportCSV(model string, rd io.Reader, opts ImportOptions) (*ImportReport, error) {
+	entity := r.Entity(model)
+	if entity == nil {
+		return nil, UnknownModelError{model}
+	}
+	c := csv.NewReader(rd)
+	if opts.Comma != 0 {
+		c.Comma = opts.Comma
+	}
+	c.FieldsPerRecord = -1
+	header, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		if columns[i], err = r.importColumn(entity, model, strings.TrimSpace(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.importRows(entity, model, opts, func() (*importRow, error) {
+		record, err := c.Read()
+		if err != nil {
+			var parseError *csv.ParseError
+			if errors.As(err, &parseError) {
+				return nil, RowError{Line: parseError.Line, Msg: parseError.Err.Error()}
+			}
+			return nil, err
+		}
+		line, _ := c.FieldPos(0)
+		if len(record) != len(columns) {
+			return nil, RowError{Line: line, Msg: fmt.Sprintf("%d values, expected %d", len(record), len(columns))}
+		}
+		row := &importRow{line: line, values: make(map[string]interface{})}
+		for i, column := range columns {
+			f := entity.Fields[column]
+			if record[i] == "" && (f.Null || f.Key || f.Kind() != "string") {
+				row.values[column] = nil
+			} else {
+				row.values[column] = record[i]
+			}
+		}
+		return row, nil
+	})
+}
+
+// ImportJSONL inserts the JSON objects in rd, one per line, into model.
+// The keys name the fields, as model field names or column names.
+//
+// Every row is validated against the fields of the entity: values must
+// be of the type of their field and fit its length, and fields that are
+// not nullable and have no default must have a value, unless they are an
+// integer key. Invalid rows are skipped and reported. The valid rows are
+// inserted in batches, in a single transaction, so a database error
+// inserts nothing.
+func (r *Registry) ImportJSONL(model string, rd io.Reader, opts ImportOptions) (*ImportReport, error) {
+	entity := r.Entity(model)
+	if entity == nil {
+		return nil, UnknownModelError{model}
+	}
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 16*1024*1024)
+	line := 0
+
+	return r.importRows(entity, model, opts, func() (*importRow, error) {
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			decoder := json.NewDecoder(bytes.NewReader(text))
+			decoder.UseNumber()
+			var doc map[string]interface{}
+			if err := decoder.Decode(&doc); err != nil {
+				return nil, RowError{Line: line, Msg: err.Error()}
+			}
+			row := &importRow{line: line, values: make(map[string]interface{})}
+			for name, value := range doc {
+				column, err := r.importColumn(entity, model, name)
+				if err != nil {
+					return nil, RowError{Line: line, Field: name, Msg: "unknown field"}
+				}
+				switch v := value.(type) {
+				case nil, string, bool:
+					row.values[column] = v
+				case json.Number:
+					row.values[column] = v.String()
+				default:
+					return nil, RowError{Line: line, Field: name, Msg: "not a string, number or boolean"}
+				}
+			}
+			return row, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	})
+}
+
+// importColumn returns the column of field name of model.
+func (r *Registry) importColumn(entity *Entity, model, name string) (string, error) {
+	column := entity.TranslateModelField(model, name)
+	if _, ok := entity.Fields[column]; !ok {
+		return "", fmt.Errorf("Model '%s' has no field '%s'", model, name)
+	}
+	return column, nil
+}
+
+// importRows validates the rows that next returns and inserts the valid
+// ones. Next returns io.EOF after the last row, and a RowError for a row
+// that cannot be read.
+func (r *Registry) importRows(entity *Entity, model string, opts ImportOptions, next func() (*importRow, error)) (*ImportReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	report := new(ImportReport)
+	fieldPrefix := strings.Replace(r.FieldPrefix(), "{model}", model, 1)
+
+	var tx *sql.Tx
+	var inserter *batchInserter
+	if !opts.DryRun {
+		db, err := r.Db()
+		if err != nil {
+			return nil, err
+		}
+		if tx, err = db.Begin(); err != nil {
+			return nil, err
+		}
+		d := r.dialect()
+		inserter = &batchInserter{db: tx, entity: entity, size: opts.BatchSize, limit: d.maxParams(), maxRows: d.maxRows()}
+	}
+	fail := func(err error) (*ImportReport, error) {
+		if tx != nil {
+			tx.Rollback()
+		}
+		report.Inserted = 0
+		return report, err
+	}
+
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		var rowError RowError
+		if errors.As(err, &rowError) {
+			report.Rows++
+			report.Errors = append(report.Errors, rowError)
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		report.Rows++
+
+		errs := validateRow(entity, fieldPrefix, row)
+		if len(errs) > 0 {
+			report.Errors = append(report.Errors, errs...)
+			continue
+		}
+		if inserter != nil {
+			n, err := inserter.add(row.values)
+			report.Inserted += n
+			if err != nil {
+				return fail(fmt.Errorf("line %d: %w", row.line, err))
+			}
+		}
+	}
+
+	if inserter != nil {
+		n, err := inserter.flush()
+		report.Inserted += n
+		if err != nil {
+			return fail(err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fail(err)
+		}
+	}
+	return report, nil
+}
+
+// validateRow checks the values of row against the fields of entity and
+// converts them to the parameters of an INSERT.
+func validateRow(entity *Entity, fieldPrefix string, row *importRow) []RowError {
+	errs := make([]RowError, 0)
+	for _, column := range entity.ColumnNames() {
+		f := entity.Fields[column]
+		name := strings.TrimPrefix(column, fieldPrefix)
+		value, ok := row.values[column]
+		if !ok || value == nil {
+			if f.Default != "" && !strings.EqualFold(f.Default, "NULL") {
+				// Leave the column out, so that the database default applies.
+				delete(row.values, column)
+			} else if !f.Null && !(f.Key && f.Kind() == "int") {
+				errs = append(errs, RowError{Line: row.line, Field: name, Msg: "a value is required"})
+			}
+			continue
+		}
+		v, err := importValue(f, value)
+		if err != nil {
+			errs = append(errs, RowError{Line: row.line, Field: name, Msg: err.Error()})
+			continue
+		}
+		row.values[column] = v
+	}
+	return errs
+}
+
+// importValue checks value against the type of field f and returns it
+// as a parameter: int64 for integers, bool for booleans and strings for
+// the other kinds.
+func importValue(f *EntityField, value interface{}) (interface{}, error) {
+	if b, ok := value.(bool); ok {
+		if f.Kind() != "bool" {
+			return nil, fmt.Errorf("%t is not a %s", b, f.Type)
+		}
+		return b, nil
+	}
+	s := value.(string)
+	switch f.Kind() {
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", s)
+		}
+		return i, nil
+	case "float", "decimal":
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", s)
+		}
+		return b, nil
+	case "date", "datetime", "time":
+		layouts := map[string][]string{
+			"date":     {"2006-01-02"},
+			"datetime": {"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"},
+			"time":     {"15:04:05.999999999", "15:04"},
+		}[f.Kind()]
+		valid := false
+		for _, layout := range layouts {
+			if _, err := time.Parse(layout, s); err == nil {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%q is not a %s", s, f.Kind())
+		}
+	case "string":
+		if f.Length > 0 && utf8.RuneCountInString(s) > f.Length {
+			return nil, fmt.Errorf("%q is longer than %d characters", s, f.Length)
+		}
+	case "bytes":
+		if f.Length > 0 && len(s) > f.Length {
+			return nil, fmt.Errorf("value is longer than %d bytes", f.Length)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,352 @@
+package toumin
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// maxParams returns the maximum number of parameters of a statement.
+// SQL Server allows 2100 parameters, including the two of sp_executesql.
+func (d dialect) maxParams() int {
+	switch d {
+	case "mssql":
+		return 2098
+	case "sqlite":
+		return 32766
+	}
+	return 65535
+}
+
+// maxRows returns the maximum number of rows of a VALUES list, or 0 if
+// there is no limit.
+func (d dialect) maxRows() int {
+	if d == "mssql" {
+		return 1000
+	}
+	return 0
+}
+
+// InsertMany inserts models, which are of model, with multi-row INSERT
+// statements in a single transaction. A statement has as many rows as the
+// parameter limit of the database allows (2098 parameters on MSSQL).
+// The columns of a model are its struct fields that Scan binds to columns,
+// like Achternaam to patient_achternaam, and the other fields it has; see
+// Model.Fields. It returns the number of models inserted.
+func (r *Registry) InsertMany(model string, models []IModel) (int, error) {
+	entity := r.Entity(model)
+	if entity == nil {
+		return 0, UnknownModelError{model}
+	}
+	return r.writeMany(entity, model, models, func(columns []string, rows int) (string, error) {
+		return insertSql(entity, columns, rows), nil
+	})
+}
+
+// Upsert inserts models, which are of model, and updates the rows that
+// already exist, like InsertMany. Rows are matched on the primary key of
+// the entity or, if it has none, on its first unique index, with the SQL
+// of the database: ON DUPLICATE KEY UPDATE on MySQL, ON CONFLICT on SQLite
+// and PostgreSQL and MERGE on MSSQL. Every model must have the key fields.
+// It returns the number of models written.
+func (r *Registry) Upsert(model string, models []IModel) (int, error) {
+	entity := r.Entity(model)
+	if entity == nil {
+		return 0, UnknownModelError{model}
+	}
+	keys := upsertKeys(entity)
+	if len(keys) == 0 {
+		return 0, NoKeyError{entity.Name}
+	}
+	d := r.dialect()
+	return r.writeMany(entity, model, models, func(columns []string, rows int) (string, error) {
+		return d.upsertSql(entity, keys, columns, rows)
+	})
+}
+
+// writeMany writes the fields of models with the statements of
+// statement, in a transaction.
+func (r *Registry) writeMany(entity *Entity, model string, models []IModel,
+	statement func(columns []string, rows int) (string, error)) (int, error) {
+	db, err := r.Db()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	d := r.dialect()
+	b := &batchInserter{db: tx, entity: entity, limit: d.maxParams(), maxRows: d.maxRows(), statement: statement}
+	fieldPrefix := strings.Replace(r.FieldPrefix(), "{model}", model, 1)
+	n := 0
+	for i, m := range models {
+		values := modelValues(entity, fieldPrefix, m)
+		if len(values) == 0 {
+			tx.Rollback()
+			return 0, fmt.Errorf("Model %d has no fields of table %s", i, entity.Name)
+		}
+		inserted, err := b.add(values)
+		n += inserted
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	inserted, err := b.flush()
+	n += inserted
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// modelValues returns the values of the fields of m by column: those of
+// the struct fields that Scan binds to the columns, or else those of
+// m.Fields.
+func modelValues(entity *Entity, fieldPrefix string, m IModel) map[string]interface{} {
+	values := make(map[string]interface{})
+	fields := m.Fields()
+	for column := range entity.Fields {
+		name := strings.TrimPrefix(column, fieldPrefix)
+		if v, ok := structValue(m, entity, column, name); ok {
+			values[column] = v
+		} else if v, ok := fields[name]; ok {
+			values[column] = v.Get()
+		}
+	}
+	return values
+}
+
+// structValue returns the value of the exported struct field of the owner
+// of m that Scan binds to column, with model field name: the field that
+// entity records for column, or else Achternaam for achternaam.
+// A nil pointer field is NULL.
+func structValue(m IModel, entity *Entity, column, name string) (interface{}, bool) {
+	field, ok := entity.structField(column)
+	if !ok {
+		if name == "" || strings.HasPrefix(name, "_") || strings.HasSuffix(name, "_") || strings.Contains(name, "__") {
+			return nil, false
+		}
+		field = Underscore2Camel(name)
+	}
+	owner := m.Owner()
+	if owner == nil {
+		owner = m
+	}
+	v := reflect.ValueOf(owner)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	sf, ok := v.Elem().Type().FieldByName(field)
+	if !ok || !sf.IsExported() {
+		return nil, false
+	}
+	f, err := v.Elem().FieldByIndexErr(sf.Index)
+	if err != nil {
+		return nil, false
+	}
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return nil, true
+		}
+		f = f.Elem()
+	}
+	return f.Interface(), true
+}
+
+// upsertKeys returns the columns that identify the rows of entity: those
+// of the primary key, or else those of the first unique index by name.
+func upsertKeys(entity *Entity) []string {
+	keys := make([]string, 0)
+	for _, f := range entity.Keys() {
+		keys = append(keys, f.Name)
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return keys
+	}
+	names := make([]string, 0)
+	for name, index := range entity.Indexes {
+		if index.Unique {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return keys
+	}
+	return append(keys, entity.Indexes[names[0]].Columns...)
+}
+
+// execer executes statements; it is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// batchInserter writes rows of an entity with multi-row statements of up
+// to size rows, and no more parameters than limit. Consecutive rows with
+// the same columns share a statement. The statements are INSERTs unless
+// statement is set.
+type batchInserter struct {
+	db        execer
+	entity    *Entity
+	size      int
+	limit     int
+	maxRows   int
+	statement func(columns []string, rows int) (string, error)
+	columns   []string
+	rows      []map[string]interface{}
+}
+
+// add adds the row values, a value per column, and writes the pending
+// rows if the batch is full or the columns differ. It returns the number
+// of rows written.
+func (b *batchInserter) add(values map[string]interface{}) (int, error) {
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	n := 0
+	if len(b.rows) > 0 && strings.Join(columns, ",") != strings.Join(b.columns, ",") {
+		var err error
+		if n, err = b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	b.columns = columns
+	b.rows = append(b.rows, values)
+	if len(b.rows) >= b.batchSize() {
+		m, err := b.flush()
+		return n + m, err
+	}
+	return n, nil
+}
+
+// batchSize returns the number of rows of a statement with the current columns.
+func (b *batchInserter) batchSize() int {
+	size := b.size
+	if b.limit > 0 && len(b.columns) > 0 {
+		if rows := b.limit / len(b.columns); size <= 0 || rows < size {
+			size = rows
+		}
+	}
+	if b.maxRows > 0 && (size <= 0 || b.maxRows < size) {
+		size = b.maxRows
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return size
+}
+
+// flush writes the pending rows and returns their number.
+func (b *batchInserter) flush() (int, error) {
+	if len(b.rows) == 0 {
+		return 0, nil
+	}
+	params := make([]interface{}, 0, len(b.rows)*len(b.columns))
+	for _, row := range b.rows {
+		for _, column := range b.columns {
+			params = append(params, row[column])
+		}
+	}
+	n := len(b.rows)
+	b.rows = b.rows[:0]
+	statement := insertSql(b.entity, b.columns, n)
+	if b.statement != nil {
+		var err error
+		if statement, err = b.statement(b.columns, n); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := b.db.Exec(statement, params...); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// valuesSql returns the VALUES list of rows rows of n parameters: (?, ?), (?, ?).
+func valuesSql(n, rows int) string {
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+	values := make([]string, rows)
+	for i := range values {
+		values[i] = placeholders
+	}
+	return strings.Join(values, ", ")
+}
+
+// insertSql returns an INSERT of rows rows of columns into entity:
+//
+//	INSERT INTO patient_data (patient_key, patient_naam) VALUES (?, ?), (?, ?)
+func insertSql(entity *Entity, columns []string, rows int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", entity.Name, strings.Join(columns, ", "),
+		valuesSql(len(columns), rows))
+}
+
+// upsertSql returns the statement that inserts rows rows of columns into
+// entity and updates the rows whose keys exist.
+func (d dialect) upsertSql(entity *Entity, keys, columns []string, rows int) (string, error) {
+	isKey := make(map[string]bool)
+	for _, key := range keys {
+		isKey[key] = true
+	}
+	present := 0
+	update := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if isKey[column] {
+			present++
+		} else {
+			update = append(update, column)
+		}
+	}
+	if present != len(keys) {
+		return "", fmt.Errorf("Upsert into %s needs the key columns %s", entity.Name, strings.Join(keys, ", "))
+	}
+
+	set := make([]string, len(update))
+	switch d {
+	case "mysql":
+		for i, column := range update {
+			set[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+		}
+		if len(set) == 0 {
+			set = append(set, fmt.Sprintf("%s = %s", keys[0], keys[0]))
+		}
+		return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", insertSql(entity, columns, rows), strings.Join(set, ", ")), nil
+	case "mssql":
+		on := make([]string, len(keys))
+		for i, key := range keys {
+			on[i] = fmt.Sprintf("target.%s = source.%s", key, key)
+		}
+		for i, column := range update {
+			set[i] = fmt.Sprintf("%s = source.%s", column, column)
+		}
+		source := make([]string, len(columns))
+		for i, column := range columns {
+			source[i] = "source." + column
+		}
+		sql := fmt.Sprintf("MERGE INTO %s AS target USING (VALUES %s) AS source (%s) ON %s",
+			entity.Name, valuesSql(len(columns), rows), strings.Join(columns, ", "), strings.Join(on, " AND "))
+		if len(set) > 0 {
+			sql += fmt.Sprintf(" WHEN MATCHED THEN UPDATE SET %s", strings.Join(set, ", "))
+		}
+		return sql + fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);",
+			strings.Join(columns, ", "), strings.Join(source, ", ")), nil
+	}
+	for i, column := range update {
+		set[i] = fmt.Sprintf("%s = excluded.%s", column, column)
+	}
+	action := "DO NOTHING"
+	if len(set) > 0 {
+		action = "DO UPDATE SET " + strings.Join(set, ", ")
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) %s", insertSql(entity, columns, rows), strings.Join(keys, ", "), action), nil
+}
@@ -0,0 +1,164 @@
+package toumin
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+)
+
+// KeyNaming selects the keys of models encoded to JSON.
+type KeyNaming int
+
+const (
+	// ModelFieldKeys uses model field names: achternaam.
+	ModelFieldKeys KeyNaming = iota
+	// ColumnKeys uses column names: patient_achternaam.
+	ColumnKeys
+)
+
+// JSONOptions configures the JSON encoding of models.
+type JSONOptions struct {
+	Keys     KeyNaming
+	OmitNull bool
+}
+
+// JSONOptions returns the options used to encode the models
+// of the registry to JSON.
+func (r *Registry) JSONOptions() JSONOptions {
+	return r.jsonOptions
+}
+
+func (r *Registry) SetJSONOptions(options JSONOptions) {
+	r.jsonOptions = options
+}
+
+// MarshalJSON encodes the fields of the model, including the struct
+// fields bound in Scan, and its preloaded relations as a JSON object.
+// The options are those of the model's registry.
+//
+//	{"achternaam": "Leeuwerik", "key": "PJJG-AA0010",
+//	 "huisarts": {"key": "PJJG-VW0800", ...},
+//	 "behandeling": [{"key": ...}, ...]}
+//
+// Values are typed by the fields of the model's entity: numbers for
+// integer and decimal columns, booleans for bit columns.
+func (m *Model) MarshalJSON() ([]byte, error) {
+	options := JSONOptions{}
+	if m.registry != nil {
+		options = m.registry.JSONOptions()
+	}
+	return m.MarshalJSONOptions(options)
+}
+
+// MarshalJSONOptions is MarshalJSON with explicit options.
+// Relations are encoded with the options of their own registry.
+func (m *Model) MarshalJSONOptions(options JSONOptions) ([]byte, error) {
+	doc := make(map[string]interface{})
+	entity := m.Entity()
+
+	for name, value := range m.fields {
+		column := m.FieldMapping(name)
+		var field *EntityField
+		if entity != nil {
+			field = entity.Fields[column]
+		}
+		v := jsonValue(value, field)
+		if v == nil && options.OmitNull {
+			continue
+		}
+		key := name
+		if options.Keys == ColumnKeys && column != "" {
+			key = column
+		}
+		doc[key] = v
+	}
+
+	for name, r := range m.relations {
+		if r == nil && options.OmitNull {
+			continue
+		}
+		doc[name] = r
+	}
+
+	return json.Marshal(doc)
+}
+
+// jsonValue returns the value of v for encoding to JSON, converted
+// to the kind of field if field is not nil.
+func jsonValue(v *FieldValue, field *EntityField) interface{} {
+	value := reflect.ValueOf(v.Get())
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return nil
+	}
+
+	var s string
+	switch x := value.Interface().(type) {
+	case string:
+		s = x
+	case []byte:
+		s = string(x)
+	default:
+		return x
+	}
+	if field == nil {
+		return s
+	}
+
+	switch field.Kind() {
+	case "int":
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case "float", "decimal":
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+		if len(s) == 1 && (s[0] == 0 || s[0] == 1) {
+			return s[0] == 1
+		}
+	}
+	return s
+}
+
+// Preload makes the query load the named relations of every model it
+// returns, for use with Model.Relation and JSON encoding. A name is
+// either a reference, as used with Ref ("huisarts"), or a model that
+// refers to the model of the query, as used with BackRef ("behandeling").
+func (q *Query) Preload(names ...string) *Query {
+	q.preload = append(q.preload, names...)
+	return q
+}
+
+// loadRelations loads the relations named in Preload for m, if m is
+// a RelationHolder.
+func (q *Query) loadRelations(m IModel) {
+	h, ok := m.(RelationHolder)
+	if !ok {
+		return
+	}
+	for _, name := range q.preload {
+		if entity := m.Entity(); entity != nil {
+			if _, ok := entity.Relationship(entity.TranslateModelField(m.Name(), name)); ok {
+				if ref, ok := m.Ref(name); ok {
+					h.SetRelation(name, ref)
+				} else {
+					h.SetRelation(name, nil)
+				}
+				continue
+			}
+		}
+		if q.registry.Entity(name) != nil {
+			h.SetRelation(name, m.BackRef(name).All())
+		}
+	}
+}
@@ -0,0 +1,573 @@
+// Package migrate applies versioned schema migrations to the database
+// of a toumin Engine.
+//
+// Migrations are written in Go or loaded from .sql files:
+//
+//	m := migrate.New(engine)
+//	m.Add(&migrate.Migration{Version: 1, Name: "create patient",
+//		Up:   func(db migrate.Execer) error { _, err := db.Exec(`CREATE TABLE ...`); return err },
+//		Down: func(db migrate.Execer) error { _, err := db.Exec(`DROP TABLE patient_data`); return err }})
+//	m.LoadDir(os.DirFS("migrations"), ".")
+//	applied, err := m.Up()
+//
+// The applied migrations are kept in the table toumin_migrations.
+// Each migration runs in a transaction, except on MySQL, where DDL
+// statements commit implicitly. A database lock keeps concurrent
+// instances of an application from applying the same migrations; on
+// SQLite, the lock is a row with version -1 in toumin_migrations.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/henkburgstra/toumin"
+)
+
+// Table is the name of the table with the applied migrations.
+const Table = "toumin_migrations"
+
+// Execer executes SQL statements; it is implemented by the connection
+// or transaction that a migration runs in.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Migration is a versioned change of the schema. Up applies the change
+// and Down undoes it; either is a Go function or SQL statements,
+// separated by semicolons (or lines with GO).
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(db Execer) error
+	Down    func(db Execer) error
+	UpSql   string
+	DownSql string
+	// NoTransaction runs the migration outside a transaction, for
+	// statements that cannot run in one.
+	NoTransaction bool
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%d %s", m.Version, m.Name)
+}
+
+func (m *Migration) run(db Execer, up bool, dialect string) error {
+	f, s, step := m.Down, m.DownSql, "down"
+	if up {
+		f, s, step = m.Up, m.UpSql, "up"
+	}
+	if f != nil {
+		return f(db)
+	}
+	if s == "" {
+		return fmt.Errorf("migrate: migration %s has no %s step", m, step)
+	}
+	split := SplitSql
+	if dialect == "mysql" {
+		split = SplitMysql
+	}
+	for _, statement := range split(s) {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("migrate: migration %s: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// Status is the status of a migration.
+type Status struct {
+	Migration *Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to the database of an engine.
+type Migrator struct {
+	engine     *toumin.Engine
+	migrations []*Migration
+	// LockTimeout is how long to wait for another migrator to release
+	// the lock; default one minute.
+	LockTimeout time.Duration
+}
+
+// New returns a Migrator for the database of engine.
+func New(engine *toumin.Engine) *Migrator {
+	return &Migrator{engine: engine, LockTimeout: time.Minute}
+}
+
+// Add registers migrations. Versions must be unique.
+func (m *Migrator) Add(migrations ...*Migration) error {
+	for _, migration := range migrations {
+		for _, other := range m.migrations {
+			if other.Version == migration.Version {
+				return fmt.Errorf("migrate: duplicate version %d: %s and %s", migration.Version, other, migration)
+			}
+		}
+		m.migrations = append(m.migrations, migration)
+	}
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+	return nil
+}
+
+// Migrations returns the registered migrations in order of version.
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+var sqlFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// LoadDir registers the migrations in the .sql files of directory dir
+// of fsys. Files are named version_name.up.sql and version_name.down.sql:
+// 0001_create_patient.up.sql. The down file is optional.
+func (m *Migrator) LoadDir(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	migrations := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := sqlFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("migrate: %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		migration, ok := migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: strings.ReplaceAll(match[2], "_", " ")}
+			migrations[version] = migration
+		}
+		if match[3] == "up" {
+			migration.UpSql = string(data)
+		} else {
+			migration.DownSql = string(data)
+		}
+	}
+	for _, migration := range migrations {
+		if err := m.Add(migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FromDiff returns a migration that changes the database of registry a
+// to the schema of registry b, using Diff.MigrationSql.
+func FromDiff(version int64, name string, a, b *toumin.Registry) *Migration {
+	up, down := toumin.SchemaDiff(a, b).MigrationSql(a, b)
+	return &Migration{Version: version, Name: name, UpSql: joinSql(up), DownSql: joinSql(down)}
+}
+
+func joinSql(statements []string) string {
+	if len(statements) == 0 {
+		return ""
+	}
+	return strings.Join(statements, ";\n") + ";\n"
+}
+
+// SplitSql splits SQL text into statements at semicolons and at lines
+// with only GO, outside string literals, quoted identifiers and comments.
+// Empty statements and statements with only comments are left out.
+// Quotes are escaped by doubling them, as in standard SQL; see SplitMysql
+// for backslash escapes.
+func SplitSql(text string) []string {
+	return splitSql(text, false)
+}
+
+// SplitMysql splits SQL text like SplitSql, with MySQL's backslash
+// escapes in strings: 'a\';b' is one string.
+func SplitMysql(text string) []string {
+	return splitSql(text, true)
+}
+
+func splitSql(text string, backslash bool) []string {
+	statements := make([]string, 0)
+	var current strings.Builder
+	hasCode := false
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" && hasCode {
+			statements = append(statements, s)
+		}
+		current.Reset()
+		hasCode = false
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	var quote byte // the quote of the string or identifier the text is in
+	inComment := false
+	for _, line := range lines {
+		if quote == 0 && !inComment && strings.EqualFold(strings.TrimSpace(line), "GO") {
+			flush()
+			continue
+		}
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inComment:
+				current.WriteByte(c)
+				if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+					current.WriteByte('/')
+					i++
+					inComment = false
+				}
+			case quote != 0:
+				current.WriteByte(c)
+				if c == '\\' && backslash && quote != '`' && i+1 < len(line) {
+					current.WriteByte(line[i+1])
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '-' && i+1 < len(line) && line[i+1] == '-':
+				current.WriteString(line[i:])
+				i = len(line)
+			case c == '/' && i+1 < len(line) && line[i+1] == '*':
+				current.WriteString("/*")
+				i++
+				inComment = true
+			case c == ';':
+				flush()
+			default:
+				if c == '\'' || c == '"' || c == '`' {
+					quote = c
+				}
+				if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+					hasCode = true
+				}
+				current.WriteByte(c)
+			}
+		}
+	}
+	flush()
+	return statements
+}
+
+// session is a connection of the migrator, on which the lock is held.
+type session struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (s session) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.conn.ExecContext(s.ctx, query, args...)
+}
+
+func (s session) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn.QueryContext(s.ctx, query, args...)
+}
+
+func (s session) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.conn.QueryRowContext(s.ctx, query, args...)
+}
+
+func (m *Migrator) dialect() string {
+	return m.engine.Driver().Name()
+}
+
+// placeholder returns the placeholder of parameter i, counting from 1.
+func (m *Migrator) placeholder(i int) string {
+	if m.dialect() == "postgres" {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// open returns a session with the migrations table created and the lock
+// taken. The returned function releases the lock and the connection.
+func (m *Migrator) open() (session, func(), error) {
+	db := m.engine.Db()
+	if db == nil {
+		var err error
+		if db, err = m.engine.Connect(); err != nil {
+			return session{}, nil, err
+		}
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return session{}, nil, err
+	}
+	s := session{ctx: ctx, conn: conn}
+	if err := m.lock(s); err != nil {
+		conn.Close()
+		return session{}, nil, err
+	}
+	release := func() {
+		m.unlock(s)
+		conn.Close()
+	}
+	if err := m.createTable(s); err != nil {
+		release()
+		return session{}, nil, err
+	}
+	return s, release, nil
+}
+
+// lockId is the key of the PostgreSQL advisory lock: "toumin".
+const lockId = 0x746f756d696e
+
+// lockVersion is the version of the row in the migrations table that is
+// the lock on SQLite.
+const lockVersion = -1
+
+func (m *Migrator) lock(s session) error {
+	seconds := int(m.LockTimeout / time.Second)
+	switch m.dialect() {
+	case "mysql":
+		var ok sql.NullInt64
+		if err := s.QueryRow("SELECT GET_LOCK(?, ?)", Table, seconds).Scan(&ok); err != nil {
+			return err
+		}
+		if ok.Int64 != 1 {
+			return fmt.Errorf("migrate: timeout waiting for lock %s", Table)
+		}
+	case "mssql":
+		var result int
+		if err := s.QueryRow(`DECLARE @result int;
+			EXEC @result = sp_getapplock @Resource = ?, @LockMode = 'Exclusive',
+				@LockOwner = 'Session', @LockTimeout = ?;
+			SELECT @result`, Table, m.LockTimeout.Milliseconds()).Scan(&result); err != nil {
+			return err
+		}
+		if result < 0 {
+			return fmt.Errorf("migrate: cannot get lock %s (%d)", Table, result)
+		}
+	case "postgres":
+		_, err := s.Exec("SELECT pg_advisory_lock($1)", lockId)
+		return err
+	case "sqlite":
+		return m.lockRow(s)
+	}
+	return nil
+}
+
+// lockRow takes the lock by inserting the lock row into the migrations
+// table, waiting for another migrator to delete it. If a migrator stops
+// without deleting the row, it must be deleted by hand.
+func (m *Migrator) lockRow(s session) error {
+	if err := m.createTable(s); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(m.LockTimeout)
+	for {
+		_, err := s.Exec(fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (?, ?, ?)", Table),
+			lockVersion, "lock", time.Now().UTC().Format(time.RFC3339))
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("migrate: timeout waiting for lock %s: %w", Table, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (m *Migrator) unlock(s session) {
+	switch m.dialect() {
+	case "mysql":
+		s.Exec("SELECT RELEASE_LOCK(?)", Table)
+	case "mssql":
+		s.Exec("EXEC sp_releaseapplock @Resource = ?, @LockOwner = 'Session'", Table)
+	case "postgres":
+		s.Exec("SELECT pg_advisory_unlock($1)", lockId)
+	case "sqlite":
+		s.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = ?", Table), lockVersion)
+	}
+}
+
+func (m *Migrator) createTable(s session) error {
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version bigint NOT NULL,
+	name varchar(255) NOT NULL,
+	applied_at varchar(40) NOT NULL,
+	PRIMARY KEY (version)
+)`, Table)
+	if m.dialect() == "mssql" {
+		create = fmt.Sprintf("IF OBJECT_ID('%s', 'U') IS NULL %s", Table,
+			strings.Replace(create, " IF NOT EXISTS", "", 1))
+	}
+	_, err := s.Exec(create)
+	return err
+}
+
+// applied returns the applied versions with the time they were applied.
+func (m *Migrator) applied(db Execer) (map[int64]time.Time, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT version, applied_at FROM %s WHERE version <> %d", Table, lockVersion))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version], _ = time.Parse(time.RFC3339, at)
+	}
+	return versions, rows.Err()
+}
+
+// transactional reports whether migration runs in a transaction.
+func (m *Migrator) transactional(migration *Migration) bool {
+	return !migration.NoTransaction && m.dialect() != "mysql"
+}
+
+// apply runs migration up or down and records it in the migrations table.
+func (m *Migrator) apply(s session, migration *Migration, up bool) error {
+	record := func(db Execer) error {
+		var err error
+		if up {
+			_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (%s, %s, %s)",
+				Table, m.placeholder(1), m.placeholder(2), m.placeholder(3)),
+				migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339))
+		} else {
+			_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE version = %s", Table, m.placeholder(1)),
+				migration.Version)
+		}
+		return err
+	}
+
+	if !m.transactional(migration) {
+		if err := migration.run(s, up, m.dialect()); err != nil {
+			return err
+		}
+		return record(s)
+	}
+
+	tx, err := s.conn.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := migration.run(tx, up, m.dialect()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies all migrations that have not been applied, in order of
+// version, and returns the migrations it applied. It stops at the
+// first migration that fails.
+func (m *Migrator) Up() ([]*Migration, error) {
+	s, release, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	versions, err := m.applied(s)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]*Migration, 0)
+	for _, migration := range m.migrations {
+		if _, ok := versions[migration.Version]; ok {
+			continue
+		}
+		if err := m.apply(s, migration, true); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down undoes the last n applied migrations, latest first, and returns
+// the migrations it undid.
+func (m *Migrator) Down(n int) ([]*Migration, error) {
+	s, release, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return m.down(s, n)
+}
+
+func (m *Migrator) down(s session, n int) ([]*Migration, error) {
+	versions, err := m.applied(s)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]*Migration, 0)
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < n; i-- {
+		migration := m.migrations[i]
+		if _, ok := versions[migration.Version]; !ok {
+			continue
+		}
+		if err := m.apply(s, migration, false); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Redo undoes the last applied migration and applies it again.
+func (m *Migrator) Redo() (*Migration, error) {
+	s, release, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	done, err := m.down(s, 1)
+	if err != nil || len(done) == 0 {
+		return nil, err
+	}
+	return done[0], m.apply(s, done[0], true)
+}
+
+// Status returns the status of the registered migrations, in order of
+// version. Applied versions without a registered migration are included
+// with a Migration that has only a Version and a Name.
+func (m *Migrator) Status() ([]Status, error) {
+	s, release, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	versions, err := m.applied(s)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	known := make(map[int64]bool)
+	for _, migration := range m.migrations {
+		at, ok := versions[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: at})
+		known[migration.Version] = true
+	}
+	for version, at := range versions {
+		if !known[version] {
+			statuses = append(statuses, Status{
+				Migration: &Migration{Version: version, Name: "(unknown)"}, Applied: true, AppliedAt: at})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Migration.Version < statuses[j].Migration.Version
+	})
+	return statuses, nil
+}
@@ -0,0 +1,217 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/henkburgstra/toumin"
+	_ "modernc.org/sqlite"
+)
+
+func TestSplitSql(t *testing.T) {
+	statements := SplitSql(`-- patienten
+CREATE TABLE patient_data (patient_key varchar(25), patient_naam varchar(50) DEFAULT 'a;b');
+/* geen; statement */
+INSERT INTO patient_data VALUES ('x', 'y');
+GO
+DROP TABLE x`)
+	expected := []string{
+		"-- patienten\nCREATE TABLE patient_data (patient_key varchar(25), patient_naam varchar(50) DEFAULT 'a;b')",
+		"/* geen; statement */\nINSERT INTO patient_data VALUES ('x', 'y')",
+		"DROP TABLE x",
+	}
+	if fmt.Sprintf("%q", statements) != fmt.Sprintf("%q", expected) {
+		t.Errorf("TestSplitSql(): %q", statements)
+	}
+
+	statements = SplitSql(`CREATE TABLE "a;b" (x varchar(5) DEFAULT 'C:\'); SELECT 1`)
+	if fmt.Sprintf("%q", statements) != `["CREATE TABLE \"a;b\" (x varchar(5) DEFAULT 'C:\\')" "SELECT 1"]` {
+		t.Errorf("TestSplitSql(): %q", statements)
+	}
+	statements = SplitMysql("INSERT INTO t VALUES ('it\\'s; ok', \"a\\\";b\", `c;d`); SELECT 1")
+	if len(statements) != 2 || statements[1] != "SELECT 1" {
+		t.Errorf("TestSplitSql(): MySQL %q", statements)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_add_naam.up.sql":       {Data: []byte("ALTER TABLE patient_data ADD patient_naam varchar(50)")},
+		"migrations/0002_add_naam.down.sql":     {Data: []byte("ALTER TABLE patient_data DROP COLUMN patient_naam")},
+		"migrations/0001_create_patient.up.sql": {Data: []byte("CREATE TABLE patient_data (patient_key varchar(25))")},
+		"migrations/readme.txt":                 {Data: []byte("")},
+	}
+	m := New(toumin.NewEngine(toumin.SqliteDriver))
+	if err := m.LoadDir(fsys, "migrations"); err != nil {
+		t.Fatalf("TestLoadDir(): %s", err.Error())
+	}
+	migrations := m.Migrations()
+	if len(migrations) != 2 || migrations[0].String() != "1 create patient" || migrations[1].DownSql == "" {
+		t.Errorf("TestLoadDir(): %v", migrations)
+	}
+	if err := m.Add(&Migration{Version: 2, Name: "dubbel"}); err == nil {
+		t.Errorf("TestLoadDir(): duplicate version accepted")
+	}
+}
+
+func TestFromDiff(t *testing.T) {
+	a := toumin.NewRegistry(toumin.NewEngine(toumin.MysqlDriver))
+	b := toumin.NewRegistry(toumin.NewEngine(toumin.MysqlDriver))
+	for _, r := range []*toumin.Registry{a, b} {
+		patient := toumin.NewEntity("patient")
+		patient.Fields["key"] = &toumin.EntityField{Name: "key", Type: "varchar(25)", Key: true}
+		r.RegisterEntity("patient", patient)
+	}
+	b.Entity("patient").Fields["naam"] = &toumin.EntityField{Name: "naam", Type: "varchar(50)", Null: true}
+	b.Entity("patient").Indexes["naam"] = &toumin.TableIndex{Columns: []string{"naam"}}
+
+	m := FromDiff(3, "naam", a, b)
+	expected := "ALTER TABLE `patient` ADD `naam` varchar(50);\nCREATE INDEX `naam` ON `patient` (`naam`);\n"
+	if m.UpSql != expected {
+		t.Errorf("TestFromDiff(): up %q", m.UpSql)
+	}
+	expected = "DROP INDEX `naam` ON `patient`;\nALTER TABLE `patient` DROP COLUMN `naam`;\n"
+	if m.DownSql != expected {
+		t.Errorf("TestFromDiff(): down %q", m.DownSql)
+	}
+	if !strings.HasPrefix(m.String(), "3 ") {
+		t.Errorf("TestFromDiff(): %s", m)
+	}
+}
+
+// makeMigrator returns a Migrator for an in-memory SQLite database with
+// the migrations, and the engine of the database.
+func makeMigrator(t *testing.T, migrations ...*Migration) (*Migrator, *toumin.Engine) {
+	engine := toumin.NewEngine(toumin.SqliteDriver)
+	engine.SetDatabase(":memory:")
+	db, err := engine.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection has its own in-memory database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	m := New(engine)
+	if err := m.Add(migrations...); err != nil {
+		t.Fatal(err)
+	}
+	return m, engine
+}
+
+// versions returns the versions in the migrations table.
+func versions(t *testing.T, engine *toumin.Engine) string {
+	rows, err := engine.Db().Query("SELECT version FROM " + Table + " ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	versions := make([]int64, 0)
+	for rows.Next() {
+		var version int64
+		rows.Scan(&version)
+		versions = append(versions, version)
+	}
+	return fmt.Sprint(versions)
+}
+
+func TestMigrator(t *testing.T) {
+	index := &Migration{Version: 3, Name: "index naam", UpSql: "CREATE INDEX patient_naam ON patient_data (patient_naam)"}
+	m, engine := makeMigrator(t,
+		&Migration{Version: 1, Name: "create patient",
+			UpSql:   "CREATE TABLE patient_data (patient_key varchar(25) PRIMARY KEY);",
+			DownSql: "DROP TABLE patient_data"},
+		&Migration{Version: 2, Name: "add naam",
+			Up: func(db Execer) error {
+				_, err := db.Exec("ALTER TABLE patient_data ADD patient_naam varchar(50)")
+				return err
+			},
+			Down: func(db Execer) error {
+				_, err := db.Exec("ALTER TABLE patient_data DROP COLUMN patient_naam")
+				return err
+			}},
+		index)
+
+	applied, err := m.Up()
+	if err != nil || len(applied) != 3 {
+		t.Fatalf("TestMigrator(): Up %v %v", applied, err)
+	}
+	if v := versions(t, engine); v != "[1 2 3]" {
+		t.Errorf("TestMigrator(): versions %s", v)
+	}
+	if applied, err := m.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("TestMigrator(): second Up %v %v", applied, err)
+	}
+
+	// A migration without a down step is not undone.
+	if undone, err := m.Down(1); err == nil || !strings.Contains(err.Error(), "no down step") || len(undone) != 0 {
+		t.Errorf("TestMigrator(): Down without down step %v %v", undone, err)
+	}
+	if v := versions(t, engine); v != "[1 2 3]" {
+		t.Errorf("TestMigrator(): versions after failed Down %s", v)
+	}
+	if _, err := m.Redo(); err == nil {
+		t.Errorf("TestMigrator(): Redo without down step")
+	}
+
+	index.DownSql = "DROP INDEX patient_naam"
+	undone, err := m.Down(2)
+	if err != nil || len(undone) != 2 || undone[0].Version != 3 || undone[1].Version != 2 {
+		t.Fatalf("TestMigrator(): Down %v %v", undone, err)
+	}
+	if _, err := engine.Db().Exec("INSERT INTO patient_data (patient_key) VALUES ('P1')"); err != nil {
+		t.Errorf("TestMigrator(): %s", err.Error())
+	}
+	if redone, err := m.Redo(); err != nil || redone.Version != 1 {
+		t.Errorf("TestMigrator(): Redo %v %v", redone, err)
+	}
+	var n int
+	if err := engine.Db().QueryRow("SELECT COUNT(*) FROM patient_data").Scan(&n); err != nil || n != 0 {
+		t.Errorf("TestMigrator(): table not recreated by Redo: %d %v", n, err)
+	}
+
+	engine.Db().Exec("INSERT INTO "+Table+" (version, name, applied_at) VALUES (9, 'elders', ?)",
+		time.Now().UTC().Format(time.RFC3339))
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("TestMigrator(): Status %s", err.Error())
+	}
+	status := make([]string, 0)
+	for _, s := range statuses {
+		status = append(status, fmt.Sprintf("%s:%t", s.Migration, s.Applied))
+		if s.Applied && s.AppliedAt.IsZero() {
+			t.Errorf("TestMigrator(): no time for %s", s.Migration)
+		}
+	}
+	expected := "[1 create patient:true 2 add naam:false 3 index naam:false 9 (unknown):true]"
+	if fmt.Sprint(status) != expected {
+		t.Errorf("TestMigrator(): Status %v", status)
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	m, engine := makeMigrator(t, &Migration{Version: 1, Name: "create patient",
+		UpSql: "CREATE TABLE patient_data (patient_key varchar(25))"})
+	if _, err := m.Status(); err != nil {
+		t.Fatalf("TestMigratorLock(): %s", err.Error())
+	}
+	if v := versions(t, engine); v != "[]" {
+		t.Errorf("TestMigratorLock(): lock not released: %s", v)
+	}
+
+	// Another migrator holds the lock.
+	engine.Db().Exec("INSERT INTO " + Table + " (version, name, applied_at) VALUES (-1, 'lock', '')")
+	m.LockTimeout = 100 * time.Millisecond
+	if _, err := m.Up(); err == nil || !strings.Contains(err.Error(), "timeout waiting for lock") {
+		t.Errorf("TestMigratorLock(): expected a lock timeout, got %v", err)
+	}
+	engine.Db().Exec("DELETE FROM " + Table + " WHERE version = -1")
+	if applied, err := m.Up(); err != nil || len(applied) != 1 {
+		t.Errorf("TestMigratorLock(): Up %v %v", applied, err)
+	}
+	if v := versions(t, engine); v != "[1]" {
+		t.Errorf("TestMigratorLock(): versions %s", v)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"unicode"
 	"unsafe"
+
+	"github.com/henkburgstra/toumin/filter"
 )
 
 // ModelConstructor defines the signature of Model constructors.
@@ -28,6 +30,26 @@ func Underscore2Camel(underscores string) string {
 	return strings.Join(els, "")
 }
 
+// Camel2Underscore translates strings with camel case
+// to strings with underscores: TheWord -> the_word.
+// It is the inverse of Underscore2Camel.
+func Camel2Underscore(camel string) string {
+	r := []rune(camel)
+	out := make([]rune, 0, len(r)+4)
+
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			if i > 0 && (unicode.IsLower(r[i-1]) ||
+				(i+1 < len(r) && unicode.IsLower(r[i+1]) && unicode.IsUpper(r[i-1]))) {
+				out = append(out, '_')
+			}
+			c = unicode.ToLower(c)
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
 // IModel defines the interface that Models need to implement.
 type IModel interface {
 	Name() string
@@ -46,6 +68,14 @@ type IModel interface {
 	Scan(*sql.Rows)
 }
 
+// RelationHolder is implemented by models that can hold the relations
+// loaded by Query.Preload. Model implements it; models that do not are
+// returned without their relations.
+type RelationHolder interface {
+	Relation(string) (interface{}, bool)
+	SetRelation(string, interface{})
+}
+
 // Model defines the default Model. Implements IModel.
 type Model struct {
 	name         string
@@ -53,6 +83,7 @@ type Model struct {
 	fields       FieldData
 	fieldMapping map[string]string
 	owner        IModel
+	relations    map[string]interface{}
 }
 
 // NewModel constructs a new Model instance.
@@ -61,6 +92,7 @@ func NewModel(name string) IModel {
 	m.name = name
 	m.fields = make(FieldData)
 	m.fieldMapping = make(map[string]string)
+	m.relations = make(map[string]interface{})
 	m.owner = m
 	return m
 }
@@ -122,6 +154,40 @@ func (m *Model) SetOwner(owner IModel) {
 	m.owner = owner
 }
 
+// Lookup returns the value of field f of the model, so that models
+// can be tested against a filter: f.Test(model, nil).
+// Both model field names and column names are accepted.
+// It implements filter.Record.
+func (m *Model) Lookup(e, f string) (interface{}, bool) {
+	if e != "" && e != m.Name() {
+		return nil, false
+	}
+	field, ok := m.fields[f]
+	if !ok && m.registry != nil {
+		fieldPrefix := strings.Replace(m.registry.FieldPrefix(), "{model}", m.Name(), 1)
+		field, ok = m.fields[strings.TrimPrefix(f, fieldPrefix)]
+	}
+	if !ok {
+		return nil, false
+	}
+	return field.Get(), true
+}
+
+// Relation returns the preloaded relation name: an IModel for
+// a reference, a []IModel for a back reference.
+func (m *Model) Relation(name string) (interface{}, bool) {
+	r, ok := m.relations[name]
+	return r, ok
+}
+
+// SetRelation stores a preloaded relation. See Query.Preload.
+func (m *Model) SetRelation(name string, r interface{}) {
+	if m.relations == nil {
+		m.relations = make(map[string]interface{})
+	}
+	m.relations[name] = r
+}
+
 func (m *Model) Key() *FieldValue {
 	r := m.Registry()
 	if r == nil {
@@ -187,7 +253,8 @@ func (m *Model) BackRef(br string, fks ...string) *Query {
 	if key == nil {
 		return &Query{}
 	}
-	q := r.Query(br).Filter(e.Col(fk).Eq(key.Get()))
+	q := r.Query(br).Filter(filter.Selectable{Entity: br, Field: fk}.Eq(key.Get()))
+	q.backRef = &backRef{model: m.Name(), fk: fk}
 
 	return q
 }
@@ -225,6 +292,9 @@ func (m *Model) Scan(rows *sql.Rows) {
 		if belongs {
 			value := new(FieldValue)
 			modelAttr := Underscore2Camel(strings.TrimPrefix(columns[i], fieldPrefix))
+			if name, ok := entity.structField(columns[i]); ok {
+				modelAttr = name
+			}
 			// Check if the model has an attribute that matches the name
 			// of the column. Underscores are  translated to CamelCase:
 			// the_name -> TheName
@@ -1,12 +1,18 @@
 package toumin
 
 import (
+	"database/sql"
 	"fmt"
 	"strings"
+
+	"github.com/henkburgstra/toumin/filter"
 )
 
 type Cond map[string]map[string]interface{}
 
+// Connective combines conditions on the older Selectable type.
+//
+// Deprecated: use filter.Connective, which Query.Filter accepts as well.
 type Connective struct {
 	Operator string
 	Operands []interface{}
@@ -26,6 +32,10 @@ type SqlParam struct {
 	Values   []interface{}
 }
 
+// Selectable is a condition on a field of an Entity.
+//
+// Deprecated: use filter.Selectable, which supports more operators
+// and is translated with the registry's FilterTranslater.
 type Selectable struct {
 	Entity *Entity
 	Field  string
@@ -73,11 +83,26 @@ func (e *Selectable) Nin(values []interface{}) *Selectable {
 }
 
 type Query struct {
-	model    string
-	registry *Registry
-	sql      string
-	filter   []interface{}
-	params   []interface{}
+	model       string
+	registry    *Registry
+	sql         string
+	filter      []interface{}
+	params      []interface{}
+	reuse       bool
+	constructor ModelConstructor
+	columns     []string
+	backRef     *backRef
+	fromSql     bool
+	preload     []string
+	force       bool
+}
+
+// backRef records the foreign key of a query created by BackRef,
+// which correlates the query with the referenced model when it is
+// used as a subquery.
+type backRef struct {
+	model string
+	fk    string
 }
 
 func NewQuery(model string, registry *Registry) *Query {
@@ -88,64 +113,126 @@ func NewQuery(model string, registry *Registry) *Query {
 	return q
 }
 
+// Filter sets the conditions of the query, replacing any earlier ones.
+// Conditions are *filter.Filter, filter.Selectable and filter.Connective
+// values, or the older *Selectable and Connective values of this package.
+// All conditions must hold for a model to be selected.
+//
+//	registry.Query("patient").Filter(filter.NewFilter(
+//		filter.Selectable{Entity: "patient", Field: "achternaam"}.Pfx("Leeuw")))
 func (q *Query) Filter(f ...interface{}) *Query {
 	q.filter = f
 	return q
 }
 
-func (q *Query) processConnective(con Connective) string {
+// Where adds conditions to those of the query, for instance to narrow
+// down the query of Model.BackRef:
+//
+//	patient.BackRef("behandeling").Where(
+//		filter.Selectable{Entity: "behandeling", Field: "datum"}.Year().Eq(2015))
+func (q *Query) Where(f ...interface{}) *Query {
+	q.filter = append(q.filter, f...)
+	return q
+}
+
+func (q *Query) processConnective(con Connective, params *[]interface{}) string {
 	args := make([]string, 0)
+	values := len(*params)
 
 	for _, op := range con.Operands {
 		switch c := op.(type) {
 		case Connective:
-			r := q.processConnective(c)
+			r := q.processConnective(c, params)
 			if r != "" {
 				args = append(args, r)
+			} else if con.Operator == "OR" {
+				*params = (*params)[:values]
+				return ""
 			}
 		case *Selectable:
-			r := q.processSelectable(c)
+			r := q.processSelectable(c, params)
 			if r != "" {
 				args = append(args, r)
 			}
 		}
 	}
+	if len(args) == 0 {
+		// Like filter.Translater.ProcessConnective.
+		if con.Operator == "OR" {
+			return "1 = 0"
+		}
+		return ""
+	}
 	return fmt.Sprintf("(%s)", strings.Join(args, fmt.Sprintf(" %s ", con.Operator)))
 }
 
-func (q *Query) processSelectable(s *Selectable) string {
+func (q *Query) processSelectable(s *Selectable, params *[]interface{}) string {
 	if s.Param.Operator == "IN" || s.Param.Operator == "NOT IN" {
 		l := make([]string, 0)
 		for _, v := range s.Param.Values {
 			l = append(l, "?")
-			q.params = append(q.params, v)
+			*params = append(*params, v)
 		}
 		return fmt.Sprintf("%s.%s %s (%s)", s.Entity.Name, s.Field, s.Param.Operator, strings.Join(l, ", "))
 	} else {
-		q.params = append(q.params, s.Param.Value)
+		*params = append(*params, s.Param.Value)
 		return fmt.Sprintf("%s.%s %s ?", s.Entity.Name, s.Field, s.Param.Operator)
 	}
 }
 
-func (q *Query) applyFilter() string {
+// processFilter translates f with the registry's FilterTranslater.
+func (q *Query) processFilter(f *filter.Filter, params *[]interface{}) string {
+	r := q.registry.translater(q.model).Translate(f)
+	*params = append(*params, f.Values...)
+	return r
+}
+
+// where returns the WHERE condition of the query and its parameters.
+func (q *Query) where() (string, []interface{}) {
 	c := make([]string, 0)
+	params := make([]interface{}, 0)
 
 	for _, f := range q.filter {
+		r := ""
 		switch e := f.(type) {
 		case Connective:
-			r := q.processConnective(e)
-			if r != "" {
-				c = append(c, r)
-			}
+			r = q.processConnective(e, &params)
 		case *Selectable:
-			r := q.processSelectable(e)
-			if r != "" {
-				c = append(c, r)
-			}
+			r = q.processSelectable(e, &params)
+		case *filter.Filter:
+			r = q.processFilter(e, &params)
+		case filter.Connective:
+			r = q.processFilter(filter.NewFilter(e), &params)
+		case filter.Selectable:
+			r = q.processFilter(filter.NewFilter(e), &params)
+		}
+		if r != "" {
+			c = append(c, r)
 		}
 	}
 
-	return strings.Join(c, " AND ")
+	return strings.Join(c, " AND "), params
+}
+
+// modelConstructor returns the constructor used for the models
+// of the query: the one set by SetConstructor, or else the one registered
+// for the model.
+func (q *Query) modelConstructor() ModelConstructor {
+	if q.constructor != nil {
+		return q.constructor
+	}
+	return q.registry.Model(q.model)
+}
+
+// SetConstructor overrides the registered ModelConstructor for this query.
+func (q *Query) SetConstructor(c ModelConstructor) *Query {
+	q.constructor = c
+	return q
+}
+
+// Model returns the name of the model the query selects.
+func (q *Query) Model() string {
+	return q.model
 }
 
 func (q *Query) Join() *Query {
@@ -153,50 +240,159 @@ func (q *Query) Join() *Query {
 }
 
 func (q *Query) Get(keyValue interface{}) IModel {
+	model, err := q.get(keyValue)
+	if err != nil && err != sql.ErrNoRows {
+		return nil
+	}
+	return model
+}
+
+// get returns the model with key keyValue. If there is none, it returns
+// a model without fields and sql.ErrNoRows.
+func (q *Query) get(keyValue interface{}) (IModel, error) {
 	entity := q.registry.Entity(q.model)
 	if entity == nil {
-		fmt.Println("entity == nil")
-		return nil
+		return nil, UnknownModelError{q.model}
 	}
 	key := entity.Key()
 	if key == nil {
-		fmt.Println("key == nil")
-		return nil
+		return nil, fmt.Errorf("Model '%s' has no key", q.model)
 	}
-	model := q.registry.Model(q.model)(q.model)
+	model := q.modelConstructor()(q.model)
 	model.SetOwner(model)
 	model.SetRegistry(q.registry)
 
-	sql := fmt.Sprintf(`SELECT * 
+	query := fmt.Sprintf(`SELECT * 
 		FROM %s
 		WHERE %s = ?`, entity.Name, key.Name)
 
 	db, err := q.registry.Db()
 	if err != nil {
-		// TODO: log err
-		return nil
+		return nil, err
 	}
-	rows, err := db.Query(sql, keyValue)
+	rows, err := db.Query(query, keyValue)
 	if err != nil {
-		// TODO: log err
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		model.Scan(rows)
-		break
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return model, sql.ErrNoRows
 	}
-
-	return model
+	model.Scan(rows)
+	return model, nil
 }
 
+// Columns sets the fields the query selects when it is used
+// as the operand of filter.Selectable.InQuery.
 func (q *Query) Columns(cols ...string) *Query {
+	q.columns = cols
 	return q
 }
 
+// BackRef returns a query on model br for use in filter.Exists and
+// filter.NotExists, correlated with q through foreign key fk of br.
+// Unless fks is provided, the foreign key is br_<model of q>.
+//
+//	q := registry.Query("patient")
+//	q.Filter(filter.Exists(q.BackRef("behandeling")))
+func (q *Query) BackRef(br string, fks ...string) *Query {
+	fk := fmt.Sprintf("%s_%s", br, q.model)
+	if len(fks) > 0 {
+		fk = fks[0]
+	}
+	sub := q.registry.Query(br)
+	sub.backRef = &backRef{model: q.model, fk: fk}
+	return sub
+}
+
+// SubquerySql returns the SQL of q as a subquery and its parameters.
+// It implements filter.Subquery.
+//
+// Used in Exists and NotExists, q is correlated with model outer through
+// the foreign key of a BackRef, or else through a relationship between
+// the entities of q and outer. Used in InQuery, q selects the first of its
+// Columns, or else the foreign key that refers to outer, or else its key.
+func (q *Query) SubquerySql(outer string, exists bool) (string, []interface{}) {
+	if q.fromSql {
+		return q.sql, q.params
+	}
+	e := q.registry.Entity(q.model)
+	if e == nil {
+		return "", nil
+	}
+	c := make([]string, 0)
+	where, params := q.where()
+	if where != "" {
+		c = append(c, where)
+	}
+
+	column := "1"
+	if exists {
+		if correlation := q.correlation(outer); correlation != "" {
+			c = append(c, correlation)
+		}
+	} else {
+		column = q.subqueryColumn(outer)
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s", column, e.Name)
+	if len(c) > 0 {
+		sql += fmt.Sprintf(" WHERE %s", strings.Join(c, " AND "))
+	}
+	return sql, params
+}
+
+// correlation returns the condition that joins the entity of q
+// with the entity of model outer.
+func (q *Query) correlation(outer string) string {
+	inner := q.registry.Entity(q.model)
+	o := q.registry.Entity(outer)
+	if inner == nil || o == nil {
+		return ""
+	}
+	if q.backRef != nil && q.backRef.model == outer {
+		fk := inner.TranslateModelField(q.model, q.backRef.fk)
+		if r, ok := inner.Relationship(fk); ok {
+			return fmt.Sprintf("%s.%s = %s.%s", inner.Name, fk, o.Name, r.ReferencedColumn)
+		}
+		if key := o.Key(); key != nil {
+			return fmt.Sprintf("%s.%s = %s.%s", inner.Name, fk, o.Name, key.Name)
+		}
+	}
+	if r, ok := inner.RelationshipTo(o.Name); ok {
+		return fmt.Sprintf("%s.%s = %s.%s", inner.Name, r.ForeignKey, o.Name, r.ReferencedColumn)
+	}
+	if r, ok := o.RelationshipTo(inner.Name); ok {
+		return fmt.Sprintf("%s.%s = %s.%s", o.Name, r.ForeignKey, inner.Name, r.ReferencedColumn)
+	}
+	return ""
+}
+
+// subqueryColumn returns the column q selects when compared
+// with a field of model outer.
+func (q *Query) subqueryColumn(outer string) string {
+	e := q.registry.Entity(q.model)
+	if len(q.columns) > 0 {
+		return fmt.Sprintf("%s.%s", e.Name, e.TranslateModelField(q.model, q.columns[0]))
+	}
+	if o := q.registry.Entity(outer); o != nil {
+		if r, ok := e.RelationshipTo(o.Name); ok {
+			return fmt.Sprintf("%s.%s", e.Name, r.ForeignKey)
+		}
+	}
+	if key := e.Key(); key != nil {
+		return fmt.Sprintf("%s.%s", e.Name, key.Name)
+	}
+	return "1"
+}
+
 func (q *Query) FromSql(sql string, params ...interface{}) *Query {
 	q.sql = sql
+	q.fromSql = true
 	q.params = append(q.params, params...)
 	return q
 }
@@ -211,9 +407,10 @@ func (q *Query) Sql() string {
 	}
 	sql := fmt.Sprintf(`SELECT * 
 		FROM %s`, e.Name)
-	f := q.applyFilter()
+	f, params := q.where()
 	if f != "" {
 		sql += fmt.Sprintf("\nWHERE %s", f)
+		q.params = append(q.params, params...)
 	}
 
 	q.sql = sql
@@ -223,47 +420,16 @@ func (q *Query) Sql() string {
 
 func (q *Query) All() []IModel {
 	models := make([]IModel, 0)
-	entity := q.registry.Entity(q.model)
-	if entity == nil {
-		fmt.Println("Query.All(), entity == nil")
-		return models
-	}
-	key := entity.Key()
-	if key == nil {
-		fmt.Println("Query.All(), key == nil")
-		return models
-	}
-
-	fieldPrefix := strings.Replace(q.registry.FieldPrefix(), "{model}", q.model, 1)
-	keyName := strings.TrimPrefix(key.Name, fieldPrefix)
-
-	db, err := q.registry.Db()
+	c, err := newCursor(q, false)
 	if err != nil {
 		// TODO: log err
-		fmt.Println("Query.All(), db err")
+		fmt.Println("Query.All(): ", err.Error())
 		return models
 	}
-	rows, err := db.Query(q.Sql(), q.params...)
-	if err != nil {
-		// TODO: log err
-		fmt.Println("Query.All(), query error: ", err.Error())
-		return models
-	}
-	defer rows.Close()
+	defer c.Close()
 
-	var lastKey string
-	modelConstructor := q.registry.Model(q.model)
-
-	for rows.Next() {
-		model := modelConstructor(q.model)
-		model.SetOwner(model)
-		model.SetRegistry(q.registry)
-		model.Scan(rows)
-		keyValue := model.Field(keyName).String()
-		if lastKey != keyValue {
-			models = append(models, model)
-			lastKey = keyValue
-		}
+	for c.Next() {
+		models = append(models, c.Model())
 	}
 
 	return models
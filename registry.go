@@ -3,15 +3,33 @@ package toumin
 import (
 	"database/sql"
 	"strings"
+	"sync"
 )
 
+// Registry holds the entities and model constructors of a database.
+//
+// A Registry is safe for concurrent use by multiple goroutines, e.g. HTTP
+// handlers that share one registry: entities and models can be registered,
+// loaded (lazily or with LoadEntities or LoadSnapshot) and looked up
+// concurrently, and the engine is connected once. Entities are not
+// modified after they are registered or loaded; a reload replaces them,
+// so an *Entity that a goroutine holds stays consistent. Configure the
+// affixes, JSON options and lazy loading before the registry is shared,
+// and do not modify registered entities. Queries and models are not safe
+// for concurrent use; create them per goroutine.
 type Registry struct {
 	engine      *Engine
+	mu          sync.RWMutex // guards entities, models, tables and checksum
+	loadMu      sync.Mutex   // serializes lazy loading
 	entities    map[string]*Entity
 	models      map[string]ModelConstructor
 	tablePrefix string
 	tableSuffix string
 	fieldPrefix string
+	jsonOptions JSONOptions
+	checksum    string // schema checksum of the last snapshot
+	lazy        bool
+	tables      map[string]string // model name -> table name, for lazy loading
 }
 
 func NewRegistry(engine *Engine) *Registry {
@@ -22,30 +40,179 @@ func NewRegistry(engine *Engine) *Registry {
 	return r
 }
 
+// staging returns an empty registry with the engine and affixes of r,
+// in which entities are loaded before they replace those of r.
+func (r *Registry) staging() *Registry {
+	staging := NewRegistry(r.engine)
+	staging.tablePrefix = r.tablePrefix
+	staging.tableSuffix = r.tableSuffix
+	staging.fieldPrefix = r.fieldPrefix
+	return staging
+}
+
+// Entity returns the entity of model name. If the registry is lazy and
+// the entity is not loaded, it is loaded from the database.
 func (r *Registry) Entity(name string) *Entity {
+	entity := r.loadedEntity(name)
+	if entity != nil || !r.lazy {
+		return entity
+	}
+	return r.loadEntity(name)
+}
+
+// loadedEntity returns the entity of model name if it is loaded.
+func (r *Registry) loadedEntity(name string) *Entity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.entities[name]
 }
 
+// entityMap returns a copy of the map of registered entities.
+func (r *Registry) entityMap() map[string]*Entity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entities := make(map[string]*Entity, len(r.entities))
+	for name, entity := range r.entities {
+		entities[name] = entity
+	}
+	return entities
+}
+
+// setEntities replaces the registered entities.
+func (r *Registry) setEntities(entities map[string]*Entity, checksum string) {
+	r.mu.Lock()
+	r.entities = entities
+	r.checksum = checksum
+	r.mu.Unlock()
+}
+
+// Lazy reports whether entities are loaded on demand.
+func (r *Registry) Lazy() bool {
+	return r.lazy
+}
+
+// SetLazy makes Entity load an entity from the database the first time
+// it is requested, as an alternative to LoadEntities: only the structure
+// of its table and the relationships that involve the table are loaded.
+// The table is the one whose name without the table affixes is the model
+// name, as in LoadEntities. Functions that iterate over the entities,
+// such as EntityNames and CreateSchema, see the loaded entities only.
+func (r *Registry) SetLazy(lazy bool) {
+	r.lazy = lazy
+}
+
+// loadEntity loads the entity of model name from the database.
+// Entities that the table's relationships refer to are replaced by
+// copies with the new relationships added.
+func (r *Registry) loadEntity(name string) *Entity {
+	r.loadMu.Lock()
+	defer r.loadMu.Unlock()
+	if entity := r.loadedEntity(name); entity != nil {
+		return entity
+	}
+	engine, err := r.Engine()
+	if err != nil {
+		return nil
+	}
+	if r.tables == nil {
+		tables := make(map[string]string)
+		for _, table := range engine.TableNames() {
+			tables[r.TrimTableAffixes(table)] = table
+		}
+		r.tables = tables
+	}
+	table, ok := r.tables[name]
+	if !ok {
+		return nil
+	}
+
+	entity := engine.TableStructure(table)
+	entity.registry = r
+	var relationships map[string][]EntityRelationship
+	if loader, ok := engine.driver.(TableRelationshipLoader); ok {
+		if relationships, err = loader.TableRelationships(engine, table); err != nil {
+			return nil
+		}
+	} else {
+		staging := r.staging()
+		staging.entities[name] = entity
+		engine.LoadRelationships(staging)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entities[name] = entity
+	for referring, l := range relationships {
+		model := r.TrimTableAffixes(referring)
+		e, ok := r.entities[model]
+		if !ok {
+			continue
+		}
+		if e != entity {
+			e = e.clone()
+			r.entities[model] = e
+		}
+		for _, relationship := range l {
+			e.AddRelationship(relationship)
+		}
+	}
+	return entity
+}
+
 func (r *Registry) RegisterEntity(name string, entity *Entity) {
+	entity.registry = r
+	r.mu.Lock()
 	r.entities[name] = entity
+	r.mu.Unlock()
 }
 
+// LoadEntities loads the entities of all tables from the database.
+// They are loaded apart and replace the registered entities of the same
+// models when they are all loaded, so concurrent lookups never see
+// a partially loaded entity.
 func (r *Registry) LoadEntities() {
 	engine, err := r.Engine()
 	if err != nil {
 		return
 	}
+	r.addEntities(r.introspect(engine), nil)
+}
 
+// introspect returns the entities of all tables of the database, by model.
+func (r *Registry) introspect(engine *Engine) map[string]*Entity {
+	staging := r.staging()
 	for _, name := range engine.TableNames() {
 		entity := engine.TableStructure(name)
-		r.entities[r.TrimTableAffixes(name)] = entity
 		entity.registry = r
+		staging.entities[r.TrimTableAffixes(name)] = entity
+	}
+	engine.LoadRelationships(staging)
+	return staging.entities
+}
+
+// addEntities adds entities to the registered entities at once, replacing
+// those of the same models. If checksum is not nil, it becomes the
+// checksum of the last snapshot.
+func (r *Registry) addEntities(added map[string]*Entity, checksum *string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entities := make(map[string]*Entity, len(r.entities)+len(added))
+	for name, entity := range r.entities {
+		entities[name] = entity
+	}
+	for name, entity := range added {
+		entities[name] = entity
+	}
+	r.entities = entities
+	if checksum != nil {
+		r.checksum = *checksum
 	}
-	engine.LoadRelationships(r)
 }
 
 func (r *Registry) Model(name string) ModelConstructor {
+	r.mu.RLock()
 	model, ok := r.models[name]
+	r.mu.RUnlock()
 	if !ok {
 		model = NewModel
 	}
@@ -53,15 +220,36 @@ func (r *Registry) Model(name string) ModelConstructor {
 }
 
 func (r *Registry) RegisterModel(name string, model ModelConstructor) {
+	r.mu.Lock()
 	r.models[name] = model
+	r.mu.Unlock()
 }
 
-func (r *Registry) Engine() (*Engine, error) {
-	if r.engine.connected {
-		return r.engine, nil
+// registerModelIfAbsent registers model under name if no constructor
+// is registered for name.
+func (r *Registry) registerModelIfAbsent(name string, model ModelConstructor) {
+	r.mu.Lock()
+	if _, ok := r.models[name]; !ok {
+		r.models[name] = model
 	}
-	_, err := r.engine.Connect()
-	if err != nil {
+	r.mu.Unlock()
+}
+
+// modelConstructors returns a copy of the map of registered constructors.
+func (r *Registry) modelConstructors() map[string]ModelConstructor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	models := make(map[string]ModelConstructor, len(r.models))
+	for name, model := range r.models {
+		models[name] = model
+	}
+	return models
+}
+
+// Engine returns the engine of the registry, connected to the database.
+// The engine is connected once, also when Engine is called concurrently.
+func (r *Registry) Engine() (*Engine, error) {
+	if err := r.engine.connectOnce(); err != nil {
 		return nil, err
 	}
 	return r.engine, nil
@@ -103,6 +291,18 @@ func (r *Registry) TrimTableAffixes(name string) string {
 	return r.TrimTableSuffix(r.TrimTablePrefix(name))
 }
 
+// TableName returns the name of the table of model, with the
+// table prefix and suffix of the registry.
+func (r *Registry) TableName(model string) string {
+	return r.tablePrefix + model + r.tableSuffix
+}
+
+// ColumnName returns the name of the column of field f of model,
+// with the field prefix of the registry.
+func (r *Registry) ColumnName(model, f string) string {
+	return strings.Replace(r.fieldPrefix, "{model}", model, 1) + f
+}
+
 func (r *Registry) FieldPrefix() string {
 	return r.fieldPrefix
 }
@@ -1,8 +1,24 @@
 package toumin
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/henkburgstra/toumin/filter"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -104,3 +120,1367 @@ func TestFromSql(t *testing.T) {
 		}
 	}
 }
+
+func TestEach(t *testing.T) {
+	engine := makeEngine()
+	db, err := engine.Connect()
+	if err != nil {
+		t.Fatalf("TestEach(): engine.Connect(): %s", err.Error())
+	}
+	defer db.Close()
+	registry := makeRegistry(engine)
+	registry.RegisterModel("behandeldag_verrichtingen", NewBehandeldagVerrichtingen)
+
+	q := registry.Query("behandeldag_verrichtingen").FromSql(`
+		SELECT *
+		FROM behandeldag_verrichtingen
+		WHERE behandeldag_verrichtingen_id <= ?`, 2).ReuseModel(true)
+	var first IModel
+	count := 0
+	err = q.Each(func(m IModel) error {
+		if first == nil {
+			first = m
+		} else if m != first {
+			t.Errorf("TestEach(): model is not reused")
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("TestEach(): %s", err.Error())
+	}
+	if count == 0 {
+		t.Errorf("TestEach(): geen verrichtingen gevonden")
+	}
+}
+
+func TestIter(t *testing.T) {
+	engine := makeEngine()
+	db, err := engine.Connect()
+	if err != nil {
+		t.Fatalf("TestIter(): engine.Connect(): %s", err.Error())
+	}
+	defer db.Close()
+	registry := makeRegistry(engine)
+	registry.RegisterModel("behandeldag_verrichtingen", NewBehandeldagVerrichtingen)
+
+	q := registry.Query("behandeldag_verrichtingen").FromSql(`
+		SELECT *
+		FROM behandeldag_verrichtingen
+		WHERE behandeldag_verrichtingen_id <= ?`, 2)
+	all := len(registry.Query("behandeldag_verrichtingen").FromSql(q.Sql(), 2).All())
+	count := 0
+	for m, err := range q.Iter() {
+		if err != nil {
+			t.Fatalf("TestIter(): %s", err.Error())
+		}
+		if _, ok := m.(*BehandeldagVerrichtingen); !ok {
+			t.Errorf("TestIter(): model is not a *BehandeldagVerrichtingen")
+		}
+		count++
+	}
+	if count != all {
+		t.Errorf("TestIter(): %d models, All() returned %d", count, all)
+	}
+}
+
+func TestCursorUnknownModel(t *testing.T) {
+	registry := NewRegistry(makeEngine())
+	_, err := registry.Query("bestaat_niet").Cursor()
+	if _, ok := err.(UnknownModelError); !ok {
+		t.Errorf("TestCursorUnknownModel(): expected UnknownModelError, got %v", err)
+	}
+}
+
+func makeFilterRegistry() *Registry {
+	registry := NewRegistry(makeEngine())
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	patient := NewEntity("patient_data")
+	patient.Fields["patient_key"] = &EntityField{Name: "patient_key", Type: "varchar(25)", Key: true}
+	patient.Fields["patient_achternaam"] = &EntityField{Name: "patient_achternaam", Type: "varchar(50)"}
+	patient.Fields["patient_geslacht"] = &EntityField{Name: "patient_geslacht", Type: "char(1)"}
+	registry.RegisterEntity("patient", patient)
+	behandeling := NewEntity("behandeling_data")
+	behandeling.Fields["behandeling_key"] = &EntityField{Name: "behandeling_key", Type: "varchar(25)", Key: true}
+	behandeling.Fields["behandeling_patient"] = &EntityField{Name: "behandeling_patient", Type: "varchar(25)"}
+	behandeling.Fields["behandeling_datum"] = &EntityField{Name: "behandeling_datum", Type: "date"}
+	behandeling.AddRelationship(EntityRelationship{
+		ForeignKey:       "behandeling_patient",
+		ReferencedTable:  "patient_data",
+		ReferencedColumn: "patient_key",
+	})
+	registry.RegisterEntity("behandeling", behandeling)
+	return registry
+}
+
+func TestFilterSql(t *testing.T) {
+	registry := makeFilterRegistry()
+	q := registry.Query("patient").Filter(filter.NewFilter(filter.Or(
+		filter.Selectable{Entity: "patient", Field: "achternaam"}.Pfx("Leeuw"),
+		filter.Selectable{Entity: "patient", Field: "achternaam"}.Sfx("rik"))),
+		filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M"))
+	expected := `SELECT * 
+		FROM patient_data
+WHERE (patient_data.patient_achternaam LIKE ? ESCAPE '!' OR patient_data.patient_achternaam LIKE ? ESCAPE '!') AND patient_data.patient_geslacht = ?`
+	if sql := q.Sql(); sql != expected {
+		t.Errorf("TestFilterSql(): %s", sql)
+	}
+	if fmt.Sprint(q.params) != "[Leeuw% %rik M]" {
+		t.Errorf("TestFilterSql(): params %v", q.params)
+	}
+}
+
+func TestFilterWhere(t *testing.T) {
+	registry := makeFilterRegistry()
+	q := registry.Query("patient").Filter(filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("V"))
+	q.Filter(filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M"))
+	q.Where(filter.Selectable{Entity: "patient", Field: "achternaam"}.Pfx("Leeuw"))
+	where, params := q.where()
+	if where != "patient_data.patient_geslacht = ? AND patient_data.patient_achternaam LIKE ? ESCAPE '!'" {
+		t.Errorf("TestFilterWhere(): %s", where)
+	}
+	if fmt.Sprint(params) != "[M Leeuw%]" {
+		t.Errorf("TestFilterWhere(): params %v", params)
+	}
+
+	// An engine without a driver translates to standard SQL.
+	if tr := NewRegistry(NewEngine(nil)).translater("patient"); tr.Dialect != "" {
+		t.Errorf("TestFilterWhere(): dialect %q", tr.Dialect)
+	}
+}
+
+func TestFilterTestModel(t *testing.T) {
+	registry := makeFilterRegistry()
+	patient := NewPatient("patient").(*Patient)
+	patient.SetRegistry(registry)
+	patient.Achternaam = "Leeuwerik"
+	patient.Fields()["achternaam"] = &FieldValue{value: &patient.Achternaam}
+	patient.Fields()["geslacht"] = &FieldValue{value: "M"}
+
+	f := filter.NewFilter(filter.And(
+		filter.Selectable{Entity: "patient", Field: "achternaam"}.Pfx("Leeuw"),
+		filter.Selectable{Entity: "patient", Field: "patient_geslacht"}.Eq("M")))
+	if !f.Test(patient, nil) {
+		t.Errorf("TestFilterTestModel(): patient does not match")
+	}
+	patient.Achternaam = "Merel"
+	if f.Test(patient, nil) {
+		t.Errorf("TestFilterTestModel(): changed patient matches")
+	}
+}
+
+func TestSubquerySql(t *testing.T) {
+	registry := makeFilterRegistry()
+	datum := filter.Selectable{Entity: "behandeling", Field: "datum"}
+	geslacht := filter.Selectable{Entity: "patient", Field: "geslacht"}
+
+	q := registry.Query("patient")
+	q.Filter(geslacht.Eq("M"), filter.Exists(q.BackRef("behandeling").Filter(datum.Year().Eq(2015))))
+	expected := `SELECT * 
+		FROM patient_data
+WHERE patient_data.patient_geslacht = ? AND EXISTS (SELECT 1 FROM behandeling_data WHERE YEAR(behandeling_data.behandeling_datum) = ? AND behandeling_data.behandeling_patient = patient_data.patient_key)`
+	if sql := q.Sql(); sql != expected {
+		t.Errorf("TestSubquerySql(): %s", sql)
+	}
+	if fmt.Sprint(q.params) != "[M 2015]" {
+		t.Errorf("TestSubquerySql(): params %v", q.params)
+	}
+
+	q = registry.Query("patient").Filter(
+		filter.NotExists(registry.Query("behandeling").Filter(datum.Lt("2015-01-01"))),
+		geslacht.Eq("V"))
+	expected = `SELECT * 
+		FROM patient_data
+WHERE NOT EXISTS (SELECT 1 FROM behandeling_data WHERE behandeling_data.behandeling_datum < ? AND behandeling_data.behandeling_patient = patient_data.patient_key) AND patient_data.patient_geslacht = ?`
+	if sql := q.Sql(); sql != expected {
+		t.Errorf("TestSubquerySql(): %s", sql)
+	}
+	if fmt.Sprint(q.params) != "[2015-01-01 V]" {
+		t.Errorf("TestSubquerySql(): params %v", q.params)
+	}
+
+	q = registry.Query("patient").Filter(filter.Selectable{Entity: "patient", Field: "key"}.InQuery(
+		registry.Query("behandeling").Filter(datum.Year().Eq(2015))))
+	expected = `SELECT * 
+		FROM patient_data
+WHERE patient_data.patient_key IN (SELECT behandeling_data.behandeling_patient FROM behandeling_data WHERE YEAR(behandeling_data.behandeling_datum) = ?)`
+	if sql := q.Sql(); sql != expected {
+		t.Errorf("TestSubquerySql(): %s", sql)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	registry := makeFilterRegistry()
+	f := new(filter.Filter)
+	err := json.Unmarshal([]byte(`{"and":[
+		{"entity":"patient","field":"geslacht","op":"EQ","value":"M"},
+		{"entity":"behandeling","field":"datum","part":"year","op":"GTE","value":2015}]}`), f)
+	if err != nil {
+		t.Fatalf("TestValidateFilter(): %s", err.Error())
+	}
+	if err := registry.ValidateFilter(f); err != nil {
+		t.Errorf("TestValidateFilter(): %s", err.Error())
+	}
+	if sql := registry.FilterTranslater().Translate(f); sql != "(patient_data.patient_geslacht = ? AND YEAR(behandeling_data.behandeling_datum) >= ?)" {
+		t.Errorf("TestValidateFilter(): %s", sql)
+	}
+
+	for _, invalid := range []string{
+		`{"entity":"patient","field":"wachtwoord","op":"EQ","value":"x"}`,
+		`{"entity":"gebruiker","field":"naam","op":"EQ","value":"x"}`,
+		`{"or":[{"entity":"patient","field":"geslacht","op":"EQ","value":"M"},{"entity":"patient","field":"1=1 --","op":"EQ","value":1}]}`,
+	} {
+		f := new(filter.Filter)
+		if err := json.Unmarshal([]byte(invalid), f); err != nil {
+			t.Fatalf("TestValidateFilter(): %s", err.Error())
+		}
+		if _, ok := registry.ValidateFilter(f).(InvalidFilterError); !ok {
+			t.Errorf("TestValidateFilter(): no InvalidFilterError for %s", invalid)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	registry := makeFilterRegistry()
+	registry.Entity("patient").Fields["patient_leeftijd"] = &EntityField{Name: "patient_leeftijd", Type: "int(11)"}
+	patient := NewPatient("patient").(*Patient)
+	patient.SetRegistry(registry)
+	patient.Achternaam = "Leeuwerik"
+	leeftijd := []byte("42")
+	for field, value := range map[string]interface{}{
+		"achternaam": &patient.Achternaam,
+		"leeftijd":   leeftijd,
+		"geslacht":   nil,
+	} {
+		patient.Fields()[field] = &FieldValue{value: value}
+		patient.SetFieldMapping(field, "patient_"+field)
+	}
+	huisarts := NewModel("relatie")
+	huisarts.Fields()["naam"] = &FieldValue{value: "Merel"}
+	patient.SetRelation("huisarts", huisarts)
+	patient.SetRelation("behandeling", []IModel{})
+
+	data, err := json.Marshal(patient)
+	if err != nil {
+		t.Fatalf("TestMarshalJSON(): %s", err.Error())
+	}
+	expected := `{"achternaam":"Leeuwerik","behandeling":[],"geslacht":null,"huisarts":{"naam":"Merel"},"leeftijd":42}`
+	if string(data) != expected {
+		t.Errorf("TestMarshalJSON(): %s", data)
+	}
+
+	registry.SetJSONOptions(JSONOptions{Keys: ColumnKeys, OmitNull: true})
+	data, _ = json.Marshal(patient)
+	expected = `{"behandeling":[],"huisarts":{"naam":"Merel"},"patient_achternaam":"Leeuwerik","patient_leeftijd":42}`
+	if string(data) != expected {
+		t.Errorf("TestMarshalJSON(): %s", data)
+	}
+	// A Model that is not made with NewModel can hold relations too.
+	m := &Model{name: "relatie"}
+	m.SetRelation("huisarts", nil)
+	if data, _ = json.Marshal(m); string(data) != `{"huisarts":null}` {
+		t.Errorf("TestMarshalJSON(): %s", data)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	engine := makeEngine()
+	db, err := engine.Connect()
+	if err != nil {
+		t.Fatalf("TestPreload(): engine.Connect(): %s", err.Error())
+	}
+	defer db.Close()
+	registry := makeRegistry(engine)
+	registry.RegisterModel("patient", NewPatient)
+
+	q := registry.Query("patient").Filter(
+		filter.Selectable{Entity: "patient", Field: "huisarts"}.Eq("PJJG-VW0800")).Preload("huisarts")
+	for _, m := range q.All() {
+		if _, ok := m.(RelationHolder).Relation("huisarts"); !ok {
+			t.Errorf("TestPreload(): huisarts niet geladen")
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("TestPreload(): %s", err.Error())
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("TestPreload(): %s", err.Error())
+		}
+		if huisarts, ok := doc["huisarts"].(map[string]interface{}); !ok || len(huisarts) == 0 {
+			t.Errorf("TestPreload(): expected a huisarts object, got %s", data)
+		}
+	}
+}
+
+func TestDocumentSql(t *testing.T) {
+	registry := makeFilterRegistry()
+	q := registry.Query("patient").Filter(filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M"))
+	sql, params, err := q.Document().HasMany("behandelingen").Sql()
+	if err != nil {
+		t.Fatalf("TestDocumentSql(): %s", err.Error())
+	}
+	expected := "SELECT JSON_OBJECT('achternaam', patient_data.patient_achternaam, " +
+		"'geslacht', patient_data.patient_geslacht, 'key', patient_data.patient_key, " +
+		"'behandelingen', (SELECT COALESCE(JSON_ARRAYAGG(JSON_OBJECT('datum', t1.behandeling_datum, " +
+		"'key', t1.behandeling_key, 'patient', t1.behandeling_patient)), JSON_ARRAY()) " +
+		"FROM behandeling_data t1 WHERE t1.behandeling_patient = patient_data.patient_key)) " +
+		"FROM patient_data WHERE patient_data.patient_geslacht = ?"
+	if sql != expected {
+		t.Errorf("TestDocumentSql(): %s", sql)
+	}
+	if fmt.Sprint(params) != "[M]" {
+		t.Errorf("TestDocumentSql(): params %v", params)
+	}
+
+	registry.engine = NewEngine(MssqlDriver)
+	sql, _, err = registry.Query("behandeling").Document().HasOne("patient").Sql()
+	if err != nil {
+		t.Fatalf("TestDocumentSql(): %s", err.Error())
+	}
+	expected = "SELECT behandeling_data.behandeling_datum AS [datum], behandeling_data.behandeling_key AS [key], " +
+		"behandeling_data.behandeling_patient AS [patient], JSON_QUERY((SELECT t1.patient_achternaam AS [achternaam], " +
+		"t1.patient_geslacht AS [geslacht], t1.patient_key AS [key] FROM patient_data t1 " +
+		"WHERE t1.patient_key = behandeling_data.behandeling_patient FOR JSON PATH, INCLUDE_NULL_VALUES, " +
+		"WITHOUT_ARRAY_WRAPPER)) AS [patient] FROM behandeling_data FOR JSON PATH, INCLUDE_NULL_VALUES"
+	if sql != expected {
+		t.Errorf("TestDocumentSql(): %s", sql)
+	}
+
+	if _, _, err = registry.Query("patient").Document().HasMany("huisartsen").Sql(); err == nil {
+		t.Errorf("TestDocumentSql(): expected an error for an unknown model")
+	}
+
+	// The SQLite variant, executed.
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE patient_data (patient_key varchar(25) PRIMARY KEY,
+			patient_achternaam varchar(50), patient_geslacht char(1))`,
+		`CREATE TABLE behandeling_data (behandeling_key varchar(25) PRIMARY KEY, behandeling_datum date,
+			behandeling_patient varchar(25) REFERENCES patient_data (patient_key))`,
+		`INSERT INTO patient_data VALUES ('P1', 'Merel', 'M'), ('P2', 'Leeuw', 'V'), ('P3', 'Vink', 'M')`,
+		`INSERT INTO behandeling_data VALUES ('B1', '2015-03-01', 'P1'), ('B2', '2016-01-01', 'P1'), ('B3', '2015-06-01', 'P2')`)
+	registry = NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.LoadEntities()
+	type behandelingDoc struct {
+		Key     string
+		Datum   string
+		Patient string
+	}
+	var patients []struct {
+		Key           string
+		Achternaam    string
+		Geslacht      string
+		Behandelingen []behandelingDoc
+	}
+	err = registry.Query("patient").Filter(filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M")).
+		Document().HasMany("behandelingen").Decode(&patients)
+	if err != nil {
+		t.Fatalf("TestDocumentSql(): sqlite: %s", err.Error())
+	}
+	if len(patients) == 2 {
+		sort.Slice(patients, func(i, j int) bool { return patients[i].Key < patients[j].Key })
+		sort.Slice(patients[0].Behandelingen, func(i, j int) bool {
+			return patients[0].Behandelingen[i].Key < patients[0].Behandelingen[j].Key
+		})
+	}
+	expected = "[{P1 Merel M [{B1 2015-03-01 P1} {B2 2016-01-01 P1}]} {P3 Vink M []}]"
+	if fmt.Sprint(patients) != expected {
+		t.Errorf("TestDocumentSql(): sqlite: %v", patients)
+	}
+	if len(patients) == 2 && patients[1].Behandelingen == nil {
+		t.Errorf("TestDocumentSql(): sqlite: null instead of an empty array")
+	}
+}
+
+func TestCreateSchemaSql(t *testing.T) {
+	registry := makeFilterRegistry()
+	patient := registry.Entity("patient")
+	patient.Fields["patient_geslacht"].Default = "O"
+	patient.Indexes["patient_achternaam"] = &TableIndex{Columns: []string{"patient_achternaam"}}
+	behandeling := registry.Entity("behandeling")
+	behandeling.Fields["behandeling_datum"].Null = true
+
+	expected := []string{
+		"CREATE TABLE `patient_data` (\n\t`patient_key` varchar(25) NOT NULL,\n" +
+			"\t`patient_achternaam` varchar(50) NOT NULL,\n\t`patient_geslacht` char(1) NOT NULL DEFAULT 'O',\n" +
+			"\tPRIMARY KEY (`patient_key`)\n)",
+		"CREATE INDEX `patient_achternaam` ON `patient_data` (`patient_achternaam`)",
+		"CREATE TABLE `behandeling_data` (\n\t`behandeling_key` varchar(25) NOT NULL,\n" +
+			"\t`behandeling_datum` date,\n\t`behandeling_patient` varchar(25) NOT NULL,\n" +
+			"\tPRIMARY KEY (`behandeling_key`),\n" +
+			"\tCONSTRAINT `fk_behandeling_data_behandeling_patient` FOREIGN KEY (`behandeling_patient`) " +
+			"REFERENCES `patient_data` (`patient_key`)\n)",
+	}
+	if sql := registry.CreateSchemaSql(); fmt.Sprint(sql) != fmt.Sprint(expected) {
+		t.Errorf("TestCreateSchemaSql(): %q", sql)
+	}
+
+	// A varchar key without a length cannot be longtext.
+	code := NewEntity("code")
+	code.Fields["code"] = &EntityField{Name: "code", Type: "varchar", Key: true}
+	code.Fields["omschrijving"] = &EntityField{Name: "omschrijving", Type: "varchar", Null: true}
+	sql := registry.engine.CreateTableSql(code)
+	if !strings.Contains(sql[0], "`code` varchar(255) NOT NULL") || !strings.Contains(sql[0], "`omschrijving` longtext") {
+		t.Errorf("TestCreateSchemaSql(): %s", sql[0])
+	}
+
+	registry.engine = NewEngine(MssqlDriver)
+	sql = registry.engine.CreateTableSql(patient)
+	if !strings.Contains(sql[0], "[patient_key] nvarchar(25) NOT NULL") {
+		t.Errorf("TestCreateSchemaSql(): %s", sql[0])
+	}
+}
+
+func TestCreateSchema(t *testing.T) {
+	registry := makeFilterRegistry()
+	engine := NewEngine(SqliteDriver)
+	engine.SetDatabase(filepath.Join(t.TempDir(), "toumin.db"))
+	registry.engine = engine
+
+	// A failing statement rolls back the tables created before it.
+	behandeling := registry.Entity("behandeling")
+	registry.Entity("patient").Indexes["datum"] = &TableIndex{Columns: []string{"patient_achternaam"}}
+	behandeling.Indexes["datum"] = &TableIndex{Columns: []string{"behandeling_datum"}}
+	if err := registry.CreateSchema(); err == nil {
+		t.Fatalf("TestCreateSchema(): expected an error for a duplicate index name")
+	}
+	if names := engine.TableNames(); len(names) != 0 {
+		t.Errorf("TestCreateSchema(): tables %v after a failed CreateSchema", names)
+	}
+
+	delete(behandeling.Indexes, "datum")
+	if err := registry.CreateSchema(); err != nil {
+		t.Fatalf("TestCreateSchema(): %s", err.Error())
+	}
+	if names := engine.TableNames(); fmt.Sprint(names) != "[behandeling_data patient_data]" {
+		t.Errorf("TestCreateSchema(): tables %v", names)
+	}
+	code := NewEntity("select")
+	code.Fields["order"] = &EntityField{Name: "order", Type: "varchar(10)", Key: true}
+	if err := engine.CreateTable(code); err != nil {
+		t.Errorf("TestCreateSchema(): CreateTable with reserved words: %s", err.Error())
+	}
+}
+
+func TestNormalizeType(t *testing.T) {
+	tests := map[string]string{
+		"varchar(25)":      "varchar 25",
+		"nvarchar(max)":    "text ",
+		"int(11) unsigned": "int ",
+		"tinyint(1)":       "bool ",
+		"DECIMAL(10, 2)":   "decimal 10,2",
+		"datetime2(7)":     "datetime ",
+		"bit":              "bool ",
+	}
+	for t1, expected := range tests {
+		if name, args := normalizeType(t1); name+" "+args != expected {
+			t.Errorf("TestNormalizeType(%s): %s %s", t1, name, args)
+		}
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+	a := makeFilterRegistry()
+	b := makeFilterRegistry()
+	b.engine = NewEngine(SqliteDriver)
+	if d := SchemaDiff(a, b); !d.Empty() {
+		t.Errorf("TestSchemaDiff(): %s", d)
+	}
+
+	a.Entity("patient").Fields["patient_actief"] = &EntityField{Name: "patient_actief", Type: "tinyint(1)"}
+	a.Entity("patient").Fields["patient_leeftijd"] = &EntityField{Name: "patient_leeftijd", Type: "int(11)"}
+	b.Entity("patient").Fields["patient_actief"] = &EntityField{Name: "patient_actief", Type: "integer"}
+	b.Entity("patient").Fields["patient_achternaam"] = &EntityField{Name: "patient_achternaam",
+		Type: "nvarchar", Length: 60, Null: true}
+	b.Entity("patient").Fields["patient_geslacht"].Default = "('O')"
+	delete(b.Entity("behandeling").Relationships, "behandeling_patient")
+	b.Entity("behandeling").Indexes["idx"] = &TableIndex{Columns: []string{"behandeling_datum"}}
+	b.RegisterEntity("huisarts", NewEntity("huisarts_data"))
+
+	expected := `+ index behandeling (datum)
+- relationship behandeling.patient
++ entity huisarts
+~ field patient.achternaam: type varchar(50) -> varchar(60); null false -> true
+~ field patient.geslacht: default "" -> "O"
+- field patient.leeftijd`
+	if d := SchemaDiff(a, b); d.String() != expected {
+		t.Errorf("TestSchemaDiff(): %s", d)
+	}
+}
+
+func TestMigrationSql(t *testing.T) {
+	a := NewRegistry(NewEngine(MysqlDriver))
+	a.SetTableSuffix("_data")
+	a.SetFieldPrefix("{model}_")
+	a.RegisterEntity("patient", makeFilterRegistry().Entity("patient"))
+	// b names the columns of patient without the field prefix of a.
+	b := NewRegistry(NewEngine(MysqlDriver))
+	b.SetTableSuffix("_data")
+	patient := NewEntity("patient_data")
+	for column, field := range a.Entity("patient").Fields {
+		name := strings.TrimPrefix(column, "patient_")
+		patient.Fields[name] = &EntityField{Name: name, Type: field.Type, Key: field.Key}
+	}
+	patient.Fields["bsn"] = &EntityField{Name: "bsn", Type: "varchar(9)", Null: true}
+	patient.Indexes["naam"] = &TableIndex{Name: "naam", Columns: []string{"achternaam", "bsn"}}
+	b.RegisterEntity("patient", patient)
+
+	up, down := SchemaDiff(a, b).MigrationSql(a, b)
+	expected := []string{
+		"ALTER TABLE `patient_data` ADD `bsn` varchar(9)",
+		"CREATE INDEX `naam` ON `patient_data` (`patient_achternaam`, `bsn`)",
+	}
+	if fmt.Sprint(up) != fmt.Sprint(expected) {
+		t.Errorf("TestMigrationSql(): up %q", up)
+	}
+	expected = []string{
+		"DROP INDEX `naam` ON `patient_data`",
+		"ALTER TABLE `patient_data` DROP COLUMN `bsn`",
+	}
+	if fmt.Sprint(down) != fmt.Sprint(expected) {
+		t.Errorf("TestMigrationSql(): down %q", down)
+	}
+}
+
+func TestMigrationSqlOrder(t *testing.T) {
+	// behandeling refers to patient; both are new.
+	a := NewRegistry(NewEngine(MysqlDriver))
+	b := makeFilterRegistry()
+	up, down := SchemaDiff(a, b).MigrationSql(a, b)
+	if len(up) != 2 || !strings.HasPrefix(up[0], "CREATE TABLE `patient_data`") ||
+		!strings.HasPrefix(up[1], "CREATE TABLE `behandeling_data`") {
+		t.Errorf("TestMigrationSqlOrder(): up %q", up)
+	}
+	if fmt.Sprint(down) != "[DROP TABLE `behandeling_data` DROP TABLE `patient_data`]" {
+		t.Errorf("TestMigrationSqlOrder(): down %q", down)
+	}
+
+	// A cycle: the foreign key to the table created later is added last.
+	patient := b.Entity("patient")
+	patient.Fields["patient_behandeling"] = &EntityField{Name: "patient_behandeling", Type: "varchar(25)", Null: true}
+	patient.AddRelationship(EntityRelationship{ForeignKey: "patient_behandeling",
+		ReferencedTable: "behandeling_data", ReferencedColumn: "behandeling_key"})
+	up, down = SchemaDiff(a, b).MigrationSql(a, b)
+	addFk := "ALTER TABLE `behandeling_data` ADD CONSTRAINT `fk_behandeling_data_behandeling_patient` " +
+		"FOREIGN KEY (`behandeling_patient`) REFERENCES `patient_data` (`patient_key`)"
+	dropFk := "ALTER TABLE `behandeling_data` DROP FOREIGN KEY `fk_behandeling_data_behandeling_patient`"
+	if len(up) != 3 || !strings.HasPrefix(up[0], "CREATE TABLE `behandeling_data`") ||
+		strings.Contains(up[0], "FOREIGN KEY") || up[2] != addFk {
+		t.Errorf("TestMigrationSqlOrder(): cycle up %q", up)
+	}
+	if fmt.Sprint(down) != fmt.Sprint([]string{dropFk, "DROP TABLE `patient_data`", "DROP TABLE `behandeling_data`"}) {
+		t.Errorf("TestMigrationSqlOrder(): cycle down %q", down)
+	}
+	// Removing the tables undoes in the opposite order.
+	up, down = SchemaDiff(b, a).MigrationSql(b, a)
+	if fmt.Sprint(up) != fmt.Sprint([]string{dropFk, "DROP TABLE `patient_data`", "DROP TABLE `behandeling_data`"}) {
+		t.Errorf("TestMigrationSqlOrder(): remove up %q", up)
+	}
+	if len(down) != 3 || !strings.HasPrefix(down[0], "CREATE TABLE `behandeling_data`") ||
+		strings.Contains(down[0], "FOREIGN KEY") || down[2] != addFk {
+		t.Errorf("TestMigrationSqlOrder(): remove down %q", down)
+	}
+
+	engine := makeSqliteEngine(t, "PRAGMA foreign_keys = ON")
+	a = NewRegistry(engine)
+	b = makeFilterRegistry()
+	up, down = SchemaDiff(a, b).MigrationSql(a, b)
+	db := engine.Db()
+	for _, s := range append(append(up, "INSERT INTO patient_data (patient_key, patient_achternaam, patient_geslacht) VALUES ('P1', 'Leeuwerik', 'M')",
+		"INSERT INTO behandeling_data (behandeling_key, behandeling_datum, behandeling_patient) VALUES ('B1', '2015-01-01', 'P1')",
+		"DELETE FROM behandeling_data"), down...) {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("TestMigrationSqlOrder(): %s: %s", s, err.Error())
+		}
+	}
+	if names := engine.TableNames(); len(names) != 0 {
+		t.Errorf("TestMigrationSqlOrder(): tables %v after down", names)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	registry := makeFilterRegistry()
+	registry.engine = makeSqliteEngine(t)
+	registry.Entity("patient").Indexes["naam"] = &TableIndex{Columns: []string{"patient_achternaam"}}
+	var buf bytes.Buffer
+	if err := registry.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("TestSnapshot(): %s", err.Error())
+	}
+
+	loaded := NewRegistry(registry.engine)
+	if err := loaded.LoadSnapshot(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("TestSnapshot(): snapshot with other affixes loaded")
+	}
+	loaded.SetTableSuffix("_data")
+	loaded.SetFieldPrefix("{model}_")
+	if err := loaded.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("TestSnapshot(): %s", err.Error())
+	}
+	if d := SchemaDiff(registry, loaded); !d.Empty() {
+		t.Errorf("TestSnapshot(): %s", d)
+	}
+	if loaded.Entity("behandeling").registry != loaded {
+		t.Errorf("TestSnapshot(): registry of entity not set")
+	}
+	if stale, err := loaded.SnapshotStale(); stale || err != nil {
+		t.Errorf("TestSnapshot(): snapshot of the database is stale: %v", err)
+	}
+	if _, err := registry.engine.Db().Exec("CREATE TABLE huisarts_data (huisarts_key varchar(25))"); err != nil {
+		t.Fatalf("TestSnapshot(): %s", err.Error())
+	}
+	if stale, _ := loaded.SnapshotStale(); !stale {
+		t.Errorf("TestSnapshot(): snapshot is not stale after a schema change")
+	}
+	loaded.setEntities(loaded.entityMap(), "")
+	if stale, _ := loaded.SnapshotStale(); !stale {
+		t.Errorf("TestSnapshot(): snapshot without checksum is not stale")
+	}
+}
+
+func TestLoadEntitiesSnapshot(t *testing.T) {
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE patient_data (patient_key varchar(25) PRIMARY KEY, patient_achternaam varchar(50))`,
+		`CREATE INDEX patient_naam ON patient_data (patient_achternaam)`)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	huisarts := NewEntity("huisarts")
+	huisarts.Fields["huisarts_key"] = &EntityField{Name: "huisarts_key", Type: "varchar(25)", Key: true}
+	registry.RegisterEntity("huisarts", huisarts)
+
+	if err := registry.LoadEntitiesSnapshot(path); err != nil {
+		t.Fatalf("TestLoadEntitiesSnapshot(): %s", err.Error())
+	}
+	if registry.Entity("huisarts") != huisarts {
+		t.Errorf("TestLoadEntitiesSnapshot(): registered entity discarded")
+	}
+	if index := registry.Entity("patient").Indexes["patient_naam"]; index == nil {
+		t.Errorf("TestLoadEntitiesSnapshot(): index not loaded")
+	}
+	checksum, _ := engine.SchemaChecksum()
+	data, _ := os.ReadFile(path)
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil || s.Checksum != checksum {
+		t.Fatalf("TestLoadEntitiesSnapshot(): snapshot checksum %q, expected %q", s.Checksum, checksum)
+	}
+	if index := s.Entities["patient"].Indexes["patient_naam"]; fmt.Sprint(index.Columns) != "[patient_achternaam]" {
+		t.Errorf("TestLoadEntitiesSnapshot(): snapshot index %+v", index)
+	}
+
+	// An up to date snapshot is loaded; a stale one is replaced.
+	loaded := NewRegistry(engine)
+	loaded.SetTableSuffix("_data")
+	loaded.SetFieldPrefix("{model}_")
+	if err := loaded.LoadEntitiesSnapshot(path); err != nil {
+		t.Fatalf("TestLoadEntitiesSnapshot(): %s", err.Error())
+	}
+	if d := SchemaDiff(registry, loaded); !d.Empty() {
+		t.Errorf("TestLoadEntitiesSnapshot(): %s", d)
+	}
+	if _, err := engine.Db().Exec("CREATE TABLE relatie_data (relatie_key varchar(25))"); err != nil {
+		t.Fatalf("TestLoadEntitiesSnapshot(): %s", err.Error())
+	}
+	if err := loaded.LoadEntitiesSnapshot(path); err != nil {
+		t.Fatalf("TestLoadEntitiesSnapshot(): %s", err.Error())
+	}
+	if loaded.Entity("relatie") == nil {
+		t.Errorf("TestLoadEntitiesSnapshot(): stale snapshot loaded")
+	}
+	if stale, err := loaded.SnapshotStale(); stale || err != nil {
+		t.Errorf("TestLoadEntitiesSnapshot(): new snapshot is stale: %v", err)
+	}
+}
+
+// fakeDriver serves the entities of a registry as a database, counting
+// the tables whose structure is requested. Its name is that of a
+// registered database/sql driver, so engines can "connect" to it.
+type fakeDriver struct {
+	source     *Registry
+	structures *int32
+	// err is returned by TableRelationships.
+	err error
+}
+
+func (d fakeDriver) Name() string                      { return "mysql" }
+func (d fakeDriver) Version() string                   { return "0.0.1" }
+func (d fakeDriver) ConnectionString(e *Engine) string { return "" }
+
+func (d fakeDriver) TableNames(e *Engine) []string {
+	names := make([]string, 0)
+	for _, entity := range d.source.entities {
+		names = append(names, entity.Name)
+	}
+	return names
+}
+
+func (d fakeDriver) TableStructure(e *Engine, name string, entity *Entity) {
+	atomic.AddInt32(d.structures, 1)
+	for _, source := range d.source.entities {
+		if source.Name == name {
+			for column, field := range source.Fields {
+				f := *field
+				entity.Fields[column] = &f
+			}
+		}
+	}
+}
+
+func (d fakeDriver) LoadRelationships(e *Engine, registry *Registry) {
+	for _, source := range d.source.entities {
+		if entity := registry.loadedEntity(registry.TrimTableAffixes(source.Name)); entity != nil {
+			for _, r := range source.Relationships {
+				entity.AddRelationship(r)
+			}
+		}
+	}
+}
+
+func (d fakeDriver) TableRelationships(e *Engine, table string) (map[string][]EntityRelationship, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	relationships := make(map[string][]EntityRelationship)
+	for _, source := range d.source.entities {
+		for _, r := range source.Relationships {
+			if source.Name == table || r.ReferencedTable == table {
+				relationships[source.Name] = append(relationships[source.Name], r)
+			}
+		}
+	}
+	return relationships, nil
+}
+
+func TestLazyEntity(t *testing.T) {
+	var structures int32
+	registry := NewRegistry(NewEngine(fakeDriver{source: makeFilterRegistry(), structures: &structures}))
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.SetLazy(true)
+
+	patient := registry.Entity("patient")
+	if patient == nil || patient.Name != "patient_data" || len(patient.Fields) != 3 {
+		t.Fatalf("TestLazyEntity(): patient %v", patient)
+	}
+	if registry.Entity("patient") != patient || structures != 1 {
+		t.Errorf("TestLazyEntity(): patient loaded %d times", structures)
+	}
+	if registry.Entity("patient_data") != nil || registry.Entity("huisarts") != nil {
+		t.Errorf("TestLazyEntity(): unknown model loaded")
+	}
+	behandeling := registry.Entity("behandeling")
+	if _, ok := behandeling.Relationship("behandeling_patient"); !ok {
+		t.Errorf("TestLazyEntity(): relationship not loaded")
+	}
+	if names := registry.EntityNames(); fmt.Sprint(names) != "[behandeling patient]" || structures != 2 {
+		t.Errorf("TestLazyEntity(): %v, %d structures", names, structures)
+	}
+
+	// An entity whose relationships cannot be loaded is not loaded.
+	registry = NewRegistry(NewEngine(fakeDriver{source: makeFilterRegistry(), structures: &structures,
+		err: errors.New("no foreign keys")}))
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.SetLazy(true)
+	if patient := registry.Entity("patient"); patient != nil {
+		t.Errorf("TestLazyEntity(): patient loaded without its relationships")
+	}
+}
+
+func TestConcurrentRegistry(t *testing.T) {
+	var structures int32
+	registry := NewRegistry(NewEngine(fakeDriver{source: makeFilterRegistry(), structures: &structures}))
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.SetLazy(true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := registry.Engine(); err != nil {
+				t.Errorf("TestConcurrentRegistry(): %s", err.Error())
+			}
+			switch i % 4 {
+			case 0:
+				registry.LoadEntities()
+			case 1:
+				registry.RegisterModel(fmt.Sprintf("model%d", i), NewPatient)
+				registry.RegisterEntity(fmt.Sprintf("model%d", i), NewEntity(fmt.Sprintf("model%d_data", i)))
+			case 2:
+				_, _ = ModelName[*Patient](registry)
+				registry.Model("patient")
+			}
+			for _, model := range []string{"behandeling", "patient"} {
+				entity := registry.Entity(model)
+				if entity == nil {
+					t.Errorf("TestConcurrentRegistry(): no entity %s", model)
+					continue
+				}
+				entity.Relationship("behandeling_patient")
+				for range entity.Fields {
+				}
+			}
+			registry.EntityNames()
+		}(i)
+	}
+	wg.Wait()
+
+	if _, ok := registry.Entity("behandeling").Relationship("behandeling_patient"); !ok {
+		t.Errorf("TestConcurrentRegistry(): relationship not loaded")
+	}
+	if db := registry.engine.Db(); db == nil {
+		t.Errorf("TestConcurrentRegistry(): engine not connected")
+	}
+}
+
+func TestConcurrentEngine(t *testing.T) {
+	engine := NewEngine(SqliteDriver)
+	engine.SetDatabase(filepath.Join(t.TempDir(), "toumin.db"))
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := registry.Engine()
+			if err != nil {
+				t.Errorf("TestConcurrentEngine(): %s", err.Error())
+				return
+			}
+			if err := e.Db().Ping(); err != nil {
+				t.Errorf("TestConcurrentEngine(): %s", err.Error())
+			}
+			if _, err := registry.Db(); err != nil {
+				t.Errorf("TestConcurrentEngine(): %s", err.Error())
+			}
+			if db, err := e.Connect(); err != nil || db.Ping() != nil {
+				t.Errorf("TestConcurrentEngine(): Connect %v", err)
+			}
+			e.TableNames()
+			if _, err := e.SchemaChecksum(); err != nil {
+				t.Errorf("TestConcurrentEngine(): %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Connecting again returns the pool in use.
+	db := engine.Db()
+	defer db.Close()
+	again, err := engine.Connect()
+	if err != nil {
+		t.Fatalf("TestConcurrentEngine(): %s", err.Error())
+	}
+	if again != db {
+		t.Errorf("TestConcurrentEngine(): Connect replaced the pool in use")
+	}
+	if err := db.Ping(); err != nil {
+		t.Errorf("TestConcurrentEngine(): %s", err.Error())
+	}
+}
+
+func TestDiagram(t *testing.T) {
+	registry := makeFilterRegistry()
+	relatie := NewEntity("relatie_data")
+	relatie.Fields["relatie_key"] = &EntityField{Name: "relatie_key", Type: "varchar(25)", Key: true}
+	registry.RegisterEntity("relatie", relatie)
+	patient := registry.Entity("patient").clone()
+	patient.Fields["patient_huisarts"] = &EntityField{Name: "patient_huisarts", Type: "varchar(25)", Null: true}
+	patient.AddRelationship(EntityRelationship{ForeignKey: "patient_huisarts",
+		ReferencedTable: "relatie_data", ReferencedColumn: "relatie_key"})
+	registry.RegisterEntity("patient", patient)
+
+	var b bytes.Buffer
+	if err := registry.WriteDot(&b, DiagramOptions{}); err != nil {
+		t.Fatalf("TestDiagram(): %s", err.Error())
+	}
+	for _, expected := range []string{
+		`"behandeling" [label="{behandeling|PK behandeling_key varchar(25)\lFK behandeling_patient varchar(25)\l}"];`,
+		`"behandeling" -> "patient" [label="behandeling_patient", taillabel="*", headlabel="1"];`,
+		`"patient" -> "relatie" [label="patient_huisarts", taillabel="*", headlabel="0..1"];`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("TestDiagram(): expected %s in\n%s", expected, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := registry.WriteMermaid(&b, DiagramOptions{Model: "behandeling", Hops: 1}); err != nil {
+		t.Fatalf("TestDiagram(): %s", err.Error())
+	}
+	expected := `erDiagram
+    behandeling {
+        varchar behandeling_key PK
+        varchar behandeling_patient FK
+    }
+    patient {
+        varchar patient_key PK
+        varchar patient_huisarts FK
+    }
+    patient ||--o{ behandeling : "behandeling_patient"
+`
+	if b.String() != expected {
+		t.Errorf("TestDiagram(): %s", b.String())
+	}
+	if err := registry.WriteMermaid(&b, DiagramOptions{Model: "arts"}); err == nil {
+		t.Errorf("TestDiagram(): expected an error for an unknown model")
+	}
+}
+
+func TestExport(t *testing.T) {
+	registry := makeFilterRegistry()
+	q := registry.Query("behandeling")
+	fields, err := q.exportFields([]string{"key", "behandeling_datum", "patient"})
+	if err != nil {
+		t.Fatalf("TestExport(): %s", err.Error())
+	}
+	if _, err := q.exportFields([]string{"arts"}); err == nil {
+		t.Errorf("TestExport(): expected an error for an unknown field")
+	}
+	models := make([]IModel, 0)
+	for _, values := range [][]interface{}{{"B1", "2015-01-01", "P;1"}, {"B2", nil, "P2"}} {
+		m := NewModel("behandeling")
+		m.SetRegistry(registry)
+		for i, f := range fields {
+			m.Fields()[f.name] = &FieldValue{value: values[i]}
+		}
+		models = append(models, m)
+	}
+	export := func(e exporter) {
+		if err := e.header(fields); err != nil {
+			t.Fatalf("TestExport(): %s", err.Error())
+		}
+		for _, m := range models {
+			if err := e.row(fields, m); err != nil {
+				t.Fatalf("TestExport(): %s", err.Error())
+			}
+		}
+		if err := e.close(); err != nil {
+			t.Fatalf("TestExport(): %s", err.Error())
+		}
+	}
+
+	var b bytes.Buffer
+	c := csv.NewWriter(&b)
+	c.Comma = ';'
+	export(&csvExporter{w: c})
+	if b.String() != "key;datum;patient\nB1;2015-01-01;\"P;1\"\nB2;;P2\n" {
+		t.Errorf("TestExport(): CSV %q", b.String())
+	}
+
+	b.Reset()
+	export(&jsonlExporter{w: bufio.NewWriter(&b)})
+	if b.String() != `{"datum":"2015-01-01","key":"B1","patient":"P;1"}`+"\n"+`{"datum":null,"key":"B2","patient":"P2"}`+"\n" {
+		t.Errorf("TestExport(): JSON Lines %q", b.String())
+	}
+
+	b.Reset()
+	export(&xlsxExporter{zip: zip.NewWriter(&b), sheet: "behandeling"})
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("TestExport(): %s", err.Error())
+	}
+	sheet := ""
+	for _, f := range z.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			sheet = string(data)
+		}
+	}
+	for _, expected := range []string{
+		`<row r="1"><c r="A1" s="4" t="inlineStr"><is><t xml:space="preserve">key</t></is></c>`,
+		`<c r="B2" s="1"><v>42005</v></c><c r="C2" t="inlineStr"><is><t xml:space="preserve">P;1</t></is></c></row>`,
+		`<row r="3"><c r="A3" t="inlineStr"><is><t xml:space="preserve">B2</t></is></c><c r="C3" `,
+	} {
+		if !strings.Contains(sheet, expected) {
+			t.Errorf("TestExport(): expected %s in\n%s", expected, sheet)
+		}
+	}
+	if xlsxColumn(0) != "A" || xlsxColumn(25) != "Z" || xlsxColumn(26) != "AA" || xlsxColumn(702) != "AAA" {
+		t.Errorf("TestExport(): xlsxColumn")
+	}
+	if name := xlsxSheetName("behandeling/2015: [archief]*"); name != "behandeling_2015_ _archief__" {
+		t.Errorf("TestExport(): sheet name %s", name)
+	}
+	if name := xlsxSheetName(strings.Repeat("é", 40)); name != strings.Repeat("é", 31) {
+		t.Errorf("TestExport(): sheet name %s", name)
+	}
+
+	// NaN and infinity are written as text.
+	b.Reset()
+	e := &xlsxExporter{w: bufio.NewWriter(&b), rows: 1}
+	bedrag := &EntityField{Name: "bedrag", Type: "decimal(10,2)"}
+	e.cell(0, &FieldValue{value: "NaN"}, bedrag)
+	e.cell(1, &FieldValue{value: math.Inf(-1)}, nil)
+	e.cell(2, &FieldValue{value: "12.50"}, bedrag)
+	e.w.Flush()
+	expected := `<c r="A1" t="inlineStr"><is><t xml:space="preserve">NaN</t></is></c>` +
+		`<c r="B1" t="inlineStr"><is><t xml:space="preserve">-Inf</t></is></c><c r="C1"><v>12.50</v></c>`
+	if b.String() != expected {
+		t.Errorf("TestExport(): %s", b.String())
+	}
+}
+
+type execRecorder struct {
+	statements []string
+	params     [][]interface{}
+}
+
+func (e *execRecorder) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.statements = append(e.statements, query)
+	e.params = append(e.params, args)
+	return nil, nil
+}
+
+func TestImport(t *testing.T) {
+	registry := makeFilterRegistry()
+	behandeling := registry.Entity("behandeling").clone()
+	behandeling.Fields["behandeling_aantal"] = &EntityField{Name: "behandeling_aantal", Type: "int(11)", Null: true}
+	behandeling.Fields["behandeling_patient"] = &EntityField{Name: "behandeling_patient", Type: "varchar(25)", Length: 5}
+	registry.RegisterEntity("behandeling", behandeling)
+
+	csvText := `key;patient;datum;aantal
+B1;P1;2015-01-01;3
+B2;P1234567;2015-13-01;x
+B3;P2;2016-02-29;
+B4;P3
+`
+	report, err := registry.ImportCSV("behandeling", strings.NewReader(csvText), ImportOptions{Comma: ';', DryRun: true})
+	if err != nil {
+		t.Fatalf("TestImport(): %s", err.Error())
+	}
+	expected := `4 rows read, 0 inserted, 4 errors
+line 3: field aantal: "x" is not an integer
+line 3: field datum: "2015-13-01" is not a date
+line 3: field patient: "P1234567" is longer than 5 characters
+line 5: 2 values, expected 4
+`
+	if report.String() != expected {
+		t.Errorf("TestImport(): CSV report\n%s", report.String())
+	}
+	if _, err := registry.ImportCSV("behandeling", strings.NewReader("key;arts\n"), ImportOptions{Comma: ';', DryRun: true}); err == nil {
+		t.Errorf("TestImport(): expected an error for an unknown field")
+	}
+
+	jsonText := `{"key": "B1", "patient": "P1", "datum": "2015-01-01", "aantal": 3}
+
+{"key": "B2", "behandeling_patient": "P2", "aantal": 1.5}
+{"key": "B3", "patient": "P3", "datum": "2015-01-01", "arts": "A"}
+{"key": "B4"
+`
+	report, err = registry.ImportJSONL("behandeling", strings.NewReader(jsonText), ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("TestImport(): %s", err.Error())
+	}
+	expected = `4 rows read, 0 inserted, 4 errors
+line 3: field aantal: "1.5" is not an integer
+line 3: field datum: a value is required
+line 4: field arts: unknown field
+line 5: unexpected EOF
+`
+	if report.String() != expected {
+		t.Errorf("TestImport(): JSON Lines report\n%s", report.String())
+	}
+
+	recorder := &execRecorder{}
+	inserter := &batchInserter{db: recorder, entity: behandeling, size: 2}
+	for _, values := range []map[string]interface{}{
+		{"behandeling_key": "B1", "behandeling_patient": "P1"},
+		{"behandeling_key": "B2", "behandeling_patient": "P2"},
+		{"behandeling_key": "B3", "behandeling_patient": "P3"},
+		{"behandeling_key": "B4", "behandeling_aantal": int64(2)},
+	} {
+		if _, err := inserter.add(values); err != nil {
+			t.Fatalf("TestImport(): %s", err.Error())
+		}
+	}
+	if n, _ := inserter.flush(); n != 1 {
+		t.Errorf("TestImport(): flushed %d rows", n)
+	}
+	statements := []string{
+		"INSERT INTO behandeling_data (behandeling_key, behandeling_patient) VALUES (?, ?), (?, ?)",
+		"INSERT INTO behandeling_data (behandeling_key, behandeling_patient) VALUES (?, ?)",
+		"INSERT INTO behandeling_data (behandeling_aantal, behandeling_key) VALUES (?, ?)",
+	}
+	if fmt.Sprint(recorder.statements) != fmt.Sprint(statements) {
+		t.Errorf("TestImport(): statements %q", recorder.statements)
+	}
+	if fmt.Sprint(recorder.params) != "[[B1 P1 B2 P2] [B3 P3] [2 B4]]" {
+		t.Errorf("TestImport(): params %v", recorder.params)
+	}
+}
+
+func TestImportSqlite(t *testing.T) {
+	engine := makeSqliteEngine(t, `CREATE TABLE behandeling_data (
+		behandeling_key varchar(25) NOT NULL PRIMARY KEY,
+		behandeling_aantal int NOT NULL DEFAULT 0,
+		behandeling_datum date
+	)`)
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.LoadEntities()
+
+	// An empty value of a field with a default gets the default; invalid
+	// rows are reported and the others inserted.
+	report, err := registry.ImportCSV("behandeling", strings.NewReader("key,aantal,datum\nB1,3,2015-01-01\nB2,,\nB3,x,\n"), ImportOptions{})
+	if err != nil {
+		t.Fatalf("TestImportSqlite(): %s", err.Error())
+	}
+	if report.String() != "3 rows read, 2 inserted, 1 errors\nline 4: field aantal: \"x\" is not an integer\n" {
+		t.Errorf("TestImportSqlite(): report\n%s", report.String())
+	}
+	rows := func() string {
+		return queryStrings(t, engine, "SELECT behandeling_key || ':' || behandeling_aantal FROM behandeling_data ORDER BY behandeling_key")
+	}
+	if r := rows(); r != "[B1:3 B2:0]" {
+		t.Errorf("TestImportSqlite(): rows %s", r)
+	}
+
+	// A database error rolls back the whole import.
+	report, err = registry.ImportJSONL("behandeling", strings.NewReader(`{"key": "B4", "aantal": 1}
+{"key": "B1", "aantal": 2}
+`), ImportOptions{BatchSize: 1})
+	if err == nil || report.Inserted != 0 {
+		t.Errorf("TestImportSqlite(): expected an error for a duplicate key, got %v, %d inserted", err, report.Inserted)
+	}
+	if r := rows(); r != "[B1:3 B2:0]" {
+		t.Errorf("TestImportSqlite(): rows %s after a rollback", r)
+	}
+}
+
+func TestUpdateDeleteSqlite(t *testing.T) {
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE patient_data (
+			patient_key varchar(25) NOT NULL PRIMARY KEY,
+			patient_achternaam varchar(50)
+		)`,
+		`CREATE TABLE behandeling_data (
+			behandeling_key varchar(25) NOT NULL PRIMARY KEY,
+			behandeling_datum date,
+			behandeling_patient varchar(25) REFERENCES patient_data (patient_key)
+		)`,
+		`INSERT INTO patient_data VALUES ('P1', 'Merel'), ('P2', 'Leeuw'), ('P3', 'Vink')`,
+		`INSERT INTO behandeling_data VALUES ('B1', '2014-06-01', 'P1'), ('B2', '2015-03-01', 'P1'), ('B3', '2016-01-01', 'P2')`)
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.LoadEntities()
+	datum := filter.Selectable{Entity: "behandeling", Field: "datum"}
+
+	n, err := registry.Query("behandeling").Filter(datum.Lt("2015-06-01")).
+		Update(map[string]interface{}{"patient": "P3"})
+	if err != nil || n != 2 {
+		t.Errorf("TestUpdateDeleteSqlite(): update %d %v", n, err)
+	}
+	r := queryStrings(t, engine, "SELECT behandeling_key || ':' || behandeling_patient FROM behandeling_data ORDER BY behandeling_key")
+	if r != "[B1:P3 B2:P3 B3:P2]" {
+		t.Errorf("TestUpdateDeleteSqlite(): rows %s", r)
+	}
+
+	n, err = registry.Query("patient").Filter(filter.NotExists(registry.Query("behandeling"))).Delete()
+	if err != nil || n != 1 {
+		t.Errorf("TestUpdateDeleteSqlite(): delete %d %v", n, err)
+	}
+	if r := queryStrings(t, engine, "SELECT patient_key FROM patient_data ORDER BY patient_key"); r != "[P2 P3]" {
+		t.Errorf("TestUpdateDeleteSqlite(): rows %s", r)
+	}
+}
+
+func TestUpsertSql(t *testing.T) {
+	registry := makeFilterRegistry()
+	patient := registry.Entity("patient")
+	keys := upsertKeys(patient)
+	columns := []string{"patient_achternaam", "patient_key"}
+	for d, expected := range map[dialect]string{
+		"mysql": "INSERT INTO patient_data (patient_achternaam, patient_key) VALUES (?, ?), (?, ?)" +
+			" ON DUPLICATE KEY UPDATE patient_achternaam = VALUES(patient_achternaam)",
+		"sqlite": "INSERT INTO patient_data (patient_achternaam, patient_key) VALUES (?, ?), (?, ?)" +
+			" ON CONFLICT (patient_key) DO UPDATE SET patient_achternaam = excluded.patient_achternaam",
+		"mssql": "MERGE INTO patient_data AS target USING (VALUES (?, ?), (?, ?)) AS source" +
+			" (patient_achternaam, patient_key) ON target.patient_key = source.patient_key" +
+			" WHEN MATCHED THEN UPDATE SET patient_achternaam = source.patient_achternaam" +
+			" WHEN NOT MATCHED THEN INSERT (patient_achternaam, patient_key)" +
+			" VALUES (source.patient_achternaam, source.patient_key);",
+	} {
+		sql, err := d.upsertSql(patient, keys, columns, 2)
+		if err != nil || sql != expected {
+			t.Errorf("TestUpsertSql(%s): %s %v", d, sql, err)
+		}
+	}
+	if sql, _ := dialect("postgres").upsertSql(patient, keys, []string{"patient_key"}, 1); sql !=
+		"INSERT INTO patient_data (patient_key) VALUES (?) ON CONFLICT (patient_key) DO NOTHING" {
+		t.Errorf("TestUpsertSql(postgres): %s", sql)
+	}
+	if _, err := dialect("mysql").upsertSql(patient, keys, []string{"patient_achternaam"}, 1); err == nil {
+		t.Errorf("TestUpsertSql(): expected an error without key columns")
+	}
+
+	lookup := NewEntity("lookup_data")
+	lookup.Fields["lookup_code"] = &EntityField{Name: "lookup_code", Type: "varchar(10)"}
+	lookup.Indexes["lookup_code"] = &TableIndex{Name: "lookup_code", Columns: []string{"lookup_code"}, Unique: true}
+	if keys := upsertKeys(lookup); fmt.Sprint(keys) != "[lookup_code]" {
+		t.Errorf("TestUpsertSql(): unique index keys %v", keys)
+	}
+
+	m := NewPatient("patient").(*Patient)
+	m.SetRegistry(registry)
+	m.Achternaam = "Leeuwerik"
+	m.Fields()["key"] = &FieldValue{value: "P1"}
+	values := modelValues(patient, "patient_", m)
+	if len(values) != 2 || values["patient_key"] != "P1" || values["patient_achternaam"] != "Leeuwerik" {
+		t.Errorf("TestUpsertSql(): values %v", values)
+	}
+
+	recorder := &execRecorder{}
+	inserter := &batchInserter{db: recorder, entity: patient, limit: dialect("mssql").maxParams(),
+		maxRows: dialect("mssql").maxRows()}
+	for i := 0; i < 1500; i++ {
+		if _, err := inserter.add(map[string]interface{}{"patient_key": i, "patient_achternaam": "x", "patient_geslacht": "M"}); err != nil {
+			t.Fatalf("TestUpsertSql(): %s", err.Error())
+		}
+	}
+	inserter.flush()
+	sizes := make([]int, 0)
+	for _, params := range recorder.params {
+		sizes = append(sizes, len(params)/3)
+	}
+	if fmt.Sprint(sizes) != "[699 699 102]" {
+		t.Errorf("TestUpsertSql(): MSSQL batches of %v rows", sizes)
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE patient_data (patient_key varchar(25) PRIMARY KEY, patient_achternaam varchar(50))`,
+		`CREATE TABLE lookup_data (lookup_code varchar(10) NOT NULL UNIQUE, lookup_omschrijving varchar(50))`)
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.LoadEntities()
+
+	patients := make([]IModel, 0)
+	for i, naam := range []string{"Leeuwerik", "Merel"} {
+		p := NewPatient("patient").(*Patient)
+		p.Achternaam = naam
+		p.Fields()["key"] = &FieldValue{value: fmt.Sprintf("P%d", i+1)}
+		patients = append(patients, p)
+	}
+	if n, err := registry.InsertMany("patient", patients); n != 2 || err != nil {
+		t.Fatalf("TestInsertMany(): %d %v", n, err)
+	}
+	if names := queryStrings(t, engine, "SELECT patient_achternaam FROM patient_data ORDER BY patient_key"); names != "[Leeuwerik Merel]" {
+		t.Errorf("TestInsertMany(): %s", names)
+	}
+	if _, err := registry.InsertMany("patient", []IModel{NewModel("patient")}); err == nil {
+		t.Errorf("TestInsertMany(): expected an error for a model without fields")
+	}
+
+	// Rows of a table without a primary key are matched on a unique index.
+	for _, omschrijving := range []string{"man", "mannelijk"} {
+		m := NewModel("lookup")
+		m.Fields()["code"] = &FieldValue{value: "M"}
+		m.Fields()["omschrijving"] = &FieldValue{value: omschrijving}
+		if n, err := registry.Upsert("lookup", []IModel{m}); n != 1 || err != nil {
+			t.Fatalf("TestInsertMany(): Upsert %d %v", n, err)
+		}
+	}
+	if rows := queryStrings(t, engine, "SELECT lookup_omschrijving FROM lookup_data"); rows != "[mannelijk]" {
+		t.Errorf("TestInsertMany(): Upsert %s", rows)
+	}
+}
+
+// queryStrings returns the values of the first column of the rows of query.
+func queryStrings(t *testing.T, engine *Engine, query string) string {
+	rows, err := engine.Db().Query(query)
+	if err != nil {
+		t.Fatalf("queryStrings(): %s", err.Error())
+	}
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		values = append(values, s)
+	}
+	return fmt.Sprint(values)
+}
+
+func TestUpdateDeleteSql(t *testing.T) {
+	registry := makeFilterRegistry()
+	before := filter.NewFilter(filter.Selectable{Entity: "behandeling", Field: "datum"}.Lt("2015-01-01"))
+
+	sql, params, err := registry.Query("behandeling").Filter(before).
+		UpdateSql(map[string]interface{}{"patient": "P2", "behandeling_datum": nil})
+	expected := "UPDATE behandeling_data SET behandeling_datum = ?, behandeling_patient = ?" +
+		" WHERE behandeling_data.behandeling_datum < ?"
+	if err != nil || sql != expected || fmt.Sprint(params) != "[<nil> P2 2015-01-01]" {
+		t.Errorf("TestUpdateDeleteSql(): %s %v %v", sql, params, err)
+	}
+	if _, _, err := registry.Query("behandeling").Filter(before).UpdateSql(map[string]interface{}{"arts": "X"}); err == nil {
+		t.Errorf("TestUpdateDeleteSql(): expected an error for an unknown field")
+	}
+
+	sql, params, err = registry.Query("behandeling").Filter(before).DeleteSql()
+	if err != nil || sql != "DELETE FROM behandeling_data WHERE behandeling_data.behandeling_datum < ?" ||
+		fmt.Sprint(params) != "[2015-01-01]" {
+		t.Errorf("TestUpdateDeleteSql(): %s %v %v", sql, params, err)
+	}
+
+	if _, err := registry.Query("behandeling").Delete(); err != ErrNoFilter {
+		t.Errorf("TestUpdateDeleteSql(): expected ErrNoFilter, got %v", err)
+	}
+	if _, err := registry.Query("behandeling").Update(map[string]interface{}{"patient": "P2"}); err != ErrNoFilter {
+		t.Errorf("TestUpdateDeleteSql(): expected ErrNoFilter, got %v", err)
+	}
+	if sql, _, err := registry.Query("behandeling").Force().DeleteSql(); err != nil || sql != "DELETE FROM behandeling_data" {
+		t.Errorf("TestUpdateDeleteSql(): forced %s %v", sql, err)
+	}
+	// Empty connectives are no conditions either.
+	for _, f := range []interface{}{filter.NewFilter(filter.And()), filter.And(), And()} {
+		if _, _, err := registry.Query("behandeling").Filter(f).DeleteSql(); err != ErrNoFilter {
+			t.Errorf("TestUpdateDeleteSql(): expected ErrNoFilter for %v, got %v", f, err)
+		}
+		if sql, _, err := registry.Query("behandeling").Filter(f).Force().DeleteSql(); err != nil || sql != "DELETE FROM behandeling_data" {
+			t.Errorf("TestUpdateDeleteSql(): forced %s %v", sql, err)
+		}
+	}
+	// Subqueries may refer to other models.
+	sql, params, err = registry.Query("patient").Filter(filter.NotExists(
+		registry.Query("behandeling").Filter(before))).DeleteSql()
+	expected = "DELETE FROM patient_data WHERE NOT EXISTS (SELECT 1 FROM behandeling_data" +
+		" WHERE behandeling_data.behandeling_datum < ? AND behandeling_data.behandeling_patient = patient_data.patient_key)"
+	if err != nil || sql != expected || fmt.Sprint(params) != "[2015-01-01]" {
+		t.Errorf("TestUpdateDeleteSql(): %s %v %v", sql, params, err)
+	}
+
+	// Conditions on unknown fields and models are refused.
+	for _, f := range []interface{}{
+		filter.NewFilter(filter.Selectable{Entity: "behandeling", Field: "arts"}.Eq("X")),
+		filter.Or(filter.Selectable{Entity: "behandeling", Field: "datum"}.IsNull(),
+			filter.Selectable{Entity: "arts", Field: "naam"}.Eq("X")),
+		registry.Entity("behandeling").Col("arts").Eq("X"),
+		"1 = 1",
+		// Conditions on another model than that of the query.
+		filter.NewFilter(filter.Selectable{Entity: "patient", Field: "achternaam"}.Eq("X")),
+		filter.And(filter.Selectable{Entity: "behandeling", Field: "datum"}.IsNull(),
+			filter.Not(filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M"))),
+		registry.Entity("patient").Col("patient_achternaam").Eq("X"),
+	} {
+		if _, _, err := registry.Query("behandeling").Filter(f).DeleteSql(); err == nil {
+			t.Errorf("TestUpdateDeleteSql(): %v accepted", f)
+		}
+		if _, err := registry.Query("behandeling").Filter(f).Update(map[string]interface{}{"patient": "P2"}); err == nil {
+			t.Errorf("TestUpdateDeleteSql(): %v accepted", f)
+		}
+	}
+}
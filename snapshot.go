@@ -0,0 +1,222 @@
+package toumin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version     int                       `json:"version"`
+	Driver      string                    `json:"driver"`
+	Checksum    string                    `json:"checksum,omitempty"`
+	TablePrefix string                    `json:"tablePrefix,omitempty"`
+	TableSuffix string                    `json:"tableSuffix,omitempty"`
+	FieldPrefix string                    `json:"fieldPrefix,omitempty"`
+	Entities    map[string]snapshotEntity `json:"entities"`
+}
+
+type snapshotEntity struct {
+	Name          string                   `json:"name"`
+	Fields        []snapshotField          `json:"fields"`
+	Indexes       map[string]snapshotIndex `json:"indexes,omitempty"`
+	Relationships []snapshotRelationship   `json:"relationships,omitempty"`
+}
+
+type snapshotField struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Length  int    `json:"length,omitempty"`
+	Key     bool   `json:"key,omitempty"`
+	Null    bool   `json:"null,omitempty"`
+	Default string `json:"default,omitempty"`
+}
+
+type snapshotIndex struct {
+	Name    string   `json:"name,omitempty"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique,omitempty"`
+}
+
+type snapshotRelationship struct {
+	ForeignKey       string `json:"foreignKey"`
+	ReferencedTable  string `json:"referencedTable"`
+	ReferencedColumn string `json:"referencedColumn"`
+}
+
+// SaveSnapshot writes the registered entities, with their fields, indexes
+// and relationships, to w as JSON. If the driver is a SchemaChecksummer,
+// the snapshot includes the checksum of the schema of the database, for
+// SnapshotStale.
+func (r *Registry) SaveSnapshot(w io.Writer) error {
+	checksum := ""
+	if r.engine != nil && r.engine.Driver() != nil {
+		if engine, err := r.Engine(); err == nil {
+			checksum, _ = engine.SchemaChecksum()
+		}
+	}
+	if err := r.writeSnapshot(w, checksum); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.checksum = checksum
+	r.mu.Unlock()
+	return nil
+}
+
+// writeSnapshot writes the registered entities to w with the schema checksum.
+func (r *Registry) writeSnapshot(w io.Writer, checksum string) error {
+	s := snapshot{
+		Version:     snapshotVersion,
+		Checksum:    checksum,
+		TablePrefix: r.tablePrefix,
+		TableSuffix: r.tableSuffix,
+		FieldPrefix: r.fieldPrefix,
+		Entities:    make(map[string]snapshotEntity),
+	}
+	if r.engine != nil && r.engine.Driver() != nil {
+		s.Driver = r.engine.Driver().Name()
+	}
+
+	for model, entity := range r.entityMap() {
+		e := snapshotEntity{Name: entity.Name, Indexes: make(map[string]snapshotIndex)}
+		for _, name := range entity.ColumnNames() {
+			f := entity.Fields[name]
+			e.Fields = append(e.Fields, snapshotField{Name: f.Name, Type: f.Type, Length: f.Length,
+				Key: f.Key, Null: f.Null, Default: f.Default})
+		}
+		for name, index := range entity.Indexes {
+			e.Indexes[name] = snapshotIndex{Name: index.Name, Columns: index.Columns, Unique: index.Unique}
+		}
+		for _, fk := range sortedForeignKeys(entity) {
+			rel := entity.Relationships[fk]
+			e.Relationships = append(e.Relationships, snapshotRelationship{ForeignKey: rel.ForeignKey,
+				ReferencedTable: rel.ReferencedTable, ReferencedColumn: rel.ReferencedColumn})
+		}
+		s.Entities[model] = e
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// LoadSnapshot replaces the registered entities with those of a snapshot
+// written by SaveSnapshot, so the database need not be introspected.
+// The table and field affixes of the snapshot must match those of the registry.
+func (r *Registry) LoadSnapshot(rd io.Reader) error {
+	entities, checksum, err := r.readSnapshot(rd)
+	if err != nil {
+		return err
+	}
+	r.setEntities(entities, checksum)
+	return nil
+}
+
+// readSnapshot returns the entities and the schema checksum of the
+// snapshot in rd.
+func (r *Registry) readSnapshot(rd io.Reader) (map[string]*Entity, string, error) {
+	var s snapshot
+	if err := json.NewDecoder(rd).Decode(&s); err != nil {
+		return nil, "", err
+	}
+	if s.Version != snapshotVersion {
+		return nil, "", fmt.Errorf("Unsupported snapshot version %d", s.Version)
+	}
+	if s.TablePrefix != r.tablePrefix || s.TableSuffix != r.tableSuffix || s.FieldPrefix != r.fieldPrefix {
+		return nil, "", fmt.Errorf("Snapshot affixes (%q, %q, %q) differ from those of the registry",
+			s.TablePrefix, s.TableSuffix, s.FieldPrefix)
+	}
+
+	entities := make(map[string]*Entity)
+	for model, e := range s.Entities {
+		entity := NewEntity(e.Name)
+		for _, f := range e.Fields {
+			entity.Fields[f.Name] = &EntityField{Name: f.Name, Type: f.Type, Length: f.Length,
+				Key: f.Key, Null: f.Null, Default: f.Default}
+		}
+		for name, index := range e.Indexes {
+			entity.Indexes[name] = &TableIndex{Name: index.Name, Columns: index.Columns, Unique: index.Unique}
+		}
+		for _, rel := range e.Relationships {
+			entity.AddRelationship(EntityRelationship{ForeignKey: rel.ForeignKey,
+				ReferencedTable: rel.ReferencedTable, ReferencedColumn: rel.ReferencedColumn})
+		}
+		entity.registry = r
+		entities[model] = entity
+	}
+	return entities, s.Checksum, nil
+}
+
+// SnapshotStale reports whether the schema of the database differs from
+// the snapshot that was last loaded or saved. A snapshot is stale if
+// either checksum is unknown.
+func (r *Registry) SnapshotStale() (bool, error) {
+	r.mu.RLock()
+	snapshot := r.checksum
+	r.mu.RUnlock()
+	return r.stale(snapshot)
+}
+
+// stale reports whether the schema of the database differs from the
+// snapshot with checksum snapshot.
+func (r *Registry) stale(snapshot string) (bool, error) {
+	if snapshot == "" {
+		return true, nil
+	}
+	engine, err := r.Engine()
+	if err != nil {
+		return true, err
+	}
+	checksum, err := engine.SchemaChecksum()
+	if err != nil {
+		return true, err
+	}
+	return checksum != snapshot, nil
+}
+
+// LoadEntitiesSnapshot loads the entities from the snapshot file path if
+// it is up to date, and otherwise introspects the database with
+// LoadEntities and saves a new snapshot to path. Like LoadEntities, it
+// keeps the entities that are registered otherwise, for instance with
+// RegisterStruct, unless the database has a table for the same model, and
+// replaces the entities at once.
+func (r *Registry) LoadEntitiesSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err == nil {
+		entities, checksum, err := r.readSnapshot(f)
+		f.Close()
+		if err == nil {
+			if stale, _ := r.stale(checksum); !stale {
+				r.addEntities(entities, &checksum)
+				return nil
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	engine, err := r.Engine()
+	if err != nil {
+		return err
+	}
+	// The checksum is taken before the introspection, so that the snapshot
+	// is stale if the schema changes in the meantime.
+	checksum, _ := engine.SchemaChecksum()
+	r.addEntities(r.introspect(engine), &checksum)
+	f, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.writeSnapshot(f, checksum); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
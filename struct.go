@@ -0,0 +1,281 @@
+package toumin
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// TagError reports an invalid db tag on a struct field.
+type TagError struct {
+	Struct string
+	Field  string
+	Tag    string
+	Msg    string
+}
+
+func (e TagError) Error() string {
+	return fmt.Sprintf("Invalid db tag on %s.%s `db:\"%s\"`: %s", e.Struct, e.Field, e.Tag, e.Msg)
+}
+
+// EntityFromStruct builds the entity of model from the db tags of the
+// fields of v, a struct or a pointer to one:
+//
+//	type Patient struct {
+//		*toumin.Model
+//		Key        string  `db:"varchar(25), PK"`
+//		Achternaam string  `db:"varchar(50), INDEX"`
+//		Geslacht   *string `db:"char(1), NULL, DEFAULT(O)"`
+//		Huisarts   string  `db:"varchar(25), FK(relatie:key, name=patient_huisarts)"`
+//		Arts       *Relatie       `db:"ManyToOne(relatie, huisarts)"`
+//		Behandelingen []*Behandeling `db:"OneToMany(behandeling)"`
+//	}
+//
+// Only tagged fields are columns. The column of a field is its name with
+// underscores and the field prefix of the registry (patient_achternaam),
+// unless the tag has name=column. The tag lists, separated by commas:
+//
+//	a database type        varchar(25); if omitted, it follows from the Go type
+//	PK                     the column is (part of) the primary key
+//	NULL                   the column is nullable; so are pointer fields
+//	DEFAULT(value)         the default value of the column
+//	UNIQUE, UNIQUE(index)  a unique index on the column, or on all columns with the same index name
+//	INDEX, INDEX(index)    an index on the column, or on all columns with the same index name
+//	FK(model:field)        a foreign key to field of model
+//	ManyToOne(model, fk)   the field holds the model that foreign key fk (default: the field name) refers to
+//	OneToMany(model)       the field holds the models of model that refer to this model
+//
+// ManyToOne and OneToMany fields are not columns: the relationship is
+// that of the foreign key. A tag "-" is ignored. Model.Scan and InsertMany
+// bind the columns to the fields they are built from, also if a column
+// is named with name=.
+func (r *Registry) EntityFromStruct(model string, v interface{}) (*Entity, error) {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("EntityFromStruct: %T is not a struct", v)
+	}
+
+	entity := NewEntity(r.TableName(model))
+	manyToOne := make(map[string][2]string) // fk -> model, struct field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("db")
+		if !ok || tag == "-" || !sf.IsExported() {
+			continue
+		}
+		tagError := func(format string, args ...interface{}) error {
+			return TagError{Struct: t.Name(), Field: sf.Name, Tag: tag, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		field := &EntityField{Name: r.ColumnName(model, Camel2Underscore(sf.Name))}
+		var relationship *EntityRelationship
+		var indexes []string
+		isColumn := true
+
+		for _, item := range splitTag(tag) {
+			keyword, args := tagItem(item)
+			switch strings.ToUpper(keyword) {
+			case "PK":
+				field.Key = true
+			case "NULL":
+				field.Null = true
+			case "DEFAULT":
+				field.Default = args
+			case "UNIQUE", "INDEX":
+				name := args
+				if name == "" {
+					name = "*"
+				}
+				if strings.ToUpper(keyword) == "UNIQUE" {
+					name = "!" + name
+				}
+				indexes = append(indexes, name)
+			case "FK":
+				ref := strings.Split(splitTag(args)[0], ":")
+				if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+					return nil, tagError("FK needs model:field")
+				}
+				relationship = &EntityRelationship{
+					ReferencedTable:  r.TableName(ref[0]),
+					ReferencedColumn: r.ColumnName(ref[0], ref[1]),
+				}
+				for _, arg := range splitTag(args)[1:] {
+					if name, ok := strings.CutPrefix(arg, "name="); ok {
+						field.Name = strings.TrimSpace(name)
+					} else {
+						return nil, tagError("unknown FK argument %q", arg)
+					}
+				}
+			case "MANYTOONE":
+				l := splitTag(args)
+				if l[0] == "" || len(l) > 2 {
+					return nil, tagError("ManyToOne needs a model and an optional foreign key")
+				}
+				fk := Camel2Underscore(sf.Name)
+				if len(l) == 2 {
+					fk = l[1]
+				}
+				manyToOne[r.ColumnName(model, fk)] = [2]string{l[0], sf.Name}
+				isColumn = false
+			case "ONETOMANY":
+				if args == "" {
+					return nil, tagError("OneToMany needs a model")
+				}
+				isColumn = false
+			default:
+				if name, ok := strings.CutPrefix(item, "name="); ok {
+					field.Name = strings.TrimSpace(name)
+				} else if field.Type == "" && strings.Index(item, "=") < 0 {
+					field.Type = item
+				} else {
+					return nil, tagError("unknown option %q", item)
+				}
+			}
+		}
+		if !isColumn {
+			continue
+		}
+
+		if field.Type == "" {
+			if field.Type = goColumnType(sf.Type); field.Type == "" {
+				return nil, tagError("no database type for %s", sf.Type)
+			}
+		}
+		field.Length = typeLength(field.Type)
+		if sf.Type.Kind() == reflect.Pointer {
+			field.Null = true
+		}
+		if _, ok := entity.Fields[field.Name]; ok {
+			return nil, tagError("duplicate column %s", field.Name)
+		}
+		entity.Fields[field.Name] = field
+		if entity.structFields == nil {
+			entity.structFields = make(map[string]string)
+		}
+		entity.structFields[field.Name] = sf.Name
+		if relationship != nil {
+			relationship.ForeignKey = field.Name
+			entity.AddRelationship(*relationship)
+		}
+		for _, name := range indexes {
+			unique := strings.HasPrefix(name, "!")
+			name = strings.TrimPrefix(name, "!")
+			if name == "*" {
+				name = field.Name
+			}
+			index, ok := entity.Indexes[name]
+			if !ok {
+				index = &TableIndex{Name: name}
+				entity.Indexes[name] = index
+			}
+			index.Columns = append(index.Columns, field.Name)
+			index.Unique = index.Unique || unique
+		}
+	}
+
+	for fk, m := range manyToOne {
+		ref := m[0]
+		if _, ok := entity.Fields[fk]; !ok {
+			sf, _ := t.FieldByName(m[1])
+			return nil, TagError{Struct: t.Name(), Field: m[1], Tag: sf.Tag.Get("db"),
+				Msg: fmt.Sprintf("no column %s", fk)}
+		}
+		if _, ok := entity.Relationship(fk); ok {
+			continue
+		}
+		column := r.ColumnName(ref, "key")
+		if e := r.Entity(ref); e != nil && e.Key() != nil {
+			column = e.Key().Name
+		}
+		entity.AddRelationship(EntityRelationship{
+			ForeignKey:       fk,
+			ReferencedTable:  r.TableName(ref),
+			ReferencedColumn: column,
+		})
+	}
+	return entity, nil
+}
+
+// RegisterStruct registers the entity that EntityFromStruct builds from
+// the model type T, so that toumin can be used without introspecting the
+// database. If no constructor is registered for the model, that of T is.
+func RegisterStruct[T IModel](r *Registry) error {
+	name, err := ModelName[T](r)
+	if err != nil {
+		return err
+	}
+	entity, err := r.EntityFromStruct(name, reflect.Zero(reflect.TypeFor[T]()).Interface())
+	if err != nil {
+		return err
+	}
+	r.RegisterEntity(name, entity)
+	r.registerModelIfAbsent(name, TypedConstructor[T]())
+	return nil
+}
+
+// splitTag splits a db tag at the commas outside parentheses.
+func splitTag(tag string) []string {
+	items := make([]string, 0)
+	depth, start := 0, 0
+	for i, c := range tag {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(tag[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(tag[start:]))
+}
+
+// tagItem splits an item of a db tag in a keyword and its arguments:
+// "FK(relatie:key)" -> "FK", "relatie:key".
+func tagItem(item string) (keyword, args string) {
+	i := strings.Index(item, "(")
+	if i < 0 || !strings.HasSuffix(item, ")") {
+		return item, ""
+	}
+	return strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1 : len(item)-1])
+}
+
+// goColumnType returns the database type of a field with Go type t.
+func goColumnType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[time.Time]() {
+		return "datetime"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "varchar(255)"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int8, reflect.Uint8:
+		return "tinyint"
+	case reflect.Int16, reflect.Uint16:
+		return "smallint"
+	case reflect.Int, reflect.Int32, reflect.Uint32:
+		return "int"
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "bigint"
+	case reflect.Float32:
+		return "float"
+	case reflect.Float64:
+		return "double"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "blob"
+		}
+	}
+	return ""
+}
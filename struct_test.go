@@ -0,0 +1,137 @@
+package toumin
+
+import (
+	"errors"
+	"testing"
+)
+
+type Arts struct {
+	*Model
+	Key  string `db:"varchar(25), PK"`
+	Naam string `db:"varchar(50), UNIQUE"`
+}
+
+type Consult struct {
+	*Model
+	Key         string  `db:"varchar(25), PK"`
+	Datum       string  `db:"date, INDEX(consult_datum_arts)"`
+	Arts        string  `db:"varchar(25), INDEX(consult_datum_arts), FK(arts:key, name=consult_behandelaar)"`
+	Patient     string  `db:"varchar(25)"`
+	Toelichting *string `db:"text"`
+	Duur        int     `db:"DEFAULT(15)"`
+	Betaald     bool    `db:""`
+	Notitie     string
+	Behandelaar *Arts    `db:"ManyToOne(arts, behandelaar)"`
+	PatientRef  *Patient `db:"ManyToOne(patient, patient)"`
+	Ignored     string   `db:"-"`
+}
+
+func TestEntityFromStruct(t *testing.T) {
+	registry := NewRegistry(makeEngine())
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	if err := RegisterStruct[*Arts](registry); err != nil {
+		t.Fatalf("TestEntityFromStruct(): %s", err.Error())
+	}
+	if err := RegisterStruct[*Consult](registry); err != nil {
+		t.Fatalf("TestEntityFromStruct(): %s", err.Error())
+	}
+	if _, ok := registry.Model("consult")("consult").(*Consult); !ok {
+		t.Errorf("TestEntityFromStruct(): no constructor registered")
+	}
+
+	consult := registry.Entity("consult")
+	if consult == nil || consult.Name != "consult_data" {
+		t.Fatalf("TestEntityFromStruct(): entity %v", consult)
+	}
+	if len(consult.Fields) != 7 {
+		t.Errorf("TestEntityFromStruct(): %d fields", len(consult.Fields))
+	}
+	for name, expected := range map[string]EntityField{
+		"consult_key":         {Name: "consult_key", Type: "varchar(25)", Length: 25, Key: true},
+		"consult_behandelaar": {Name: "consult_behandelaar", Type: "varchar(25)", Length: 25},
+		"consult_toelichting": {Name: "consult_toelichting", Type: "text", Null: true},
+		"consult_duur":        {Name: "consult_duur", Type: "int", Default: "15"},
+		"consult_betaald":     {Name: "consult_betaald", Type: "bool"},
+	} {
+		if field := consult.Fields[name]; field == nil || *field != expected {
+			t.Errorf("TestEntityFromStruct(): field %s: %v", name, field)
+		}
+	}
+	if r, ok := consult.Relationship("consult_behandelaar"); !ok || r.ReferencedTable != "arts_data" ||
+		r.ReferencedColumn != "arts_key" {
+		t.Errorf("TestEntityFromStruct(): relationship %v", r)
+	}
+	if r, ok := consult.Relationship("consult_patient"); !ok || r.ReferencedTable != "patient_data" {
+		t.Errorf("TestEntityFromStruct(): relationship %v", r)
+	}
+	if index := consult.Indexes["consult_datum_arts"]; index == nil || len(index.Columns) != 2 || index.Unique {
+		t.Errorf("TestEntityFromStruct(): index %v", index)
+	}
+	if index := registry.Entity("arts").Indexes["arts_naam"]; index == nil || !index.Unique {
+		t.Errorf("TestEntityFromStruct(): unique index %v", index)
+	}
+}
+
+// Verwijzing has columns that are not the names of their fields with
+// underscores: verwijzing_arts_id and verwijzing_omschrijving.
+type Verwijzing struct {
+	*Model
+	Key    string `db:"varchar(25), PK"`
+	ArtsID string `db:"varchar(25)"`
+	Reden  string `db:"varchar(50), name=verwijzing_omschrijving"`
+}
+
+func TestStructColumns(t *testing.T) {
+	engine := makeSqliteEngine(t, `CREATE TABLE verwijzing_data (verwijzing_key varchar(25) PRIMARY KEY,
+		verwijzing_arts_id varchar(25), verwijzing_omschrijving varchar(50))`)
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	if err := RegisterStruct[*Verwijzing](registry); err != nil {
+		t.Fatalf("TestStructColumns(): %s", err.Error())
+	}
+
+	v := registry.Model("verwijzing")("verwijzing").(*Verwijzing)
+	v.Key, v.ArtsID, v.Reden = "V1", "A1", "controle"
+	if n, err := registry.InsertMany("verwijzing", []IModel{v}); n != 1 || err != nil {
+		t.Fatalf("TestStructColumns(): InsertMany %d %v", n, err)
+	}
+	r := queryStrings(t, engine, "SELECT verwijzing_arts_id || ':' || verwijzing_omschrijving FROM verwijzing_data")
+	if r != "[A1:controle]" {
+		t.Errorf("TestStructColumns(): rows %s", r)
+	}
+
+	verwijzingen, err := For[*Verwijzing](registry).All()
+	if err != nil {
+		t.Fatalf("TestStructColumns(): %s", err.Error())
+	}
+	if len(verwijzingen) != 1 || verwijzingen[0].Key != "V1" || verwijzingen[0].ArtsID != "A1" ||
+		verwijzingen[0].Reden != "controle" {
+		t.Errorf("TestStructColumns(): %+v", verwijzingen[0])
+	}
+}
+
+func TestEntityFromStructErrors(t *testing.T) {
+	registry := NewRegistry(makeEngine())
+	for _, v := range []interface{}{
+		struct {
+			Arts string `db:"FK(arts)"`
+		}{},
+		struct {
+			Arts *Arts `db:"ManyToOne(arts)"`
+		}{},
+		struct {
+			Data chan int `db:""`
+		}{},
+		struct {
+			Key string `db:"varchar(25), key=value"`
+		}{},
+	} {
+		_, err := registry.EntityFromStruct("test", v)
+		var tagError TagError
+		if !errors.As(err, &tagError) {
+			t.Errorf("TestEntityFromStructErrors(%T): %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package toumin
+
+import (
+	"fmt"
+
+	"github.com/henkburgstra/toumin/filter"
+)
+
+// registryNames maps the model and field names of a filter to
+// table and column names, using the table affixes and field prefix
+// of the registry.
+type registryNames struct {
+	registry *Registry
+}
+
+// TranslateEntity returns the table name of model e.
+func (n registryNames) TranslateEntity(e string) string {
+	entity := n.registry.Entity(e)
+	if entity == nil {
+		return e
+	}
+	return entity.Name
+}
+
+// TranslateField returns the column name of field f of model e.
+func (n registryNames) TranslateField(e, f string) string {
+	entity := n.registry.Entity(e)
+	if entity == nil {
+		return f
+	}
+	return entity.TranslateModelField(e, f)
+}
+
+// FilterTranslater returns a filter.FilterTranslater that translates
+// filters on models of this registry to SQL:
+//
+//	filter.Selectable{Entity: "patient", Field: "geslacht"}.Eq("M")
+//
+// becomes patient_data.patient_geslacht = ? when the table suffix
+// is "_data" and the field prefix "{model}_".
+// The SQL dialect is that of the registry's engine driver.
+func (r *Registry) FilterTranslater() filter.FilterTranslater {
+	return r.translater("")
+}
+
+// translater returns the Translater for filters of a query on model.
+func (r *Registry) translater(model string) filter.Translater {
+	return filter.Translater{Names: registryNames{r}, Entity: model, Dialect: string(r.dialect())}
+}
+
+// InvalidFilterError reports a condition on a model or field
+// that the registry does not know.
+type InvalidFilterError struct {
+	Model string
+	Field string
+}
+
+func (e InvalidFilterError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Filter refers to unknown model '%s'", e.Model)
+	}
+	return fmt.Sprintf("Filter refers to unknown field '%s' of model '%s'", e.Field, e.Model)
+}
+
+// ValidateFilter checks that every condition of f refers to a registered
+// model and to one of its fields. Validate filters from untrusted input,
+// such as filters decoded from JSON, before passing them to Query.Filter.
+func (r *Registry) ValidateFilter(f *filter.Filter) error {
+	for _, p := range f.Params {
+		if err := r.validateParam(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) validateParam(p interface{}) error {
+	switch e := p.(type) {
+	case *filter.Filter:
+		return r.ValidateFilter(e)
+	case filter.Connective:
+		for _, op := range e.Operands {
+			if err := r.validateParam(op); err != nil {
+				return err
+			}
+		}
+	case filter.Selectable:
+		if _, ok := e.Param.Value.(filter.Subquery); ok && e.Entity == "" {
+			return nil
+		}
+		entity := r.Entity(e.Entity)
+		if entity == nil {
+			return InvalidFilterError{Model: e.Entity}
+		}
+		if _, ok := entity.Fields[entity.TranslateModelField(e.Entity, e.Field)]; !ok {
+			return InvalidFilterError{Model: e.Entity, Field: e.Field}
+		}
+	default:
+		return fmt.Errorf("Filter contains an unknown condition of type %T", p)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package toumin
+
+import (
+	"fmt"
+	"iter"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// AmbiguousModelError is returned by ModelName if more than one
+// registered constructor produces the model type; use ForModel with
+// the name of the model instead.
+type AmbiguousModelError struct {
+	Type   string
+	Models []string
+}
+
+func (e AmbiguousModelError) Error() string {
+	return fmt.Sprintf("Models %s all have type %s", strings.Join(e.Models, ", "), e.Type)
+}
+
+// TypedQuery is a Query whose results are of the model type T,
+// so call sites do not need to cast IModel values.
+//
+//	patients, err := toumin.For[*Patient](registry).Filter(...).All()
+type TypedQuery[T IModel] struct {
+	query *Query
+	err   error
+}
+
+// For returns a TypedQuery for the model type T, with the model name
+// of ModelName. If ModelName fails, the query returns its error.
+func For[T IModel](r *Registry) *TypedQuery[T] {
+	name, err := ModelName[T](r)
+	q := ForModel[T](r, name)
+	q.err = err
+	return q
+}
+
+// ForModel returns a TypedQuery for the model type T, selecting from
+// the model with the given name.
+func ForModel[T IModel](r *Registry, name string) *TypedQuery[T] {
+	q := r.Query(name)
+	if _, ok := r.Model(name)(name).(T); !ok {
+		q.SetConstructor(TypedConstructor[T]())
+	}
+	return &TypedQuery[T]{query: q}
+}
+
+// ModelName returns the name of the model with type T: that of the
+// constructor registered for T. If no constructor produces a T, the
+// name is derived from the struct type:
+// *BehandeldagVerrichtingen -> behandeldag_verrichtingen.
+// If several constructors produce a T, ModelName returns an
+// AmbiguousModelError.
+func ModelName[T IModel](r *Registry) (string, error) {
+	names := make([]string, 0)
+	for name, constructor := range r.modelConstructors() {
+		if _, ok := constructor(name).(T); ok {
+			names = append(names, name)
+		}
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		return names[0], nil
+	default:
+		sort.Strings(names)
+		return "", AmbiguousModelError{Type: reflect.TypeFor[T]().String(), Models: names}
+	}
+	t := reflect.TypeFor[T]()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return Camel2Underscore(t.Name()), nil
+}
+
+// TypedConstructor returns a ModelConstructor for T, a pointer to a struct
+// that embeds *Model, like the hand-written constructors:
+//
+//	func NewPatient(name string) IModel {
+//		p := new(Patient)
+//		p.Model = NewModel(name).(*Model)
+//		p.Model.SetOwner(p)
+//		return p
+//	}
+//
+// If T does not embed *Model, the constructor returns a plain *Model.
+func TypedConstructor[T IModel]() ModelConstructor {
+	t := reflect.TypeFor[T]()
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return NewModel
+	}
+	embedded, ok := t.Elem().FieldByName("Model")
+	if !ok || !embedded.Anonymous || embedded.Type != reflect.TypeFor[*Model]() {
+		return NewModel
+	}
+	return func(name string) IModel {
+		v := reflect.New(t.Elem())
+		model := NewModel(name).(*Model)
+		v.Elem().FieldByIndex(embedded.Index).Set(reflect.ValueOf(model))
+		m := v.Interface().(IModel)
+		model.SetOwner(m)
+		return m
+	}
+}
+
+// Query returns the underlying untyped Query.
+func (q *TypedQuery[T]) Query() *Query {
+	return q.query
+}
+
+// Filter sets the conditions of the query. See Query.Filter.
+func (q *TypedQuery[T]) Filter(f ...interface{}) *TypedQuery[T] {
+	q.query.Filter(f...)
+	return q
+}
+
+// Where adds conditions to the query. See Query.Where.
+func (q *TypedQuery[T]) Where(f ...interface{}) *TypedQuery[T] {
+	q.query.Where(f...)
+	return q
+}
+
+// FromSql sets the SQL of the query. See Query.FromSql.
+func (q *TypedQuery[T]) FromSql(sql string, params ...interface{}) *TypedQuery[T] {
+	q.query.FromSql(sql, params...)
+	return q
+}
+
+// ReuseModel enables model reuse for Each and Iter. See Query.ReuseModel.
+func (q *TypedQuery[T]) ReuseModel(reuse bool) *TypedQuery[T] {
+	q.query.ReuseModel(reuse)
+	return q
+}
+
+// Force allows Update and Delete without conditions. See Query.Force.
+func (q *TypedQuery[T]) Force() *TypedQuery[T] {
+	q.query.Force()
+	return q
+}
+
+// Update updates the models selected by the query. See Query.Update.
+func (q *TypedQuery[T]) Update(values map[string]interface{}) (int64, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	return q.query.Update(values)
+}
+
+// Delete deletes the models selected by the query. See Query.Delete.
+func (q *TypedQuery[T]) Delete() (int64, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	return q.query.Delete()
+}
+
+// Sql returns the SQL of the query, or the error of For.
+func (q *TypedQuery[T]) Sql() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	return q.query.Sql(), nil
+}
+
+// Get returns the model with key keyValue. It returns sql.ErrNoRows
+// if there is none, and an error if the model cannot be retrieved or
+// is not a T.
+func (q *TypedQuery[T]) Get(keyValue interface{}) (T, error) {
+	var zero T
+	if q.err != nil {
+		return zero, q.err
+	}
+	m, err := q.query.get(keyValue)
+	if err != nil {
+		return zero, err
+	}
+	return q.cast(m)
+}
+
+// All returns all models selected by the query. It returns an error if
+// the query fails or returns a model that is not a T.
+func (q *TypedQuery[T]) All() ([]T, error) {
+	models := make([]T, 0)
+	for t, err := range q.Iter() {
+		if err != nil {
+			return models, err
+		}
+		models = append(models, t)
+	}
+	return models, nil
+}
+
+// Each calls fn for every model selected by the query. It returns an
+// error if the query returns a model that is not a T.
+func (q *TypedQuery[T]) Each(fn func(T) error) error {
+	if q.err != nil {
+		return q.err
+	}
+	return q.query.Each(func(m IModel) error {
+		t, err := q.cast(m)
+		if err != nil {
+			return err
+		}
+		return fn(t)
+	})
+}
+
+// Iter returns an iterator over the models selected by the query.
+// A model that is not a T ends the iteration with an error.
+func (q *TypedQuery[T]) Iter() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if q.err != nil {
+			yield(zero, q.err)
+			return
+		}
+		for m, err := range q.query.Iter() {
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			t, err := q.cast(m)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(t, nil) {
+				return
+			}
+		}
+	}
+}
+
+// cast returns m as a T, or an error if it is not one.
+func (q *TypedQuery[T]) cast(m IModel) (T, error) {
+	t, ok := m.(T)
+	if !ok {
+		return t, fmt.Errorf("Model '%s' is a %T, not a %s", q.query.Model(), m, reflect.TypeFor[T]())
+	}
+	return t, nil
+}
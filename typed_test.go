@@ -0,0 +1,132 @@
+package toumin
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+type Relatie struct {
+	*Model
+	Naam string
+}
+
+func TestCamel2Underscore(t *testing.T) {
+	for camel, underscores := range map[string]string{
+		"Patient":                  "patient",
+		"BehandeldagVerrichtingen": "behandeldag_verrichtingen",
+		"PatientID":                "patient_id",
+	} {
+		if s := Camel2Underscore(camel); s != underscores {
+			t.Errorf("Camel2Underscore(%q) = %q, want %q", camel, s, underscores)
+		}
+	}
+}
+
+func TestModelName(t *testing.T) {
+	registry := NewRegistry(makeEngine())
+	if name, err := ModelName[*BehandeldagVerrichtingen](registry); err != nil || name != "behandeldag_verrichtingen" {
+		t.Errorf("TestModelName(): %s, %v", name, err)
+	}
+	registry.RegisterModel("pat", NewPatient)
+	if name, err := ModelName[*Patient](registry); err != nil || name != "pat" {
+		t.Errorf("TestModelName(): registered name %s, %v", name, err)
+	}
+
+	registry.RegisterModel("patient", NewPatient)
+	_, err := ModelName[*Patient](registry)
+	if e, ok := err.(AmbiguousModelError); !ok || strings.Join(e.Models, " ") != "pat patient" {
+		t.Errorf("TestModelName(): expected an AmbiguousModelError, got %v", err)
+	}
+	if _, err := For[*Patient](registry).All(); err == nil {
+		t.Errorf("TestModelName(): For of an ambiguous type returns no error")
+	}
+	if _, err := For[*Patient](registry).Sql(); err == nil {
+		t.Errorf("TestModelName(): Sql of an ambiguous type returns no error")
+	}
+}
+
+func TestTypedQueryType(t *testing.T) {
+	engine := makeSqliteEngine(t,
+		`CREATE TABLE relatie_data (relatie_key varchar(25) PRIMARY KEY, relatie_naam varchar(50))`,
+		`INSERT INTO relatie_data VALUES ('PJJG-VW0800', 'Merel')`)
+	registry := NewRegistry(engine)
+	registry.SetTableSuffix("_data")
+	registry.SetFieldPrefix("{model}_")
+	registry.LoadEntities()
+
+	relaties, err := For[*Relatie](registry).All()
+	if err != nil {
+		t.Fatalf("TestTypedQueryType(): %s", err.Error())
+	}
+	if len(relaties) != 1 || relaties[0].Naam != "Merel" {
+		t.Errorf("TestTypedQueryType(): %v", relaties)
+	}
+	if relatie, err := For[*Relatie](registry).Get("PJJG-VW0800"); err != nil || relatie.Naam != "Merel" {
+		t.Errorf("TestTypedQueryType(): Get: %v, %v", relatie, err)
+	}
+	if relatie, err := For[*Relatie](registry).Get("PJJG-XX0000"); err != sql.ErrNoRows || relatie != nil {
+		t.Errorf("TestTypedQueryType(): Get of a missing key: %v, %v", relatie, err)
+	}
+
+	// A query that constructs models of another type returns an error
+	// instead of zero values.
+	q := For[*Relatie](registry)
+	q.Query().SetConstructor(NewModel)
+	if relaties, err := q.All(); err == nil || len(relaties) != 0 {
+		t.Errorf("TestTypedQueryType(): All: %v, %v", relaties, err)
+	}
+	if r, err := q.Get("PJJG-VW0800"); err == nil || r != nil {
+		t.Errorf("TestTypedQueryType(): Get: %v, %v", r, err)
+	}
+	if err := q.Each(func(*Relatie) error { return nil }); err == nil {
+		t.Errorf("TestTypedQueryType(): Each returns no error")
+	}
+	for r, err := range q.Iter() {
+		if err == nil || r != nil {
+			t.Errorf("TestTypedQueryType(): Iter: %v, %v", r, err)
+		}
+	}
+}
+
+func TestTypedConstructor(t *testing.T) {
+	m := TypedConstructor[*Relatie]()("relatie")
+	relatie, ok := m.(*Relatie)
+	if !ok {
+		t.Fatalf("TestTypedConstructor(): %T is not a *Relatie", m)
+	}
+	if relatie.Name() != "relatie" {
+		t.Errorf("TestTypedConstructor(): name %s", relatie.Name())
+	}
+	if relatie.Owner() != IModel(relatie) {
+		t.Errorf("TestTypedConstructor(): owner is not set")
+	}
+
+	registry := NewRegistry(makeEngine())
+	q := For[*Relatie](registry)
+	if q.Query().Model() != "relatie" {
+		t.Errorf("TestTypedConstructor(): query model %s", q.Query().Model())
+	}
+	if _, ok := q.Query().modelConstructor()("relatie").(*Relatie); !ok {
+		t.Errorf("TestTypedConstructor(): query does not construct *Relatie")
+	}
+}
+
+func TestFor(t *testing.T) {
+	engine := makeEngine()
+	db, err := engine.Connect()
+	if err != nil {
+		t.Fatalf("TestFor(): engine.Connect(): %s", err.Error())
+	}
+	defer db.Close()
+	registry := makeRegistry(engine)
+	registry.RegisterModel("patient", NewPatient)
+
+	patient, err := For[*Patient](registry).Get("PJJG-AA0010")
+	if err != nil {
+		t.Fatalf("TestFor(): geen patient gevonden: %s", err.Error())
+	}
+	if patient.Field("achternaam").String() != patient.Achternaam {
+		t.Errorf(`TestFor(): Field("achternaam").String() != Achternaam`)
+	}
+}
@@ -0,0 +1,201 @@
+package toumin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/henkburgstra/toumin/filter"
+)
+
+// ErrNoFilter is returned by Query.Update and Query.Delete for a query
+// without conditions, which would change every row of the table.
+var ErrNoFilter = errors.New("Query has no filter; use Force to change all rows")
+
+// Force allows Update and Delete of a query without conditions to change
+// every row of the table.
+func (q *Query) Force() *Query {
+	q.force = true
+	return q
+}
+
+// UpdateSql returns the UPDATE statement of Update and its parameters.
+func (q *Query) UpdateSql(values map[string]interface{}) (string, []interface{}, error) {
+	e, where, params, err := q.writeWhere()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) == 0 {
+		return "", nil, fmt.Errorf("Update of model '%s' has no values", q.model)
+	}
+	columns := make([]string, 0, len(values))
+	byColumn := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		column := e.TranslateModelField(q.model, name)
+		if _, ok := e.Fields[column]; !ok {
+			return "", nil, fmt.Errorf("Model '%s' has no field '%s'", q.model, name)
+		}
+		if v, ok := value.(*FieldValue); ok {
+			value = v.Get()
+		}
+		columns = append(columns, column)
+		byColumn[column] = value
+	}
+	sort.Strings(columns)
+
+	set := make([]string, len(columns))
+	setParams := make([]interface{}, 0, len(columns)+len(params))
+	for i, column := range columns {
+		set[i] = fmt.Sprintf("%s = ?", column)
+		setParams = append(setParams, byColumn[column])
+	}
+	sql := fmt.Sprintf("UPDATE %s SET %s", e.Name, strings.Join(set, ", "))
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	return sql, append(setParams, params...), nil
+}
+
+// DeleteSql returns the DELETE statement of Delete and its parameters.
+func (q *Query) DeleteSql() (string, []interface{}, error) {
+	e, where, params, err := q.writeWhere()
+	if err != nil {
+		return "", nil, err
+	}
+	sql := fmt.Sprintf("DELETE FROM %s", e.Name)
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	return sql, params, nil
+}
+
+// writeWhere returns the entity and WHERE condition of an UPDATE or
+// DELETE of the query, after validating its conditions.
+func (q *Query) writeWhere() (*Entity, string, []interface{}, error) {
+	if q.fromSql {
+		return nil, "", nil, fmt.Errorf("Query of model '%s' with FromSql cannot update or delete", q.model)
+	}
+	e := q.registry.Entity(q.model)
+	if e == nil {
+		return nil, "", nil, UnknownModelError{q.model}
+	}
+	for _, f := range q.filter {
+		if err := q.validateCondition(f); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	where, params := q.where()
+	if where == "" && !q.force {
+		return nil, "", nil, ErrNoFilter
+	}
+	return e, where, params, nil
+}
+
+// validateCondition checks that condition c of the query refers to fields
+// of the model of the query, with Registry.ValidateFilter for the
+// conditions of the filter package. Subqueries may refer to other models.
+func (q *Query) validateCondition(c interface{}) error {
+	switch e := c.(type) {
+	case *filter.Filter:
+		if err := q.registry.ValidateFilter(e); err != nil {
+			return err
+		}
+		return q.validateModel(e.Params)
+	case filter.Connective:
+		return q.validateCondition(filter.NewFilter(e))
+	case filter.Selectable:
+		return q.validateCondition(filter.NewFilter(e))
+	case Connective:
+		for _, op := range e.Operands {
+			if err := q.validateCondition(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Selectable:
+		if e.Entity == nil {
+			return InvalidFilterError{Field: e.Field}
+		}
+		model := q.registry.TrimTableAffixes(e.Entity.Name)
+		if _, ok := e.Entity.Fields[e.Field]; !ok {
+			return InvalidFilterError{Model: model, Field: e.Field}
+		}
+		if model != q.model {
+			return q.otherModelError(model, e.Field)
+		}
+		return nil
+	}
+	return fmt.Errorf("Filter contains an unknown condition of type %T", c)
+}
+
+// validateModel checks that the selectables of operands, outside
+// subqueries, are on the model of the query: an UPDATE or DELETE cannot
+// join the tables of other models.
+func (q *Query) validateModel(operands []interface{}) error {
+	for _, op := range operands {
+		switch e := op.(type) {
+		case filter.Connective:
+			if err := q.validateModel(e.Operands); err != nil {
+				return err
+			}
+		case filter.Selectable:
+			if e.Param.Operator == "EXISTS" || e.Param.Operator == "NEXISTS" {
+				continue
+			}
+			if e.Entity != q.model {
+				return q.otherModelError(e.Entity, e.Field)
+			}
+		}
+	}
+	return nil
+}
+
+func (q *Query) otherModelError(model, field string) error {
+	return fmt.Errorf("Condition on field '%s' of model '%s' cannot update or delete model '%s'; use a subquery",
+		field, model, q.model)
+}
+
+// Update sets the fields of the rows the query selects to values, by model
+// field name or column name, with a single UPDATE statement. A value may be
+// a *FieldValue. It returns the number of rows updated.
+//
+//	registry.Query("behandeling").Filter(filter.NewFilter(
+//		filter.Selectable{Entity: "behandeling", Field: "datum"}.Lt("2015-01-01"))).
+//		Update(map[string]interface{}{"status": "archief"})
+//
+// The conditions are validated with Registry.ValidateFilter first, and
+// must be on the model of the query, except within subqueries. Update
+// returns ErrNoFilter if the query has no conditions, or only empty
+// connectives, unless Force is set.
+func (q *Query) Update(values map[string]interface{}) (int64, error) {
+	sql, params, err := q.UpdateSql(values)
+	if err != nil {
+		return 0, err
+	}
+	return q.exec(sql, params)
+}
+
+// Delete deletes the rows the query selects with a single DELETE
+// statement and returns their number. Like Update, it returns ErrNoFilter
+// if the query has no conditions, unless Force is set.
+func (q *Query) Delete() (int64, error) {
+	sql, params, err := q.DeleteSql()
+	if err != nil {
+		return 0, err
+	}
+	return q.exec(sql, params)
+}
+
+// exec executes sql and returns the number of rows affected.
+func (q *Query) exec(sql string, params []interface{}) (int64, error) {
+	db, err := q.registry.Db()
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(sql, params...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}